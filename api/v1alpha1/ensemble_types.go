@@ -18,18 +18,209 @@ package v1alpha1
 
 import (
 	"fmt"
-	"reflect"
 
 	minicluster "github.com/flux-framework/flux-operator/api/v1alpha2"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	jobset "sigs.k8s.io/jobset/api/jobset/v1alpha2"
 )
 
 var (
 	defaultSidecarbase = "ghcr.io/converged-computing/ensemble-python:latest"
 	MiniclusterType    = "minicluster"
+	JobSetType         = "jobset"
+	JobType            = "job"
+	ExternalType       = "external"
 	UnknownType        = "unknown"
+
+	// The ensemble service sets this annotation on a member workload to request
+	// a new size (grow / shrink) for member types it cannot scale directly
+	RequestedSizeAnnotation = "ensemble.flux-framework.org/requested-size"
+
+	// Labels on the children of a member, used to match them to the member
+	EnsembleLabel = "ensemble.flux-framework.org/ensemble"
+	MemberLabel   = "ensemble.flux-framework.org/member"
+
+	// Set on a child when it is found to not belong to any member
+	OrphanedAtAnnotation = "ensemble.flux-framework.org/orphaned-at"
+)
+
+// Condition types for the Ensemble status
+const (
+	// The ensemble (gRPC) service deployment has available replicas
+	ConditionServiceReady = "ServiceReady"
+
+	// Every member of the ensemble is running (or finished)
+	ConditionMembersReady = "MembersReady"
+
+	// Every member of the ensemble has finished (completed or failed)
+	ConditionCompleted = "Completed"
+
+	// The ensemble is suspended (spec.suspend)
+	ConditionSuspended = "Suspended"
+)
+
+// MemberPhase is the lifecycle phase of an ensemble member
+type MemberPhase string
+
+const (
+	MemberPhasePending   MemberPhase = "Pending"
+	MemberPhaseRunning   MemberPhase = "Running"
+	MemberPhaseCompleted MemberPhase = "Completed"
+	MemberPhaseFailed    MemberPhase = "Failed"
+
+	// The member is waiting on the members it depends on
+	MemberPhaseBlocked MemberPhase = "Blocked"
+
+	// The ensemble is suspended, and the member is at its minimum or deleted
+	MemberPhaseSuspended MemberPhase = "Suspended"
+)
+
+// DependencyCondition is what a member waits for from a member it depends on
+type DependencyCondition string
+
+const (
+	DependencyCompleted DependencyCondition = "Completed"
+	DependencyReady     DependencyCondition = "Ready"
+)
+
+// ConfigUpdatePolicy is what to do when the ensemble yaml of a running member changes
+type ConfigUpdatePolicy string
+
+const (
+	ConfigUpdateNotify  ConfigUpdatePolicy = "Notify"
+	ConfigUpdateRestart ConfigUpdatePolicy = "Restart"
 )
 
+// RecreatePolicy is what to do when a field that cannot be updated changes
+type RecreatePolicy string
+
+const (
+	RecreateNever    RecreatePolicy = "Never"
+	RecreateRecreate RecreatePolicy = "Recreate"
+)
+
+// AddressMode is how members address the ensemble service
+type AddressMode string
+
+const (
+	AddressDNS       AddressMode = "dns"
+	AddressClusterIP AddressMode = "clusterIP"
+	AddressPodIP     AddressMode = "podIP"
+)
+
+// InstallMode is how ensemble-python is installed in a member
+type InstallMode string
+
+const (
+	InstallPip                InstallMode = "pip"
+	InstallBranch             InstallMode = "branch"
+	InstallPreinstalled       InstallMode = "preinstalled"
+	InstallWheelFromConfigMap InstallMode = "wheelFromConfigMap"
+	InstallWheelFromVolume    InstallMode = "wheelFromVolume"
+	InstallInitContainer      InstallMode = "initContainer"
+)
+
+// Install is how to install ensemble-python in the member when it starts.
+// It does not apply to external members, which run it themselves.
+type Install struct {
+
+	// Mode is one of pip (from PyPI), branch (from GitHub), preinstalled
+	// (in the image already), wheelFromConfigMap or wheelFromVolume (offline),
+	// or initContainer (copied from an image)
+	// +kubebuilder:validation:Enum=pip;branch;preinstalled;wheelFromConfigMap;wheelFromVolume;initContainer
+	// +kubebuilder:default="pip"
+	// +default="pip"
+	// +optional
+	Mode InstallMode `json:"mode,omitempty"`
+
+	// Version of ensemble-python to install with pip (latest if not set)
+	// +optional
+	Version string `json:"version,omitempty"`
+
+	// Branch of ensemble-python on GitHub to install
+	// +optional
+	Branch string `json:"branch,omitempty"`
+
+	// A ConfigMap with the wheel in binaryData. The key is the file name of
+	// the wheel (e.g., ensemble_python-0.0.1-py3-none-any.whl)
+	// +optional
+	ConfigMap *WheelConfigMap `json:"configMap,omitempty"`
+
+	// A volume with the wheel (or a directory of wheels)
+	// +optional
+	Volume *WheelVolume `json:"volume,omitempty"`
+
+	// Image with ensemble-python installed in a directory (pip install --target).
+	// For a MiniCluster, this is the flux view image, with ensemble-python in the view.
+	// +optional
+	Image string `json:"image,omitempty"`
+
+	// Path of the directory in the image to copy (not for a MiniCluster)
+	// +kubebuilder:default="/opt/ensemble-python"
+	// +default="/opt/ensemble-python"
+	// +optional
+	Path string `json:"path,omitempty"`
+}
+
+// WheelConfigMap is a ConfigMap with a wheel for ensemble-python
+type WheelConfigMap struct {
+
+	// Name of the ConfigMap
+	Name string `json:"name"`
+
+	// Key with the wheel, which is the file name of the wheel
+	Key string `json:"key"`
+}
+
+// WheelVolume is an existing volume with a wheel (or wheels) for ensemble-python
+type WheelVolume struct {
+
+	// Claim name of a PersistentVolumeClaim
+	// +optional
+	ClaimName string `json:"claimName,omitempty"`
+
+	// Path on the host
+	// +optional
+	HostPath string `json:"hostPath,omitempty"`
+
+	// Path of the wheel in the volume, or a directory of wheels (with
+	// the dependencies for ensemble-python, if they are not installed)
+	Path string `json:"path"`
+}
+
+// SidecarTLS is mutual TLS between members (and the operator) and the
+// ensemble service, so only they can send it requests
+type SidecarTLS struct {
+
+	// Enabled requires members to have a client certificate to connect to the
+	// ensemble service. The operator issues a CA for the ensemble, and
+	// certificates for the service and each member, in Secrets.
+	// +optional
+	Enabled bool `json:"enabled,omitempty"`
+
+	// A cert-manager Issuer (or ClusterIssuer) to issue the certificates
+	// instead of the operator CA. It is only used if cert-manager is installed,
+	// otherwise the operator issues them.
+	// +optional
+	IssuerRef *IssuerReference `json:"issuerRef,omitempty"`
+}
+
+// IssuerReference is a cert-manager issuer
+type IssuerReference struct {
+
+	// Name of the issuer
+	Name string `json:"name"`
+
+	// Kind of the issuer, Issuer or ClusterIssuer
+	// +kubebuilder:validation:Enum=Issuer;ClusterIssuer
+	// +kubebuilder:default="Issuer"
+	// +default="Issuer"
+	// +optional
+	Kind string `json:"kind,omitempty"`
+}
+
 // EnsembleSpec defines the desired state of Ensemble
 type EnsembleSpec struct {
 	Members []Member `json:"members"`
@@ -37,25 +228,270 @@ type EnsembleSpec struct {
 	// Definition and customization of the sidecar
 	//+optional
 	Sidecar Sidecar `json:"sidecar,omitempty"`
+
+	// Seconds to wait before deleting the children of a member that
+	// was removed from the members list (0 deletes them right away)
+	// +optional
+	OrphanGracePeriodSeconds int32 `json:"orphanGracePeriodSeconds,omitempty"`
+
+	// Seconds to keep the children of the ensemble after every member has
+	// finished (completed or failed). After, the members and the ensemble
+	// service deployment are deleted, and the Ensemble keeps its status.
+	// +optional
+	TTLSecondsAfterFinished *int32 `json:"ttlSecondsAfterFinished,omitempty"`
+
+	// Suspend the ensemble, which pauses the ensemble service and scales the
+	// members to their minimum size (or deletes them, see suspendPolicy).
+	// Setting it back to false restores (or recreates) the members.
+	// +optional
+	Suspend bool `json:"suspend,omitempty"`
+
+	// What to do with members when the ensemble is suspended. ScaleToMin
+	// keeps the members at their minimum size (and suspends JobSets, which
+	// can't be scaled in place), and Delete deletes them (keeping their
+	// config maps).
+	// +kubebuilder:validation:Enum=ScaleToMin;Delete
+	// +kubebuilder:default="ScaleToMin"
+	// +default="ScaleToMin"
+	// +optional
+	SuspendPolicy SuspendPolicy `json:"suspendPolicy,omitempty"`
 }
 
+// SuspendPolicy is what happens to members when an ensemble is suspended
+type SuspendPolicy string
+
+const (
+	SuspendScaleToMin SuspendPolicy = "ScaleToMin"
+	SuspendDelete     SuspendPolicy = "Delete"
+)
+
 // A member of the ensemble that will run for some number of times,
 // optionally with a maximum or minumum
 type Member struct {
 
+	// Name of the member, used to name and label its children (e.g.,
+	// <ensemble>-<name>). Defaults to the index of the member in the list,
+	// which changes if members are reordered or removed.
+	// +optional
+	Name string `json:"name,omitempty"`
+
 	// MiniCluster is of a type MiniCluster, the base unit of an ensemble.
 	// We do this because we install a flux metrics API within each MiniCluster to manage it
+	// The ensemble container runs the ensemble, so it cannot set a command or
+	// commands.script (use commands.pre, or another container, for setup).
 	// TODO where should the user define the size? Here or with the member?
 	// +optional
-	MiniCluster minicluster.MiniCluster `json:"minicluster,omitempty"`
+	MiniCluster *minicluster.MiniCluster `json:"minicluster,omitempty"`
+
+	// What to do when the MiniCluster spec changes in a way the Flux Operator
+	// cannot update (e.g., the image, resources, or a larger maxSize).
+	// Never keeps the existing MiniCluster (with a warning event), and
+	// Recreate deletes it so it is created again with the new spec.
+	// +kubebuilder:validation:Enum=Never;Recreate
+	// +kubebuilder:default="Never"
+	// +default="Never"
+	// +optional
+	RecreatePolicy RecreatePolicy `json:"recreatePolicy,omitempty"`
+
+	// JobSet is a member that runs the ensemble in a replicated job of a JobSet.
+	// Grow and shrink change the replicas of the scale replicated job.
+	// +optional
+	JobSet *JobSetMember `json:"jobset,omitempty"`
+
+	// Job is a member that runs the ensemble in index 0 of an Indexed Job.
+	// Grow and shrink change the parallelism (and completions) of the Job.
+	// +optional
+	Job *JobMember `json:"job,omitempty"`
+
+	// External is a member that runs outside of the cluster (e.g., on bare metal
+	// Flux). No workload is created, and grow / shrink requests are only recorded.
+	// +optional
+	External *ExternalMember `json:"external,omitempty"`
 
 	// Branch
 	// Instead of pip, install a specific branch of ensemble python
+	// Deprecated: use install with mode branch
 	// +optional
 	Branch string `json:"branch"`
 
+	// How to install ensemble-python in the member (defaults to pip)
+	// +optional
+	Install *Install `json:"install,omitempty"`
+
+	// Name of the container that runs the ensemble, for a MiniCluster,
+	// Job, or the ensemble job of a JobSet. Defaults to the first container.
+	// For a MiniCluster, this container cannot set a command or commands.script.
+	// +optional
+	EnsembleContainer string `json:"ensembleContainer,omitempty"`
+
 	// Ensemble yaml (configuration file)
-	Ensemble string `json:"ensemble"`
+	// Either this or ensembleFrom is required
+	// +optional
+	Ensemble string `json:"ensemble,omitempty"`
+
+	// EnsembleFrom is a reference to the ensemble yaml in a ConfigMap or
+	// Secret in the namespace of the ensemble, instead of inline
+	// +optional
+	EnsembleFrom *EnsembleSource `json:"ensembleFrom,omitempty"`
+
+	// What to do when the ensemble yaml changes for a running member.
+	// Notify sends the new ensemble yaml to the ensemble service, and
+	// Restart restarts the ensemble (the lead broker) to read it.
+	// +kubebuilder:validation:Enum=Notify;Restart
+	// +kubebuilder:default="Notify"
+	// +default="Notify"
+	// +optional
+	ConfigUpdatePolicy ConfigUpdatePolicy `json:"configUpdatePolicy,omitempty"`
+
+	// Number of copies of the member to create. Each copy has its own
+	// children and ensemble.yaml. With a matrix, this is per combination.
+	// Once set (even to 1), generated names end with the number of the copy
+	// (counted for each combination).
+	// +kubebuilder:validation:Minimum=1
+	// +optional
+	Replicas int32 `json:"replicas,omitempty"`
+
+	// Matrix of parameters to sweep over, with one member for each combination
+	// of values, named with a short hash of its values (so adding or removing
+	// values keeps the other names). The ensemble yaml is rendered as a Go
+	// template with the values for the member, e.g., {{ .Parameters.size }}
+	// and {{ .Replica }}
+	// +optional
+	Matrix map[string][]string `json:"matrix,omitempty"`
+
+	// Members (by name) that need to be ready or completed before
+	// this member is created
+	// +optional
+	DependsOn []Dependency `json:"dependsOn,omitempty"`
+}
+
+// EnsembleSource is where to find the ensemble yaml. Only one can be set.
+// The content is copied to the member config map, and changes are watched.
+type EnsembleSource struct {
+
+	// A key of a ConfigMap with the ensemble yaml
+	// +optional
+	ConfigMapKeyRef *corev1.ConfigMapKeySelector `json:"configMapKeyRef,omitempty"`
+
+	// A key of a Secret with the ensemble yaml
+	// +optional
+	SecretKeyRef *corev1.SecretKeySelector `json:"secretKeyRef,omitempty"`
+}
+
+// Dependency is a member that another member waits for
+type Dependency struct {
+
+	// Name of the member (spec.members[].name) to wait for
+	Name string `json:"name"`
+
+	// Wait for the member to be Completed (default) or Ready (running).
+	// Every member generated from it (replicas and matrix) must meet it.
+	// +kubebuilder:validation:Enum=Completed;Ready
+	// +kubebuilder:default="Completed"
+	// +default="Completed"
+	// +optional
+	Condition DependencyCondition `json:"condition,omitempty"`
+}
+
+// JobSetMember is a JobSet that runs an ensemble
+type JobSetMember struct {
+
+	// Spec for the JobSet. The ensemble runs in the first container
+	// of the ensemble job, and the other replicated jobs are unchanged.
+	// +kubebuilder:validation:Schemaless
+	// +kubebuilder:pruning:PreserveUnknownFields
+	// +kubebuilder:validation:Type=object
+	Spec jobset.JobSetSpec `json:"spec"`
+
+	// Name of the replicated job that runs the ensemble
+	// Defaults to the first replicated job
+	// +optional
+	EnsembleJob string `json:"ensembleJob,omitempty"`
+
+	// Name of the replicated job to change replicas for grow / shrink
+	// Defaults to the first replicated job that is not the ensemble job,
+	// and it cannot be the ensemble job
+	// +optional
+	ScaleJob string `json:"scaleJob,omitempty"`
+
+	// Minimum replicas of the scale job
+	// +optional
+	MinSize int32 `json:"minSize,omitempty"`
+
+	// Maximum replicas of the scale job (defaults to the replicas)
+	// +optional
+	MaxSize int32 `json:"maxSize,omitempty"`
+}
+
+// JobMember is an Indexed Job that runs an ensemble. Index 0 runs the
+// ensemble, and the other indices run the container command unchanged.
+type JobMember struct {
+
+	// Spec for the Job. The completion mode is always Indexed, and
+	// completions must equal parallelism so the Job is elastic.
+	// +kubebuilder:validation:Schemaless
+	// +kubebuilder:pruning:PreserveUnknownFields
+	// +kubebuilder:validation:Type=object
+	Spec batchv1.JobSpec `json:"spec"`
+
+	// Minimum parallelism of the Job
+	// +optional
+	MinSize int32 `json:"minSize,omitempty"`
+
+	// Maximum parallelism of the Job (defaults to the parallelism)
+	// +optional
+	MaxSize int32 `json:"maxSize,omitempty"`
+}
+
+// GetReplicatedJob returns the replicated job with a name, or nil
+func (j *JobSetMember) GetReplicatedJob(name string) *jobset.ReplicatedJob {
+	for i := range j.Spec.ReplicatedJobs {
+		if j.Spec.ReplicatedJobs[i].Name == name {
+			return &j.Spec.ReplicatedJobs[i]
+		}
+	}
+	return nil
+}
+
+// ExternalMember is an ensemble that runs outside of the cluster, and
+// connects to the ensemble service with credentials we generate.
+type ExternalMember struct {
+
+	// Expected size of the external member
+	// +kubebuilder:default=1
+	// +default=1
+	// +optional
+	Size int32 `json:"size,omitempty"`
+
+	// Minimum size the member can shrink to
+	// +optional
+	MinSize int32 `json:"minSize,omitempty"`
+
+	// Maximum size the member can grow to (defaults to the size)
+	// +optional
+	MaxSize int32 `json:"maxSize,omitempty"`
+
+	// Type of service to expose the ensemble service for the member. A
+	// NodePort or LoadBalancer service is reachable from outside of the
+	// cluster, so it requires tls for the ensemble service.
+	// +kubebuilder:validation:Enum=ClusterIP;NodePort;LoadBalancer
+	// +kubebuilder:default="ClusterIP"
+	// +default="ClusterIP"
+	// +optional
+	ServiceType corev1.ServiceType `json:"serviceType,omitempty"`
+
+	// Addresses (DNS names or IPs) the member connects to the ensemble
+	// service with, e.g., of a node for a NodePort. With TLS, they are added
+	// to the certificate of the ensemble service, along with the address of
+	// a LoadBalancer service.
+	// +optional
+	Hosts []string `json:"hosts,omitempty"`
+
+	// Seconds without a heartbeat before the member is considered lost
+	// +kubebuilder:default=60
+	// +default=60
+	// +optional
+	HeartbeatTimeoutSeconds int32 `json:"heartbeatTimeoutSeconds,omitempty"`
 }
 
 type Sidecar struct {
@@ -78,111 +514,293 @@ type Sidecar struct {
 	// +kubebuilder:default=10
 	// +default=10
 	Workers int32 `json:"workers"`
+
+	// Number of replicas of the ensemble service. With more than one, the
+	// replicas elect a leader with a Lease (owned by the Ensemble) so only
+	// one acts on members, and a PodDisruptionBudget keeps one available.
+	// The sidecar image must elect the leader with the Lease named in the
+	// ENSEMBLE_LEASE_NAME environment variable, otherwise every replica acts
+	// on members, so keep 1 for an image that doesn't.
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:default=1
+	// +default=1
+	// +optional
+	Replicas int32 `json:"replicas,omitempty"`
+
+	// How members address the ensemble service. dns (the default) is the
+	// service DNS name (<name>-grpc.<namespace>.svc), which stays the same if
+	// the service is recreated. clusterIP is the service ClusterIP, and podIP
+	// the IP of the ready ensemble service pod (only with one replica). When
+	// the address changes, running members are restarted with the new one.
+	// +kubebuilder:validation:Enum=dns;clusterIP;podIP
+	// +kubebuilder:default="dns"
+	// +default="dns"
+	// +optional
+	AddressMode AddressMode `json:"addressMode,omitempty"`
+
+	// Mutual TLS between members and the ensemble service
+	// +optional
+	TLS *SidecarTLS `json:"tls,omitempty"`
+
+	// PodTemplate is merged (strategic merge) onto the pod template of the
+	// ensemble service deployment, e.g., for resources, a nodeSelector,
+	// tolerations, env, or extra args. The container is "ensemble-service",
+	// and its image, command and port come from the sidecar.
+	// +kubebuilder:validation:Schemaless
+	// +kubebuilder:pruning:PreserveUnknownFields
+	// +kubebuilder:validation:Type=object
+	// +optional
+	PodTemplate *corev1.PodTemplateSpec `json:"podTemplate,omitempty"`
 }
 
+// SidecarContainerName is the name of the ensemble service container
+const SidecarContainerName = "ensemble-service"
+
+// Volumes the operator adds to the container that runs the ensemble
+const (
+	EnsembleVolumeName       = "ensemble-entrypoint"
+	EnsembleVolumePath       = "/ensemble-entrypoint"
+	EnsembleSecretVolumeName = "ensemble-secret"
+	EnsembleSecretVolumePath = "/ensemble-secret"
+	InstallVolumeName        = "ensemble-install"
+	InstallVolumePath        = "/ensemble-install"
+	TLSVolumeName            = "ensemble-tls"
+	TLSVolumePath            = "/ensemble-tls"
+)
+
 // EnsembleStatus defines the observed state of Ensemble
-type EnsembleStatus struct{}
+type EnsembleStatus struct {
+
+	// The generation of the Ensemble last processed by the controller
+	// +optional
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+
+	// Status for each member of the ensemble
+	// +listType=map
+	// +listMapKey=name
+	// +optional
+	Members []MemberStatus `json:"members,omitempty"`
+
+	// Total number of members in the ensemble
+	// +optional
+	TotalMembers int32 `json:"totalMembers,omitempty"`
+
+	// Number of members that are running or finished
+	// +optional
+	ReadyMembers int32 `json:"readyMembers,omitempty"`
+
+	// Conditions for the ensemble (ServiceReady, MembersReady, Completed)
+	// +listType=map
+	// +listMapKey=type
+	// +optional
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+
+	// Time when every member of the ensemble had finished
+	// +optional
+	CompletionTime *metav1.Time `json:"completionTime,omitempty"`
+}
+
+// MemberStatus is the observed state of a single ensemble member
+type MemberStatus struct {
+
+	// Name of the generated member (e.g., the MiniCluster name)
+	Name string `json:"name"`
+
+	// Member type (e.g., minicluster)
+	Type string `json:"type"`
+
+	// Current size of the member
+	// +optional
+	Size int32 `json:"size,omitempty"`
+
+	// Minimum size the member can shrink to
+	// +optional
+	MinSize int32 `json:"minSize,omitempty"`
+
+	// Maximum size the member can grow to
+	// +optional
+	MaxSize int32 `json:"maxSize,omitempty"`
+
+	// Phase of the member (Pending, Blocked, Suspended, Running, Completed, Failed)
+	// +optional
+	Phase MemberPhase `json:"phase,omitempty"`
+
+	// Human readable detail about the phase
+	// +optional
+	Message string `json:"message,omitempty"`
+
+	// Parameters from the matrix that were used to render the member
+	// +optional
+	Parameters map[string]string `json:"parameters,omitempty"`
+
+	// Address of the ensemble service for members outside of the cluster
+	// +optional
+	Address string `json:"address,omitempty"`
+
+	// Last time an external member reported to the ensemble service
+	// +optional
+	LastHeartbeatTime *metav1.Time `json:"lastHeartbeatTime,omitempty"`
+
+	// Last size requested (grow / shrink) for a member that cannot be scaled
+	// by the operator (e.g., external). The request is recorded, not executed.
+	// +optional
+	RequestedSize int32 `json:"requestedSize,omitempty"`
+
+	// Revision (a hash) of the ensemble yaml the member was last given
+	// +optional
+	ConfigRevision string `json:"configRevision,omitempty"`
+}
+
+// IsFinished determines if a member phase is terminal (completed or failed)
+func (p MemberPhase) IsFinished() bool {
+	return p == MemberPhaseCompleted || p == MemberPhaseFailed
+}
 
 // Helper function get member type
 func (m *Member) Type() string {
-	if !reflect.DeepEqual(m.MiniCluster, minicluster.MiniCluster{}) {
+	if m.MiniCluster != nil {
 		return MiniclusterType
 	}
+	if m.JobSet != nil {
+		return JobSetType
+	}
+	if m.Job != nil {
+		return JobType
+	}
+	if m.External != nil {
+		return ExternalType
+	}
 	return UnknownType
 }
 
+// countTypes returns the number of member types that are defined
+func (m *Member) countTypes() int {
+	count := 0
+	if m.MiniCluster != nil {
+		count += 1
+	}
+	if m.JobSet != nil {
+		count += 1
+	}
+	if m.Job != nil {
+		count += 1
+	}
+	if m.External != nil {
+		count += 1
+	}
+	return count
+}
+
 // Size is a common function to return a member size
 // This should only be used on init, as the size is then stored in status
 // As long as the MiniCluster is not created, the actual spec size won't
 // be used again.
 func (m *Member) Size() int32 {
-	if !reflect.DeepEqual(m.MiniCluster, minicluster.MiniCluster{}) {
+	if m.MiniCluster != nil {
 		return m.MiniCluster.Spec.Size
 	}
+	if m.JobSet != nil {
+		job := m.JobSet.GetReplicatedJob(m.JobSet.ScaleJob)
+		if job != nil {
+			return job.Replicas
+		}
+	}
+	if m.Job != nil && m.Job.Spec.Parallelism != nil {
+		return *m.Job.Spec.Parallelism
+	}
+	if m.External != nil {
+		return m.External.Size
+	}
 	return 0
 }
 
-func (e *Ensemble) ServiceName() string {
-	return fmt.Sprintf("%s-grpc", e.Name)
+// GetEnsembleContainer returns the index of the container that runs the
+// ensemble, by name, or the first container. It is -1 if not found.
+func (m *Member) GetEnsembleContainer() int {
+	names := []string{}
+	if m.MiniCluster != nil {
+		for _, container := range m.MiniCluster.Spec.Containers {
+			names = append(names, container.Name)
+		}
+	}
+	if spec := m.GetEnsemblePodSpec(); spec != nil {
+		for _, container := range spec.Containers {
+			names = append(names, container.Name)
+		}
+	}
+	if m.EnsembleContainer == "" {
+		if len(names) == 0 {
+			return -1
+		}
+		return 0
+	}
+	for i, name := range names {
+		if name == m.EnsembleContainer {
+			return i
+		}
+	}
+	return -1
 }
 
-// Validate ensures we have data that is needed, and sets defaults if needed
-func (e *Ensemble) Validate() error {
-	fmt.Println()
-
-	// Global (entire cluster) settings
-	fmt.Printf("🤓 Ensemble.members %d\n", len(e.Spec.Members))
-
-	// If MaxSize is set, it must be greater than size
-	if len(e.Spec.Members) < 1 {
-		return fmt.Errorf("ensemble must have at least one member")
+// GetEnsemblePodSpec returns the pod spec that runs the ensemble for a
+// Job or JobSet member, or nil
+func (m *Member) GetEnsemblePodSpec() *corev1.PodSpec {
+	if m.Job != nil {
+		return &m.Job.Spec.Template.Spec
 	}
-
-	// Validate the sidecar deployment
-	if e.Spec.Sidecar.Image == "" {
-		e.Spec.Sidecar.Image = defaultSidecarbase
+	if m.JobSet != nil {
+		job := m.JobSet.GetReplicatedJob(m.JobSet.EnsembleJob)
+		if job != nil {
+			return &job.Template.Spec.Template.Spec
+		}
 	}
+	return nil
+}
 
-	fmt.Printf("      Ensemble.Sidecar.Image: %s\n", e.Spec.Sidecar.Image)
-	fmt.Printf("      Ensemble.Sidecar.Port: %s\n", e.Spec.Sidecar.Port)
-	if e.Spec.Sidecar.ImagePullPolicy != "" {
-		fmt.Printf("      Ensemble.Sidecar.ImagePullPolicy: %v\n", e.Spec.Sidecar.ImagePullPolicy)
+// MemberName returns the name for the children of a member, from the
+// member name if it is set, otherwise the index of the member
+func (e *Ensemble) MemberName(i int) string {
+	if e.Spec.Members[i].Name != "" {
+		return fmt.Sprintf("%s-%s", e.Name, e.Spec.Members[i].Name)
 	}
+	return fmt.Sprintf("%s-%d", e.Name, i)
+}
 
-	// TODO stopped here - make interactive cluster with grpc running, shell in, and test
-	// client.
-	count := 0
-	for i, member := range e.Spec.Members {
+func (e *Ensemble) ServiceName() string {
+	return fmt.Sprintf("%s-grpc", e.Name)
+}
 
-		fmt.Printf("   => Ensemble.member %d\n", i)
+// ServiceHost is the DNS name of the ensemble service
+func (e *Ensemble) ServiceHost() string {
+	return fmt.Sprintf("%s.%s.svc", e.ServiceName(), e.Namespace)
+}
 
-		// Every member needs an ensemble, the yaml file, no exceptions.
-		if member.Ensemble == "" {
-			return fmt.Errorf("member in index %d is missing the ensemble (yaml) spec string", i)
-		}
+// TLSEnabled determines if members need a certificate for the ensemble service
+func (e *Ensemble) TLSEnabled() bool {
+	return e.Spec.Sidecar.TLS != nil && e.Spec.Sidecar.TLS.Enabled
+}
 
-		// If we have a minicluster, all three sizes must be defined
-		if !reflect.DeepEqual(member.MiniCluster, minicluster.MiniCluster{}) {
-
-			// If they don't set it, they get a very small size :)
-			if member.MiniCluster.Spec.Size <= 0 {
-				member.MiniCluster.Spec.Size = 1
-			}
-			// If MaxSize is not set, assume it's the size
-			// The Flux Operator does other validation checks, but we need this here!
-			if member.MiniCluster.Spec.MaxSize == 0 {
-				member.MiniCluster.Spec.MaxSize = member.MiniCluster.Spec.Size
-			}
-
-			// If no default image, consider an error
-			if member.MiniCluster.Spec.Containers[0].Image == "" {
-				return fmt.Errorf("ensemble minicluster must have an image")
-			}
-			fmt.Println("      Ensemble.member Type: minicluster")
-
-			if member.MiniCluster.Spec.MaxSize <= 0 || member.MiniCluster.Spec.Size <= 0 {
-				return fmt.Errorf("ensemble minicluster must have a size and maxsize of at least 1")
-			}
-			if member.MiniCluster.Spec.MinSize > member.MiniCluster.Spec.MaxSize {
-				return fmt.Errorf("ensemble minicluster min size must be smaller than max size")
-			}
-
-			if member.MiniCluster.Spec.Size < member.MiniCluster.Spec.MinSize || member.MiniCluster.Spec.Size > member.MiniCluster.Spec.MaxSize {
-				return fmt.Errorf("ensemble desired size must be between min and max size")
-			}
-
-			count += 1
-		}
-	}
-	// We shouldn't get here, but being pedantic
-	if count == 0 {
-		return fmt.Errorf("no members of the ensemble are valid")
-	}
-	return nil
+// LeaseName is the name of the Lease the ensemble service replicas use
+// to elect a leader
+func (e *Ensemble) LeaseName() string {
+	return fmt.Sprintf("%s-leader", e.Name)
+}
+
+// Validate sets defaults and ensures we have data that is needed.
+// The same checks are run by the admission webhooks.
+func (e *Ensemble) Validate() error {
+	e.Default()
+	return e.validateEnsemble().ToAggregate()
 }
 
 //+kubebuilder:object:root=true
 //+kubebuilder:subresource:status
+//+kubebuilder:printcolumn:name="Members",type="integer",JSONPath=".status.totalMembers"
+//+kubebuilder:printcolumn:name="Ready",type="integer",JSONPath=".status.readyMembers"
+//+kubebuilder:printcolumn:name="Service",type="string",JSONPath=".status.conditions[?(@.type==\"ServiceReady\")].status"
+//+kubebuilder:printcolumn:name="Suspended",type="boolean",JSONPath=".spec.suspend"
+//+kubebuilder:printcolumn:name="Completed",type="string",JSONPath=".status.conditions[?(@.type==\"Completed\")].status"
+//+kubebuilder:printcolumn:name="Age",type="date",JSONPath=".metadata.creationTimestamp"
 
 // Ensemble is the Schema for the ensembles API
 type Ensemble struct {
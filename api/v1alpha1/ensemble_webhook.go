@@ -0,0 +1,871 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	ctrl "sigs.k8s.io/controller-runtime"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	"github.com/converged-computing/ensemble-operator/pkg/ensemblefile"
+)
+
+var (
+	ensemblelog = logf.Log.WithName("ensemble-resource")
+
+	defaultSidecarPort    = "50051"
+	defaultSidecarWorkers = int32(10)
+
+	defaultHeartbeatTimeout = int32(60)
+	defaultInstallPath      = "/opt/ensemble-python"
+
+	// Limit for the members generated by replicas and the matrix
+	maxGeneratedMembers = 500
+	matrixKeyRegex      = regexp.MustCompile("^[a-zA-Z][a-zA-Z0-9_]*$")
+)
+
+// SetupWebhookWithManager registers the defaulting and validating webhooks
+func (e *Ensemble) SetupWebhookWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewWebhookManagedBy(mgr).
+		For(e).
+		Complete()
+}
+
+//+kubebuilder:webhook:path=/mutate-ensemble-flux-framework-org-v1alpha1-ensemble,mutating=true,failurePolicy=fail,sideEffects=None,groups=ensemble.flux-framework.org,resources=ensembles,verbs=create;update,versions=v1alpha1,name=mensemble.kb.io,admissionReviewVersions=v1
+
+var _ webhook.Defaulter = &Ensemble{}
+
+// Default sets defaults for the sidecar and members, so they are
+// persisted with the Ensemble instead of being derived at reconcile.
+func (e *Ensemble) Default() {
+	if e.Spec.Sidecar.Image == "" {
+		e.Spec.Sidecar.Image = defaultSidecarbase
+	}
+	if e.Spec.Sidecar.Port == "" {
+		e.Spec.Sidecar.Port = defaultSidecarPort
+	}
+	if e.Spec.Sidecar.Workers <= 0 {
+		e.Spec.Sidecar.Workers = defaultSidecarWorkers
+	}
+	if e.Spec.Sidecar.Replicas <= 0 {
+		e.Spec.Sidecar.Replicas = 1
+	}
+	if e.Spec.Sidecar.AddressMode == "" {
+		e.Spec.Sidecar.AddressMode = AddressDNS
+	}
+	if e.Spec.Sidecar.TLS != nil && e.Spec.Sidecar.TLS.IssuerRef != nil && e.Spec.Sidecar.TLS.IssuerRef.Kind == "" {
+		e.Spec.Sidecar.TLS.IssuerRef.Kind = "Issuer"
+	}
+	if e.Spec.SuspendPolicy == "" {
+		e.Spec.SuspendPolicy = SuspendScaleToMin
+	}
+
+	for i := range e.Spec.Members {
+		member := &e.Spec.Members[i]
+		if member.ConfigUpdatePolicy == "" {
+			member.ConfigUpdatePolicy = ConfigUpdateNotify
+		}
+		if member.RecreatePolicy == "" {
+			member.RecreatePolicy = RecreateNever
+		}
+		defaultInstall(member)
+		for j := range member.DependsOn {
+			if member.DependsOn[j].Condition == "" {
+				member.DependsOn[j].Condition = DependencyCompleted
+			}
+		}
+		if member.Type() == MiniclusterType {
+
+			// If they don't set it, they get a very small size :)
+			if member.MiniCluster.Spec.Size <= 0 {
+				member.MiniCluster.Spec.Size = 1
+			}
+			// If MaxSize is not set, assume it's the size
+			// The Flux Operator does other validation checks, but we need this here!
+			if member.MiniCluster.Spec.MaxSize == 0 {
+				member.MiniCluster.Spec.MaxSize = member.MiniCluster.Spec.Size
+			}
+		}
+		if member.Type() == JobSetType {
+			defaultJobSet(member.JobSet)
+		}
+		if member.Type() == JobType {
+			defaultJob(member.Job)
+		}
+		if member.Type() == ExternalType {
+			defaultExternal(member.External)
+		}
+	}
+}
+
+// defaultJobSet chooses the ensemble and scale jobs, and the size bounds
+func defaultJobSet(spec *JobSetMember) {
+	jobs := spec.Spec.ReplicatedJobs
+	if len(jobs) == 0 {
+		return
+	}
+	for i := range jobs {
+		if jobs[i].Replicas <= 0 {
+			jobs[i].Replicas = 1
+		}
+	}
+	if spec.EnsembleJob == "" {
+		spec.EnsembleJob = jobs[0].Name
+	}
+
+	// The scale job defaults to the first that isn't running the ensemble
+	if spec.ScaleJob == "" {
+		for _, job := range jobs {
+			if job.Name != spec.EnsembleJob {
+				spec.ScaleJob = job.Name
+				break
+			}
+		}
+	}
+	job := spec.GetReplicatedJob(spec.ScaleJob)
+	if job != nil && spec.MaxSize == 0 {
+		spec.MaxSize = job.Replicas
+	}
+}
+
+// defaultJob makes the Job indexed and elastic, and sets the size bounds
+func defaultJob(spec *JobMember) {
+	mode := batchv1.IndexedCompletion
+	spec.Spec.CompletionMode = &mode
+
+	// Completions must equal parallelism to change them together
+	if spec.Spec.Parallelism == nil || *spec.Spec.Parallelism <= 0 {
+		parallelism := int32(1)
+		if spec.Spec.Completions != nil && *spec.Spec.Completions > 0 {
+			parallelism = *spec.Spec.Completions
+		}
+		spec.Spec.Parallelism = &parallelism
+	}
+	if spec.Spec.Completions == nil {
+		completions := *spec.Spec.Parallelism
+		spec.Spec.Completions = &completions
+	}
+	if spec.MaxSize == 0 {
+		spec.MaxSize = *spec.Spec.Parallelism
+	}
+}
+
+// defaultExternal sets the size, service type and heartbeat timeout
+func defaultExternal(spec *ExternalMember) {
+	if spec.Size <= 0 {
+		spec.Size = 1
+	}
+	if spec.MaxSize == 0 {
+		spec.MaxSize = spec.Size
+	}
+	if spec.ServiceType == "" {
+		spec.ServiceType = corev1.ServiceTypeClusterIP
+	}
+	if spec.HeartbeatTimeoutSeconds <= 0 {
+		spec.HeartbeatTimeoutSeconds = defaultHeartbeatTimeout
+	}
+}
+
+//+kubebuilder:webhook:path=/validate-ensemble-flux-framework-org-v1alpha1-ensemble,mutating=false,failurePolicy=fail,sideEffects=None,groups=ensemble.flux-framework.org,resources=ensembles,verbs=create;update,versions=v1alpha1,name=vensemble.kb.io,admissionReviewVersions=v1
+
+var _ webhook.Validator = &Ensemble{}
+
+// ValidateCreate implements webhook.Validator
+func (e *Ensemble) ValidateCreate() (admission.Warnings, error) {
+	ensemblelog.Info("validate create", "name", e.Name)
+	return nil, e.invalid(e.validateEnsemble())
+}
+
+// ValidateUpdate implements webhook.Validator
+func (e *Ensemble) ValidateUpdate(old runtime.Object) (admission.Warnings, error) {
+	ensemblelog.Info("validate update", "name", e.Name)
+	return nil, e.invalid(e.validateEnsemble())
+}
+
+// ValidateDelete implements webhook.Validator (nothing to check on delete)
+func (e *Ensemble) ValidateDelete() (admission.Warnings, error) {
+	return nil, nil
+}
+
+// invalid wraps a list of field errors into an Invalid API error
+func (e *Ensemble) invalid(allErrs field.ErrorList) error {
+	if len(allErrs) == 0 {
+		return nil
+	}
+	return apierrors.NewInvalid(
+		schema.GroupKind{Group: GroupVersion.Group, Kind: "Ensemble"},
+		e.Name, allErrs,
+	)
+}
+
+// validateEnsemble checks the spec, returning errors with field paths
+func (e *Ensemble) validateEnsemble() field.ErrorList {
+	allErrs := field.ErrorList{}
+	specPath := field.NewPath("spec")
+
+	// The service name must be a valid DNS-1035 label
+	namePath := field.NewPath("metadata").Child("name")
+	for _, msg := range validation.IsDNS1035Label(e.ServiceName()) {
+		allErrs = append(allErrs, field.Invalid(namePath, e.Name,
+			fmt.Sprintf("generated service name %q is invalid: %s", e.ServiceName(), msg)))
+	}
+
+	// Validate the sidecar deployment
+	sidecarPath := specPath.Child("sidecar")
+	port, err := strconv.Atoi(e.Spec.Sidecar.Port)
+	if err != nil || port < 1 || port > 65535 {
+		allErrs = append(allErrs, field.Invalid(sidecarPath.Child("port"), e.Spec.Sidecar.Port,
+			"must be a port number between 1 and 65535"))
+	}
+	if e.Spec.Sidecar.Workers < 1 {
+		allErrs = append(allErrs, field.Invalid(sidecarPath.Child("workers"), e.Spec.Sidecar.Workers,
+			"must be at least 1"))
+	}
+	switch e.Spec.Sidecar.AddressMode {
+	case AddressDNS, AddressClusterIP, AddressPodIP:
+	default:
+		allErrs = append(allErrs, field.NotSupported(sidecarPath.Child("addressMode"), e.Spec.Sidecar.AddressMode,
+			[]string{string(AddressDNS), string(AddressClusterIP), string(AddressPodIP)}))
+	}
+
+	// Members would be restarted when a different replica is chosen
+	if e.Spec.Sidecar.AddressMode == AddressPodIP && e.Spec.Sidecar.Replicas > 1 {
+		allErrs = append(allErrs, field.Invalid(sidecarPath.Child("addressMode"), e.Spec.Sidecar.AddressMode,
+			"podIP can only be used with one replica, use dns or clusterIP to address more than one"))
+	}
+	if e.Spec.Sidecar.TLS != nil && e.Spec.Sidecar.TLS.IssuerRef != nil {
+		issuerPath := sidecarPath.Child("tls", "issuerRef")
+		issuer := e.Spec.Sidecar.TLS.IssuerRef
+		if issuer.Name == "" {
+			allErrs = append(allErrs, field.Required(issuerPath.Child("name"), "the name of the cert-manager issuer"))
+		}
+		if issuer.Kind != "Issuer" && issuer.Kind != "ClusterIssuer" {
+			allErrs = append(allErrs, field.NotSupported(issuerPath.Child("kind"), issuer.Kind, []string{"Issuer", "ClusterIssuer"}))
+		}
+	}
+	if e.Spec.Sidecar.PodTemplate != nil {
+		allErrs = append(allErrs, e.validatePodTemplate(port, sidecarPath.Child("podTemplate"))...)
+	}
+
+	if e.Spec.SuspendPolicy != SuspendScaleToMin && e.Spec.SuspendPolicy != SuspendDelete {
+		allErrs = append(allErrs, field.NotSupported(specPath.Child("suspendPolicy"), e.Spec.SuspendPolicy,
+			[]string{string(SuspendScaleToMin), string(SuspendDelete)}))
+	}
+	if e.Spec.TTLSecondsAfterFinished != nil && *e.Spec.TTLSecondsAfterFinished < 0 {
+		allErrs = append(allErrs, field.Invalid(specPath.Child("ttlSecondsAfterFinished"),
+			*e.Spec.TTLSecondsAfterFinished, "must be 0 or more"))
+	}
+	if e.Spec.OrphanGracePeriodSeconds < 0 {
+		allErrs = append(allErrs, field.Invalid(specPath.Child("orphanGracePeriodSeconds"),
+			e.Spec.OrphanGracePeriodSeconds, "must be 0 or more"))
+	}
+
+	membersPath := specPath.Child("members")
+	if len(e.Spec.Members) < 1 {
+		allErrs = append(allErrs, field.Required(membersPath, "ensemble must have at least one member"))
+	}
+	for i := range e.Spec.Members {
+		allErrs = append(allErrs, e.validateMember(i, membersPath.Index(i))...)
+	}
+
+	// The number of members is checked before they are generated (and the
+	// count stops at the limit, so it isn't shown)
+	if e.CountMembers() > maxGeneratedMembers {
+		return append(allErrs, field.TooMany(membersPath, -1, maxGeneratedMembers))
+	}
+	if len(allErrs) > 0 {
+		return allErrs
+	}
+
+	// Members cannot depend on each other in a cycle
+	_, err = e.MemberOrder()
+	if err != nil {
+		return append(allErrs, field.Invalid(membersPath, len(e.Spec.Members), err.Error()))
+	}
+
+	// Replicas and the matrix generate members, and each needs a unique name
+	// and an ensemble yaml that renders
+	generated, err := e.GetMembers()
+	if err != nil {
+		return append(allErrs, field.Invalid(membersPath, len(e.Spec.Members), err.Error()))
+	}
+	names := map[string]int{}
+	seen := map[string]bool{}
+	for _, member := range generated {
+		path := membersPath.Index(member.Index)
+		for _, msg := range validation.IsDNS1123Label(member.Name) {
+			allErrs = append(allErrs, field.Invalid(path, member.Name, fmt.Sprintf("generated member name is invalid: %s", msg)))
+		}
+
+		// Two members cannot generate the same name (e.g., a name of "0")
+		if j, ok := names[member.Name]; ok {
+			allErrs = append(allErrs, field.Duplicate(path.Child("name"),
+				fmt.Sprintf("%s (also generated by member %d)", member.Name, j)))
+		}
+		names[member.Name] = member.Index
+		allErrs = append(allErrs, validateMemberVolume(&member, path)...)
+
+		// The ensemble yaml (after rendering) must be something ensemble-python can run
+		// Generated members often have the same errors, and we only show them once
+		for _, err := range validateEnsembleFile(member.Member.Ensemble, path.Child("ensemble")) {
+			if !seen[err.Error()] {
+				allErrs = append(allErrs, err)
+			}
+			seen[err.Error()] = true
+		}
+	}
+	return allErrs
+}
+
+// validateMemberVolume checks the ensemble container of a MiniCluster doesn't
+// have a volume named for the member, since the member config is mounted with
+// the member name as the volume key
+func validateMemberVolume(member *GeneratedMember, path *field.Path) field.ErrorList {
+	allErrs := field.ErrorList{}
+	if member.Member.Type() != MiniclusterType {
+		return allErrs
+	}
+	index := member.Member.GetEnsembleContainer()
+	if index < 0 {
+		return allErrs
+	}
+	if _, ok := member.Member.MiniCluster.Spec.Containers[index].Volumes[member.Name]; ok {
+		volumePath := path.Child("minicluster", "spec", "containers").Index(index).Child("volumes").Key(member.Name)
+		allErrs = append(allErrs, field.Invalid(volumePath, member.Name,
+			"the volume name is used by the operator for the member config"))
+	}
+	return allErrs
+}
+
+// validateEnsembleFile parses and validates the ensemble yaml. An ensemble from a
+// ConfigMap or Secret is empty here, and is validated when the controller reads it.
+func validateEnsembleFile(content string, path *field.Path) field.ErrorList {
+	if content == "" {
+		return nil
+	}
+	file, err := ensemblefile.Parse(content)
+	if err != nil {
+		return field.ErrorList{field.Invalid(path, "", err.Error())}
+	}
+	return file.Validate(path)
+}
+
+// validateMember checks a single member of the ensemble
+func (e *Ensemble) validateMember(i int, path *field.Path) field.ErrorList {
+	allErrs := field.ErrorList{}
+	member := &e.Spec.Members[i]
+
+	// Every member needs an ensemble, the yaml file, no exceptions.
+	// It can be inline, or a reference to a ConfigMap or Secret
+	if member.Ensemble == "" && member.EnsembleFrom == nil {
+		allErrs = append(allErrs, field.Required(path.Child("ensemble"), "the ensemble (yaml) spec string or ensembleFrom is required"))
+	}
+	if member.Ensemble != "" && member.EnsembleFrom != nil {
+		allErrs = append(allErrs, field.Forbidden(path.Child("ensembleFrom"), "only one of ensemble or ensembleFrom can be set"))
+	}
+	if member.EnsembleFrom != nil {
+		allErrs = append(allErrs, validateEnsembleSource(member.EnsembleFrom, path.Child("ensembleFrom"))...)
+	}
+
+	// We can only restart members that run in the cluster
+	policies := []string{string(ConfigUpdateNotify), string(ConfigUpdateRestart)}
+	policyPath := path.Child("configUpdatePolicy")
+	switch member.ConfigUpdatePolicy {
+	case ConfigUpdateNotify:
+	case ConfigUpdateRestart:
+		if member.External != nil {
+			allErrs = append(allErrs, field.Invalid(policyPath, member.ConfigUpdatePolicy, "an external member cannot be restarted"))
+		}
+	default:
+		allErrs = append(allErrs, field.NotSupported(policyPath, member.ConfigUpdatePolicy, policies))
+	}
+	allErrs = append(allErrs, validateInstall(member, path.Child("install"))...)
+	if member.RecreatePolicy != RecreateNever && member.RecreatePolicy != RecreateRecreate {
+		allErrs = append(allErrs, field.NotSupported(path.Child("recreatePolicy"), member.RecreatePolicy,
+			[]string{string(RecreateNever), string(RecreateRecreate)}))
+	}
+
+	// Member names are used in generated names and labels
+	if member.Name != "" {
+		for _, msg := range validation.IsDNS1123Label(member.Name) {
+			allErrs = append(allErrs, field.Invalid(path.Child("name"), member.Name, msg))
+		}
+	}
+
+	// Matrix values are accessed in the template as {{ .Parameters.<key> }}
+	for key, values := range member.Matrix {
+		if !matrixKeyRegex.MatchString(key) {
+			allErrs = append(allErrs, field.Invalid(path.Child("matrix").Key(key), key,
+				"must start with a letter and only contain letters, numbers and underscores"))
+		}
+		if len(values) == 0 {
+			allErrs = append(allErrs, field.Required(path.Child("matrix").Key(key), "must have at least one value"))
+		}
+	}
+	if member.Replicas < 0 {
+		allErrs = append(allErrs, field.Invalid(path.Child("replicas"), member.Replicas, "must be at least 1"))
+	}
+
+	// Dependencies are by member name
+	seen := map[string]bool{}
+	for j, dependency := range member.DependsOn {
+		dependencyPath := path.Child("dependsOn").Index(j)
+		switch {
+		case member.Name != "" && dependency.Name == member.Name:
+			allErrs = append(allErrs, field.Invalid(dependencyPath.Child("name"), dependency.Name, "a member cannot depend on itself"))
+		case e.GetMemberIndex(dependency.Name) < 0:
+			allErrs = append(allErrs, field.NotFound(dependencyPath.Child("name"), dependency.Name))
+		case seen[dependency.Name]:
+			allErrs = append(allErrs, field.Duplicate(dependencyPath.Child("name"), dependency.Name))
+		}
+		seen[dependency.Name] = true
+		if dependency.Condition != DependencyCompleted && dependency.Condition != DependencyReady {
+			allErrs = append(allErrs, field.NotSupported(dependencyPath.Child("condition"), dependency.Condition,
+				[]string{string(DependencyCompleted), string(DependencyReady)}))
+		}
+	}
+
+	if member.countTypes() > 1 {
+		allErrs = append(allErrs, field.Invalid(path, member.Type(), "a member can only have one type"))
+	}
+
+	// The ensemble container is selected by name (or the first container)
+	if member.EnsembleContainer != "" && member.Type() != ExternalType && member.GetEnsembleContainer() < 0 {
+		allErrs = append(allErrs, field.NotFound(path.Child("ensembleContainer"), member.EnsembleContainer))
+	}
+
+	switch member.Type() {
+	case MiniclusterType:
+		allErrs = append(allErrs, validateMiniCluster(member, path.Child("minicluster"))...)
+	case JobSetType:
+		allErrs = append(allErrs, validateJobSet(member, path.Child("jobset"))...)
+	case JobType:
+		allErrs = append(allErrs, validateJob(member, path.Child("job"))...)
+	case ExternalType:
+		allErrs = append(allErrs, validateExternal(member, path.Child("external"), e.TLSEnabled())...)
+	default:
+		allErrs = append(allErrs, field.Required(path, "a member type (e.g., minicluster) is required"))
+	}
+	return allErrs
+}
+
+// validateJobSet checks the ensemble and scale jobs for a JobSet member
+func validateJobSet(member *Member, path *field.Path) field.ErrorList {
+	allErrs := field.ErrorList{}
+	spec := member.JobSet
+	jobsPath := path.Child("spec").Child("replicatedJobs")
+
+	if len(spec.Spec.ReplicatedJobs) == 0 {
+		return append(allErrs, field.Required(jobsPath, "jobset must have at least one replicated job"))
+	}
+
+	ensembleJob := spec.GetReplicatedJob(spec.EnsembleJob)
+	if ensembleJob == nil {
+		allErrs = append(allErrs, field.NotFound(path.Child("ensembleJob"), spec.EnsembleJob))
+	} else {
+		containers := ensembleJob.Template.Spec.Template.Spec.Containers
+		if len(containers) == 0 {
+			allErrs = append(allErrs, field.Required(path.Child("ensembleJob"), "the ensemble job must have a container"))
+		} else if containers[0].Image == "" {
+			allErrs = append(allErrs, field.Required(path.Child("ensembleJob"), "the ensemble job container must have an image"))
+		}
+		allErrs = append(allErrs, validateEnsemblePodSpec(member, path.Child("ensembleJob"))...)
+	}
+
+	// Scaling recreates the pods of the scale job, so it cannot run the ensemble
+	if spec.ScaleJob == "" {
+		return append(allErrs, field.Required(path.Child("scaleJob"),
+			"jobset must have a replicated job to scale that is not the ensemble job"))
+	}
+	if spec.ScaleJob == spec.EnsembleJob {
+		return append(allErrs, field.Invalid(path.Child("scaleJob"), spec.ScaleJob,
+			"the scale job must be a different replicated job than the ensemble job"))
+	}
+	scaleJob := spec.GetReplicatedJob(spec.ScaleJob)
+	if scaleJob == nil {
+		return append(allErrs, field.NotFound(path.Child("scaleJob"), spec.ScaleJob))
+	}
+	if spec.MaxSize <= 0 {
+		allErrs = append(allErrs, field.Invalid(path.Child("maxSize"), spec.MaxSize, "must be at least 1"))
+	}
+	if spec.MinSize > spec.MaxSize {
+		allErrs = append(allErrs, field.Invalid(path.Child("minSize"), spec.MinSize, "min size must be smaller than max size"))
+	}
+	if scaleJob.Replicas < spec.MinSize || scaleJob.Replicas > spec.MaxSize {
+		allErrs = append(allErrs, field.Invalid(path.Child("scaleJob"), scaleJob.Replicas, "scale job replicas must be between min and max size"))
+	}
+	return allErrs
+}
+
+// validateJob checks the container and elastic sizes for a Job member
+func validateJob(member *Member, path *field.Path) field.ErrorList {
+	allErrs := field.ErrorList{}
+	spec := member.Job
+	specPath := path.Child("spec")
+
+	containers := spec.Spec.Template.Spec.Containers
+	containersPath := specPath.Child("template", "spec", "containers")
+	if len(containers) == 0 {
+		allErrs = append(allErrs, field.Required(containersPath, "job must have a container"))
+	} else if containers[0].Image == "" {
+		allErrs = append(allErrs, field.Required(containersPath.Index(0).Child("image"), "job must have an image"))
+	}
+	allErrs = append(allErrs, validateEnsemblePodSpec(member, specPath.Child("template", "spec"))...)
+
+	if spec.Spec.CompletionMode == nil || *spec.Spec.CompletionMode != batchv1.IndexedCompletion {
+		allErrs = append(allErrs, field.NotSupported(specPath.Child("completionMode"),
+			spec.Spec.CompletionMode, []string{string(batchv1.IndexedCompletion)}))
+	}
+	if spec.Spec.Parallelism == nil || spec.Spec.Completions == nil {
+		return append(allErrs, field.Required(specPath.Child("parallelism"), "parallelism and completions are required"))
+	}
+	parallelism := *spec.Spec.Parallelism
+	if *spec.Spec.Completions != parallelism {
+		allErrs = append(allErrs, field.Invalid(specPath.Child("completions"), *spec.Spec.Completions,
+			"completions must equal parallelism for the job to grow and shrink"))
+	}
+	if spec.MaxSize <= 0 {
+		allErrs = append(allErrs, field.Invalid(path.Child("maxSize"), spec.MaxSize, "must be at least 1"))
+	}
+	if spec.MinSize > spec.MaxSize {
+		allErrs = append(allErrs, field.Invalid(path.Child("minSize"), spec.MinSize, "min size must be smaller than max size"))
+	}
+	if parallelism < spec.MinSize || parallelism > spec.MaxSize {
+		allErrs = append(allErrs, field.Invalid(specPath.Child("parallelism"), parallelism, "parallelism must be between min and max size"))
+	}
+	return allErrs
+}
+
+// validateExternal checks the sizes and service for an external member. A
+// service that is reachable from outside of the cluster requires TLS.
+func validateExternal(member *Member, path *field.Path, tls bool) field.ErrorList {
+	allErrs := field.ErrorList{}
+	spec := member.External
+
+	switch spec.ServiceType {
+	case corev1.ServiceTypeClusterIP:
+	case corev1.ServiceTypeNodePort, corev1.ServiceTypeLoadBalancer:
+		if !tls {
+			allErrs = append(allErrs, field.Invalid(path.Child("serviceType"), spec.ServiceType,
+				"a service reachable from outside of the cluster requires sidecar.tls to be enabled"))
+		}
+	default:
+		allErrs = append(allErrs, field.NotSupported(path.Child("serviceType"), spec.ServiceType, []string{
+			string(corev1.ServiceTypeClusterIP),
+			string(corev1.ServiceTypeNodePort),
+			string(corev1.ServiceTypeLoadBalancer),
+		}))
+	}
+	for i, host := range spec.Hosts {
+		if net.ParseIP(host) == nil && len(validation.IsDNS1123Subdomain(host)) > 0 {
+			allErrs = append(allErrs, field.Invalid(path.Child("hosts").Index(i), host, "must be a DNS name or an IP address"))
+		}
+	}
+	if spec.HeartbeatTimeoutSeconds < 1 {
+		allErrs = append(allErrs, field.Invalid(path.Child("heartbeatTimeoutSeconds"), spec.HeartbeatTimeoutSeconds, "must be at least 1"))
+	}
+	if spec.MaxSize <= 0 {
+		allErrs = append(allErrs, field.Invalid(path.Child("maxSize"), spec.MaxSize, "must be at least 1"))
+	}
+	if spec.MinSize > spec.MaxSize {
+		allErrs = append(allErrs, field.Invalid(path.Child("minSize"), spec.MinSize, "min size must be smaller than max size"))
+	}
+	if spec.Size < spec.MinSize || spec.Size > spec.MaxSize {
+		allErrs = append(allErrs, field.Invalid(path.Child("size"), spec.Size, "desired size must be between min and max size"))
+	}
+	return allErrs
+}
+
+// validateMiniCluster checks the sizes and container for a MiniCluster member
+func validateMiniCluster(member *Member, path *field.Path) field.ErrorList {
+	allErrs := field.ErrorList{}
+	spec := member.MiniCluster.Spec
+	specPath := path.Child("spec")
+
+	// If no default image, consider an error
+	if len(spec.Containers) == 0 {
+		allErrs = append(allErrs, field.Required(specPath.Child("containers"), "minicluster must have a container"))
+	} else if spec.Containers[0].Image == "" {
+		allErrs = append(allErrs, field.Required(specPath.Child("containers").Index(0).Child("image"), "minicluster must have an image"))
+	}
+	allErrs = append(allErrs, validateMiniClusterContainers(member, specPath.Child("containers"))...)
+
+	if spec.Size <= 0 {
+		allErrs = append(allErrs, field.Invalid(specPath.Child("size"), spec.Size, "must be at least 1"))
+	}
+	if spec.MaxSize <= 0 {
+		allErrs = append(allErrs, field.Invalid(specPath.Child("maxSize"), spec.MaxSize, "must be at least 1"))
+	}
+	if spec.MinSize > spec.MaxSize {
+		allErrs = append(allErrs, field.Invalid(specPath.Child("minSize"), spec.MinSize, "min size must be smaller than max size"))
+	}
+	if spec.Size < spec.MinSize || spec.Size > spec.MaxSize {
+		allErrs = append(allErrs, field.Invalid(specPath.Child("size"), spec.Size, "desired size must be between min and max size"))
+	}
+	return allErrs
+}
+
+// validateMiniClusterContainers checks that the container that runs the ensemble
+// can be merged with the volumes and commands the operator adds. User volumes
+// are kept and the install command is appended to commands.pre, but the
+// ensemble is the command of the container.
+func validateMiniClusterContainers(member *Member, path *field.Path) field.ErrorList {
+	allErrs := field.ErrorList{}
+	index := member.GetEnsembleContainer()
+	if index < 0 {
+		return allErrs
+	}
+	for i, container := range member.MiniCluster.Spec.Containers {
+		containerPath := path.Index(i)
+		if i != index {
+			if container.RunFlux {
+				allErrs = append(allErrs, field.Invalid(containerPath.Child("runFlux"), container.RunFlux,
+					"only the ensemble container can run flux"))
+			}
+			continue
+		}
+		if container.Command != "" {
+			allErrs = append(allErrs, field.Invalid(containerPath.Child("command"), container.Command,
+				"the ensemble container runs the ensemble, use commands.pre or another container"))
+		}
+		if container.Commands.Script != "" {
+			allErrs = append(allErrs, field.Invalid(containerPath.Child("commands", "script"), container.Commands.Script,
+				"the ensemble container runs the ensemble, use commands.pre or another container"))
+		}
+		for name, volume := range container.Volumes {
+			volumePath := containerPath.Child("volumes").Key(name)
+			if name == InstallVolumeName || name == TLSVolumeName || name == EnsembleSecretVolumeName {
+				allErrs = append(allErrs, field.Invalid(volumePath, name, "the volume name is used by the operator"))
+			}
+			if isOperatorVolumePath(volume.Path) {
+				allErrs = append(allErrs, field.Invalid(volumePath.Child("path"), volume.Path, "the path is used by the operator"))
+			}
+		}
+	}
+	return allErrs
+}
+
+// validateEnsemblePodSpec checks that the pod spec of a Job or JobSet does not
+// use the volumes the operator adds to the container that runs the ensemble
+func validateEnsemblePodSpec(member *Member, path *field.Path) field.ErrorList {
+	allErrs := field.ErrorList{}
+	spec := member.GetEnsemblePodSpec()
+	index := member.GetEnsembleContainer()
+	if spec == nil || index < 0 {
+		return allErrs
+	}
+	for i, volume := range spec.Volumes {
+		if volume.Name == EnsembleVolumeName || volume.Name == InstallVolumeName ||
+			volume.Name == TLSVolumeName || volume.Name == EnsembleSecretVolumeName {
+			allErrs = append(allErrs, field.Invalid(path.Child("volumes").Index(i).Child("name"), volume.Name,
+				"the volume name is used by the operator"))
+		}
+	}
+	for i, container := range spec.InitContainers {
+		if container.Name == InstallVolumeName {
+			allErrs = append(allErrs, field.Invalid(path.Child("initContainers").Index(i).Child("name"), container.Name,
+				"the init container name is used by the operator"))
+		}
+	}
+	mountsPath := path.Child("containers").Index(index).Child("volumeMounts")
+	for i, mount := range spec.Containers[index].VolumeMounts {
+		if isOperatorVolumePath(mount.MountPath) {
+			allErrs = append(allErrs, field.Invalid(mountsPath.Index(i).Child("mountPath"), mount.MountPath,
+				"the path is used by the operator"))
+		}
+	}
+	return allErrs
+}
+
+// isOperatorVolumePath determines if a path is used by a volume the operator adds
+func isOperatorVolumePath(path string) bool {
+	return path == EnsembleVolumePath || path == EnsembleSecretVolumePath ||
+		path == InstallVolumePath || path == TLSVolumePath
+}
+
+// validateEnsembleSource checks that exactly one reference is set, with a name and key
+func validateEnsembleSource(source *EnsembleSource, path *field.Path) field.ErrorList {
+	allErrs := field.ErrorList{}
+	if source.ConfigMapKeyRef != nil && source.SecretKeyRef != nil {
+		allErrs = append(allErrs, field.Forbidden(path, "only one of configMapKeyRef or secretKeyRef can be set"))
+		return allErrs
+	}
+	name, key := "", ""
+	refPath := path.Child("configMapKeyRef")
+	if source.ConfigMapKeyRef != nil {
+		name, key = source.ConfigMapKeyRef.Name, source.ConfigMapKeyRef.Key
+	} else if source.SecretKeyRef != nil {
+		name, key = source.SecretKeyRef.Name, source.SecretKeyRef.Key
+		refPath = path.Child("secretKeyRef")
+	} else {
+		allErrs = append(allErrs, field.Required(path, "one of configMapKeyRef or secretKeyRef is required"))
+		return allErrs
+	}
+	if name == "" {
+		allErrs = append(allErrs, field.Required(refPath.Child("name"), "the name of the object with the ensemble yaml is required"))
+	}
+	if key == "" {
+		allErrs = append(allErrs, field.Required(refPath.Child("key"), "the key with the ensemble yaml is required"))
+	}
+	return allErrs
+}
+
+// validatePodTemplate checks the sidecar pod template does not change what the
+// service (and members) depend on: the labels it selects, the subdomain and
+// service account, and the image, command and port of the service container.
+func (e *Ensemble) validatePodTemplate(port int, path *field.Path) field.ErrorList {
+	allErrs := field.ErrorList{}
+	template := e.Spec.Sidecar.PodTemplate
+
+	// These labels are the deployment selector, and the service selector
+	labelsPath := path.Child("metadata", "labels")
+	for key, value := range map[string]string{"app": e.Name, "operator": "ensemble-operator"} {
+		if current, ok := template.Labels[key]; ok && current != value {
+			allErrs = append(allErrs, field.Invalid(labelsPath.Key(key), current, "is used by the service selector and cannot be changed"))
+		}
+	}
+
+	specPath := path.Child("spec")
+	spec := template.Spec
+	if spec.Subdomain != "" && spec.Subdomain != e.ServiceName() {
+		allErrs = append(allErrs, field.Invalid(specPath.Child("subdomain"), spec.Subdomain, "must be the ensemble service name"))
+	}
+	if spec.ServiceAccountName != "" && spec.ServiceAccountName != e.Name {
+		allErrs = append(allErrs, field.Invalid(specPath.Child("serviceAccountName"), spec.ServiceAccountName,
+			"the ensemble service uses its own service account (with rbac for members)"))
+	}
+	if spec.RestartPolicy != "" && spec.RestartPolicy != corev1.RestartPolicyAlways {
+		allErrs = append(allErrs, field.NotSupported(specPath.Child("restartPolicy"), spec.RestartPolicy,
+			[]string{string(corev1.RestartPolicyAlways)}))
+	}
+
+	// Containers are merged by name, and the service container is generated
+	for i, container := range spec.Containers {
+		containerPath := specPath.Child("containers").Index(i)
+		if container.Name == "" {
+			allErrs = append(allErrs, field.Required(containerPath.Child("name"), "containers are merged by name"))
+			continue
+		}
+		if container.Name != SidecarContainerName {
+			continue
+		}
+		if container.Image != "" {
+			allErrs = append(allErrs, field.Forbidden(containerPath.Child("image"), "use spec.sidecar.image"))
+		}
+		if len(container.Command) > 0 {
+			allErrs = append(allErrs, field.Forbidden(containerPath.Child("command"),
+				"the command is generated for the service, use args to add to it"))
+		}
+		for j, containerPort := range container.Ports {
+			if containerPort.Name == "http" && int(containerPort.ContainerPort) != port {
+				allErrs = append(allErrs, field.Invalid(containerPath.Child("ports").Index(j).Child("containerPort"),
+					containerPort.ContainerPort, "the http port must be spec.sidecar.port, which the service targets"))
+			}
+		}
+	}
+	return allErrs
+}
+
+// defaultInstall sets the install mode, from the branch if it is set
+func defaultInstall(member *Member) {
+	if member.Install == nil {
+		member.Install = &Install{}
+	}
+	install := member.Install
+	if install.Mode == "" {
+		install.Mode = InstallPip
+		if member.Branch != "" {
+			install.Mode = InstallBranch
+		}
+	}
+	if install.Mode == InstallBranch && install.Branch == "" {
+		install.Branch = member.Branch
+	}
+	if install.Mode == InstallInitContainer && install.Path == "" {
+		install.Path = defaultInstallPath
+	}
+}
+
+// validateInstall checks a member has what it needs for the install mode
+func validateInstall(member *Member, path *field.Path) field.ErrorList {
+	allErrs := field.ErrorList{}
+	install := member.Install
+	if install == nil {
+		return allErrs
+	}
+	if member.Branch != "" && (install.Mode != InstallBranch || install.Branch != member.Branch) {
+		allErrs = append(allErrs, field.Invalid(path.Child("branch"), install.Branch,
+			"the member branch is deprecated, and must match install.branch if both are set"))
+	}
+
+	switch install.Mode {
+	case InstallPip, InstallPreinstalled:
+	case InstallBranch:
+		if install.Branch == "" {
+			allErrs = append(allErrs, field.Required(path.Child("branch"), "the branch of ensemble-python to install"))
+		}
+	case InstallWheelFromConfigMap:
+		configMapPath := path.Child("configMap")
+		if install.ConfigMap == nil {
+			allErrs = append(allErrs, field.Required(configMapPath, "the config map with the wheel"))
+			break
+		}
+		if install.ConfigMap.Name == "" {
+			allErrs = append(allErrs, field.Required(configMapPath.Child("name"), "the name of the config map"))
+		}
+		if !strings.HasSuffix(install.ConfigMap.Key, ".whl") {
+			allErrs = append(allErrs, field.Invalid(configMapPath.Child("key"), install.ConfigMap.Key,
+				"must be the file name of the wheel (ending in .whl)"))
+		}
+	case InstallWheelFromVolume:
+		volumePath := path.Child("volume")
+		if install.Volume == nil {
+			allErrs = append(allErrs, field.Required(volumePath, "the volume with the wheel"))
+			break
+		}
+		if (install.Volume.ClaimName == "") == (install.Volume.HostPath == "") {
+			allErrs = append(allErrs, field.Invalid(volumePath, "", "exactly one of claimName or hostPath is required"))
+		}
+		if install.Volume.Path == "" {
+			allErrs = append(allErrs, field.Required(volumePath.Child("path"), "the path of the wheel in the volume"))
+		}
+	case InstallInitContainer:
+		if install.Image == "" {
+			allErrs = append(allErrs, field.Required(path.Child("image"), "the image with ensemble-python installed"))
+		}
+	default:
+		allErrs = append(allErrs, field.NotSupported(path.Child("mode"), install.Mode, []string{
+			string(InstallPip), string(InstallBranch), string(InstallPreinstalled),
+			string(InstallWheelFromConfigMap), string(InstallWheelFromVolume), string(InstallInitContainer),
+		}))
+	}
+	return allErrs
+}
@@ -0,0 +1,259 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"text/template"
+)
+
+// GeneratedMember is a member expanded from the spec, with replicas and the
+// matrix applied. Each has its own name (for children) and ensemble.yaml.
+// +kubebuilder:object:generate=false
+type GeneratedMember struct {
+
+	// Name for the children of the member
+	Name string
+
+	// Index of the member in spec.members it was generated from
+	Index int
+
+	// Replica of the member (for its matrix combination)
+	Replica int32
+
+	// Parameters from the matrix for the member
+	Parameters map[string]string
+
+	// The member, with the ensemble yaml rendered
+	Member Member
+}
+
+// memberTemplate is the data available to render the ensemble yaml
+type memberTemplate struct {
+	Name       string
+	Replica    int32
+	Parameters map[string]string
+}
+
+// IsExpanded determines if a member uses replicas or a matrix. Once either
+// is set (even replicas: 1) names are suffixed, so they don't change when
+// the replicas do.
+func (m *Member) IsExpanded() bool {
+	return m.Replicas > 0 || len(m.Matrix) > 0
+}
+
+// Combinations returns the parameters for each combination of the matrix,
+// in a consistent order (sorted keys, and values in the order provided)
+func (m *Member) Combinations() []map[string]string {
+	keys := []string{}
+	for key := range m.Matrix {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	combinations := []map[string]string{{}}
+	for _, key := range keys {
+		next := []map[string]string{}
+		for _, combination := range combinations {
+			for _, value := range m.Matrix[key] {
+				params := map[string]string{key: value}
+				for k, v := range combination {
+					params[k] = v
+				}
+				next = append(next, params)
+			}
+		}
+		combinations = next
+	}
+	return combinations
+}
+
+// CountMembers returns the number of members generated from a member,
+// without generating the combinations. Above the limit of generated
+// members, it returns one more than the limit (so it can't overflow).
+func (m *Member) CountMembers() int {
+	count := int(m.Replicas)
+	if count < 1 {
+		count = 1
+	}
+	for _, values := range m.Matrix {
+		if len(values) == 0 {
+			return 0
+		}
+		if count > maxGeneratedMembers/len(values) {
+			return maxGeneratedMembers + 1
+		}
+		count *= len(values)
+	}
+	return count
+}
+
+// CountMembers returns the number of members generated for the ensemble,
+// or one more than the limit if there are too many
+func (e *Ensemble) CountMembers() int {
+	total := 0
+	for i := range e.Spec.Members {
+		total += e.Spec.Members[i].CountMembers()
+		if total > maxGeneratedMembers {
+			return maxGeneratedMembers + 1
+		}
+	}
+	return total
+}
+
+// GetMembers expands the members of the ensemble, with replicas and the
+// matrix applied. A member that isn't expanded keeps its name and yaml.
+func (e *Ensemble) GetMembers() ([]GeneratedMember, error) {
+
+	// The combinations are only generated when there aren't too many
+	if e.CountMembers() > maxGeneratedMembers {
+		return nil, fmt.Errorf("ensemble generates more than %d members", maxGeneratedMembers)
+	}
+	members := []GeneratedMember{}
+	for i := range e.Spec.Members {
+		generated, err := e.expandMember(i)
+		if err != nil {
+			return nil, err
+		}
+		members = append(members, generated...)
+	}
+	return members, nil
+}
+
+// expandMember generates the members for one entry in spec.members
+func (e *Ensemble) expandMember(i int) ([]GeneratedMember, error) {
+	member := e.Spec.Members[i]
+	baseName := e.MemberName(i)
+	if !member.IsExpanded() {
+		return []GeneratedMember{{Name: baseName, Index: i, Member: member}}, nil
+	}
+
+	// Missing parameters are an error, so typos are found early
+	tmpl, err := template.New(baseName).Option("missingkey=error").Parse(member.Ensemble)
+	if err != nil {
+		return nil, fmt.Errorf("member %s ensemble is not a valid template: %s", baseName, err)
+	}
+
+	replicas := member.Replicas
+	if replicas < 1 {
+		replicas = 1
+	}
+
+	// Members are named by their combination and replica (not by position),
+	// so changing the replicas or the values of the matrix keeps the names
+	// (and rendered yaml) of the members that are still generated
+	members := []GeneratedMember{}
+	for _, params := range member.Combinations() {
+		prefix := baseName
+		if len(params) > 0 {
+			prefix = fmt.Sprintf("%s-%s", baseName, getCombinationHash(params))
+		}
+		for replica := int32(0); replica < replicas; replica++ {
+			name := fmt.Sprintf("%s-%d", prefix, replica)
+			data := memberTemplate{Name: name, Replica: replica, Parameters: params}
+
+			var rendered bytes.Buffer
+			err := tmpl.Execute(&rendered, data)
+			if err != nil {
+				return nil, fmt.Errorf("member %s ensemble could not be rendered: %s", name, err)
+			}
+			copied := *member.DeepCopy()
+			copied.Ensemble = rendered.String()
+			members = append(members, GeneratedMember{
+				Name:       name,
+				Index:      i,
+				Replica:    replica,
+				Parameters: params,
+				Member:     copied,
+			})
+		}
+	}
+	return members, nil
+}
+
+// getCombinationHash returns a short hash of the parameters of a combination
+// of the matrix, for the names of its members
+func getCombinationHash(params map[string]string) string {
+
+	// Maps are encoded with sorted keys
+	encoded, _ := json.Marshal(params)
+	sum := sha256.Sum256(encoded)
+	return hex.EncodeToString(sum[:])[:8]
+}
+
+// GetMemberIndex returns the index of a member by name, or -1
+func (e *Ensemble) GetMemberIndex(name string) int {
+	for i, member := range e.Spec.Members {
+		if member.Name != "" && member.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// MemberOrder returns the indices of members so each comes after the members
+// it depends on, keeping the order of the spec when there is a choice.
+// A cycle (or a dependency that doesn't exist) is an error.
+func (e *Ensemble) MemberOrder() ([]int, error) {
+	count := len(e.Spec.Members)
+	waiting := make([]int, count)
+	downstream := make([][]int, count)
+	for i, member := range e.Spec.Members {
+		for _, dependency := range member.DependsOn {
+			j := e.GetMemberIndex(dependency.Name)
+			if j < 0 {
+				return nil, fmt.Errorf("member %s depends on %s, which does not exist", e.MemberName(i), dependency.Name)
+			}
+			waiting[i] += 1
+			downstream[j] = append(downstream[j], i)
+		}
+	}
+
+	// Take the first member (by index) that isn't waiting, each time
+	order := []int{}
+	done := make([]bool, count)
+	for len(order) < count {
+		next := -1
+		for i := 0; i < count; i++ {
+			if !done[i] && waiting[i] == 0 {
+				next = i
+				break
+			}
+		}
+		if next < 0 {
+			cycle := []string{}
+			for i := 0; i < count; i++ {
+				if !done[i] {
+					cycle = append(cycle, e.MemberName(i))
+				}
+			}
+			return nil, fmt.Errorf("members have a dependency cycle: %s", strings.Join(cycle, ", "))
+		}
+		done[next] = true
+		order = append(order, next)
+		for _, i := range downstream[next] {
+			waiting[i] -= 1
+		}
+	}
+	return order, nil
+}
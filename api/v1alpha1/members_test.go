@@ -0,0 +1,579 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	minicluster "github.com/flux-framework/flux-operator/api/v1alpha2"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const testEnsembleYaml = `jobs:
+  - name: sleep
+    command: sleep {{ .Parameters.time }}
+rules:
+  - trigger: start
+    action:
+      name: submit
+      label: sleep
+`
+
+// newTestEnsemble returns a defaulted ensemble with the members
+func newTestEnsemble(members ...Member) *Ensemble {
+	e := &Ensemble{
+		ObjectMeta: metav1.ObjectMeta{Name: "ens", Namespace: "default"},
+		Spec:       EnsembleSpec{Members: members},
+	}
+	e.Default()
+	return e
+}
+
+// newTestMember returns an external member (which needs no other spec)
+func newTestMember(name string, replicas int32, matrix map[string][]string) Member {
+	ensemble := strings.ReplaceAll(testEnsembleYaml, "{{ .Parameters.time }}", "10")
+	if len(matrix) > 0 {
+		ensemble = testEnsembleYaml
+	}
+	return Member{
+		Name:     name,
+		Replicas: replicas,
+		Matrix:   matrix,
+		Ensemble: ensemble,
+		External: &ExternalMember{},
+	}
+}
+
+func TestCombinations(t *testing.T) {
+	tests := []struct {
+		name     string
+		matrix   map[string][]string
+		expected []map[string]string
+	}{
+		{
+			name:     "no matrix",
+			expected: []map[string]string{{}},
+		},
+		{
+			name:   "one key keeps the order of values",
+			matrix: map[string][]string{"time": {"10", "1", "5"}},
+			expected: []map[string]string{
+				{"time": "10"}, {"time": "1"}, {"time": "5"},
+			},
+		},
+		{
+			name:   "keys are sorted, and the last key changes fastest",
+			matrix: map[string][]string{"time": {"1", "2"}, "nodes": {"a", "b"}},
+			expected: []map[string]string{
+				{"nodes": "a", "time": "1"},
+				{"nodes": "a", "time": "2"},
+				{"nodes": "b", "time": "1"},
+				{"nodes": "b", "time": "2"},
+			},
+		},
+		{
+			name:     "a key without values has no combinations",
+			matrix:   map[string][]string{"time": {"1"}, "nodes": {}},
+			expected: []map[string]string{},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			member := Member{Matrix: test.matrix}
+			combinations := member.Combinations()
+			if !reflect.DeepEqual(combinations, test.expected) {
+				t.Fatalf("expected %v, got %v", test.expected, combinations)
+			}
+		})
+	}
+}
+
+func TestGetMembers(t *testing.T) {
+	tests := []struct {
+		name    string
+		members []Member
+		names   []string
+	}{
+		{
+			name:    "a member without replicas keeps its name",
+			members: []Member{newTestMember("sim", 0, nil)},
+			names:   []string{"ens-sim"},
+		},
+		{
+			name:    "a member without a name uses its index",
+			members: []Member{newTestMember("", 0, nil), newTestMember("", 2, nil)},
+			names:   []string{"ens-0", "ens-1-0", "ens-1-1"},
+		},
+		{
+			name:    "one replica is suffixed",
+			members: []Member{newTestMember("sim", 1, nil)},
+			names:   []string{"ens-sim-0"},
+		},
+		{
+			name:    "replicas",
+			members: []Member{newTestMember("sim", 3, nil)},
+			names:   []string{"ens-sim-0", "ens-sim-1", "ens-sim-2"},
+		},
+		{
+			name:    "matrix members are named by their combination",
+			members: []Member{newTestMember("sim", 0, map[string][]string{"time": {"1", "2"}})},
+			names:   []string{"ens-sim-3b2f02a1-0", "ens-sim-531cae5f-0"},
+		},
+		{
+			name:    "matrix with replicas",
+			members: []Member{newTestMember("sim", 2, map[string][]string{"time": {"1", "2"}})},
+			names:   []string{"ens-sim-3b2f02a1-0", "ens-sim-3b2f02a1-1", "ens-sim-531cae5f-0", "ens-sim-531cae5f-1"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			e := newTestEnsemble(test.members...)
+			generated, err := e.GetMembers()
+			if err != nil {
+				t.Fatal(err)
+			}
+			names := []string{}
+			for _, member := range generated {
+				names = append(names, member.Name)
+			}
+			if !reflect.DeepEqual(names, test.names) {
+				t.Fatalf("expected %v, got %v", test.names, names)
+			}
+		})
+	}
+}
+
+// TestGetMembersStableNames checks changing the replicas or the values of the
+// matrix keeps the names (and rendered yaml) of the members that are still
+// generated, so their children are not replaced or given another combination
+func TestGetMembersStableNames(t *testing.T) {
+	tests := []struct {
+		name   string
+		before Member
+		after  Member
+	}{
+		{
+			name:   "add replicas",
+			before: newTestMember("sim", 1, nil),
+			after:  newTestMember("sim", 3, nil),
+		},
+		{
+			name:   "add replicas to a matrix",
+			before: newTestMember("sim", 1, map[string][]string{"time": {"1", "2"}}),
+			after:  newTestMember("sim", 3, map[string][]string{"time": {"1", "2"}}),
+		},
+		{
+			name:   "add a matrix value before the others",
+			before: newTestMember("sim", 2, map[string][]string{"time": {"1", "2"}}),
+			after:  newTestMember("sim", 2, map[string][]string{"time": {"3", "1", "2"}}),
+		},
+		{
+			name:   "remove a matrix value",
+			before: newTestMember("sim", 2, map[string][]string{"time": {"1", "2", "3"}}),
+			after:  newTestMember("sim", 2, map[string][]string{"time": {"1", "3"}}),
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			before, err := newTestEnsemble(test.before).GetMembers()
+			if err != nil {
+				t.Fatal(err)
+			}
+			after, err := newTestEnsemble(test.after).GetMembers()
+			if err != nil {
+				t.Fatal(err)
+			}
+			found := map[string]GeneratedMember{}
+			for _, member := range after {
+				found[member.Name] = member
+			}
+
+			// Every member generated before and after has the same parameters and yaml
+			kept := 0
+			for _, member := range before {
+				other, ok := found[member.Name]
+				if !ok {
+					continue
+				}
+				kept += 1
+				if !reflect.DeepEqual(member.Parameters, other.Parameters) || member.Member.Ensemble != other.Member.Ensemble {
+					t.Fatalf("member %s changed from %v to %v", member.Name, member.Parameters, other.Parameters)
+				}
+			}
+			expected := len(before)
+			if len(after) < expected {
+				expected = len(after)
+			}
+			if kept != expected {
+				t.Fatalf("expected %d members to keep their names, got %d", expected, kept)
+			}
+		})
+	}
+}
+
+func TestCountMembers(t *testing.T) {
+	values := make([]string, 100)
+	for i := range values {
+		values[i] = strconv.Itoa(i)
+	}
+	tests := []struct {
+		name     string
+		replicas int32
+		matrix   map[string][]string
+		expected int
+	}{
+		{name: "no replicas", expected: 1},
+		{name: "replicas", replicas: 3, expected: 3},
+		{name: "replicas and matrix", replicas: 2, matrix: map[string][]string{"a": {"1", "2"}, "b": {"1", "2", "3"}}, expected: 12},
+		{name: "a key without values", replicas: 2, matrix: map[string][]string{"a": {}}, expected: 0},
+		{
+			// 100^5 combinations would not fit in memory, the count stops at the limit
+			name:     "too many combinations",
+			replicas: 2,
+			matrix:   map[string][]string{"a": values, "b": values, "c": values, "d": values, "e": values},
+			expected: maxGeneratedMembers + 1,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			member := Member{Replicas: test.replicas, Matrix: test.matrix}
+			if count := member.CountMembers(); count != test.expected {
+				t.Fatalf("expected %d members, got %d", test.expected, count)
+			}
+		})
+	}
+
+	// The ensemble is rejected before the combinations are generated
+	member := newTestMember("sim", 1, map[string][]string{"time": values, "nodes": values})
+	e := newTestEnsemble(member)
+	errs := e.validateEnsemble()
+	if len(errs) == 0 || !strings.Contains(errs.ToAggregate().Error(), "must have at most 500 items") {
+		t.Fatalf("expected too many members, got %v", errs)
+	}
+	_, err := e.GetMembers()
+	if err == nil {
+		t.Fatal("expected an error generating too many members")
+	}
+}
+
+func TestGetMembersRender(t *testing.T) {
+	member := newTestMember("sim", 2, map[string][]string{"time": {"1", "2"}})
+	member.Ensemble = "# {{ .Name }} {{ .Replica }}\n" + member.Ensemble
+	e := newTestEnsemble(member)
+	generated, err := e.GetMembers()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Replicas are numbered for each combination
+	expected := []struct {
+		name    string
+		header  string
+		time    string
+		replica int32
+	}{
+		{"ens-sim-3b2f02a1-0", "# ens-sim-3b2f02a1-0 0", "1", 0},
+		{"ens-sim-3b2f02a1-1", "# ens-sim-3b2f02a1-1 1", "1", 1},
+		{"ens-sim-531cae5f-0", "# ens-sim-531cae5f-0 0", "2", 0},
+		{"ens-sim-531cae5f-1", "# ens-sim-531cae5f-1 1", "2", 1},
+	}
+	if len(generated) != len(expected) {
+		t.Fatalf("expected %d members, got %d", len(expected), len(generated))
+	}
+	for i, want := range expected {
+		got := generated[i]
+		if got.Name != want.name || got.Replica != want.replica || got.Parameters["time"] != want.time {
+			t.Fatalf("member %d: expected %s with time %s, got %s (replica %d) with %v",
+				i, want.name, want.time, got.Name, got.Replica, got.Parameters)
+		}
+		if !strings.HasPrefix(got.Member.Ensemble, want.header+"\n") {
+			t.Fatalf("member %d: ensemble was not rendered with the name and replica:\n%s", i, got.Member.Ensemble)
+		}
+		if !strings.Contains(got.Member.Ensemble, "command: sleep "+want.time+"\n") {
+			t.Fatalf("member %d: ensemble was not rendered with the parameters:\n%s", i, got.Member.Ensemble)
+		}
+	}
+
+	// The member in the spec keeps the template
+	if e.Spec.Members[0].Ensemble != member.Ensemble {
+		t.Fatalf("the spec was changed by rendering:\n%s", e.Spec.Members[0].Ensemble)
+	}
+}
+
+func TestGetMembersRenderErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		ensemble string
+		error    string
+	}{
+		{
+			name:     "missing parameter",
+			ensemble: "command: sleep {{ .Parameters.size }}",
+			error:    "could not be rendered",
+		},
+		{
+			name:     "not a template",
+			ensemble: "command: sleep {{ .Parameters.time",
+			error:    "not a valid template",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			member := newTestMember("sim", 0, map[string][]string{"time": {"1"}})
+			member.Ensemble = test.ensemble
+			_, err := newTestEnsemble(member).GetMembers()
+			if err == nil || !strings.Contains(err.Error(), test.error) {
+				t.Fatalf("expected error %q, got %v", test.error, err)
+			}
+		})
+	}
+}
+
+// newMiniClusterMember returns a MiniCluster member with volumes in the
+// ensemble container
+func newMiniClusterMember(name string, replicas int32, volumes ...string) Member {
+	member := newTestMember(name, replicas, nil)
+	container := minicluster.MiniClusterContainer{
+		Image:   "ghcr.io/rse-ops/lammps-matrix:mpich-ubuntu-20.04-amd64",
+		Volumes: map[string]minicluster.ContainerVolume{},
+	}
+	for _, volume := range volumes {
+		container.Volumes[volume] = minicluster.ContainerVolume{Path: "/" + volume, ClaimName: volume}
+	}
+	member.External = nil
+	member.MiniCluster = &minicluster.MiniCluster{
+		Spec: minicluster.MiniClusterSpec{
+			Size:       1,
+			MaxSize:    1,
+			Containers: []minicluster.MiniClusterContainer{container},
+		},
+	}
+	return member
+}
+
+func TestValidateGeneratedNames(t *testing.T) {
+	tests := []struct {
+		name    string
+		members []Member
+		error   string
+	}{
+		{
+			name:    "unique names",
+			members: []Member{newTestMember("sim", 2, nil), newTestMember("analysis", 0, nil)},
+		},
+		{
+			name:    "a replica has the name of another member",
+			members: []Member{newTestMember("sim", 2, nil), newTestMember("sim-1", 0, nil)},
+			error:   "spec.members[1].name: Duplicate value",
+		},
+		{
+			name:    "a member without a name has the name of another member",
+			members: []Member{newTestMember("", 0, nil), newTestMember("", 0, nil), newTestMember("1", 0, nil)},
+			error:   "ens-1 (also generated by member 1)",
+		},
+		{
+			name:    "a MiniCluster with a user volume",
+			members: []Member{newMiniClusterMember("sim", 2, "data")},
+		},
+		{
+			name:    "a MiniCluster volume has the name of the member config",
+			members: []Member{newMiniClusterMember("sim", 2, "ens-sim-1")},
+			error:   "spec.members[0].minicluster.spec.containers[0].volumes[ens-sim-1]: Invalid value",
+		},
+		{
+			name:    "a rendered ensemble is validated",
+			members: []Member{newTestMember("sim", 0, map[string][]string{"time": {"1"}})},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			e := newTestEnsemble(test.members...)
+			errs := e.validateEnsemble()
+			if test.error == "" {
+				if len(errs) > 0 {
+					t.Fatalf("expected no errors, got %v", errs)
+				}
+				return
+			}
+			if len(errs) == 0 || !strings.Contains(errs.ToAggregate().Error(), test.error) {
+				t.Fatalf("expected error %q, got %v", test.error, errs)
+			}
+		})
+	}
+}
+
+// newDependentMember returns a test member that depends on others
+func newDependentMember(name string, dependsOn ...string) Member {
+	member := newTestMember(name, 0, nil)
+	for _, dependency := range dependsOn {
+		member.DependsOn = append(member.DependsOn, Dependency{Name: dependency})
+	}
+	return member
+}
+
+func TestMemberOrder(t *testing.T) {
+	tests := []struct {
+		name    string
+		members []Member
+		order   []int
+		error   string
+	}{
+		{
+			name:    "no dependencies keeps the spec order",
+			members: []Member{newDependentMember("a"), newDependentMember("b"), newDependentMember("c")},
+			order:   []int{0, 1, 2},
+		},
+		{
+			name: "dependencies come first",
+			members: []Member{
+				newDependentMember("analysis", "simulation"),
+				newDependentMember("simulation", "preprocess"),
+				newDependentMember("preprocess"),
+			},
+			order: []int{2, 1, 0},
+		},
+		{
+			name: "the spec order is kept when there is a choice",
+			members: []Member{
+				newDependentMember("a", "c"),
+				newDependentMember("b"),
+				newDependentMember("c"),
+				newDependentMember("d", "a", "b"),
+			},
+			order: []int{1, 2, 0, 3},
+		},
+		{
+			name:    "unknown dependency",
+			members: []Member{newDependentMember("a", "missing")},
+			error:   "member ens-a depends on missing, which does not exist",
+		},
+		{
+			name:    "self dependency",
+			members: []Member{newDependentMember("a", "a")},
+			error:   "members have a dependency cycle: ens-a",
+		},
+		{
+			name: "cycle",
+			members: []Member{
+				newDependentMember("start"),
+				newDependentMember("a", "b"),
+				newDependentMember("b", "c"),
+				newDependentMember("c", "a"),
+			},
+			error: "members have a dependency cycle: ens-a, ens-b, ens-c",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			order, err := newTestEnsemble(test.members...).MemberOrder()
+			if test.error != "" {
+				if err == nil || err.Error() != test.error {
+					t.Fatalf("expected error %q, got %v", test.error, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(order, test.order) {
+				t.Fatalf("expected order %v, got %v", test.order, order)
+			}
+		})
+	}
+}
+
+func TestValidateDependencies(t *testing.T) {
+	tests := []struct {
+		name    string
+		members []Member
+		error   string
+	}{
+		{
+			name:    "valid",
+			members: []Member{newDependentMember("a"), newDependentMember("b", "a")},
+		},
+		{
+			name:    "unknown dependency",
+			members: []Member{newDependentMember("a", "missing")},
+			error:   "spec.members[0].dependsOn[0].name: Not found: \"missing\"",
+		},
+		{
+			name:    "self dependency",
+			members: []Member{newDependentMember("a", "a")},
+			error:   "spec.members[0].dependsOn[0].name: Invalid value: \"a\": a member cannot depend on itself",
+		},
+		{
+			name:    "duplicate dependency",
+			members: []Member{newDependentMember("a"), newDependentMember("b", "a", "a")},
+			error:   "spec.members[1].dependsOn[1].name: Duplicate value: \"a\"",
+		},
+		{
+			name:    "cycle",
+			members: []Member{newDependentMember("a", "b"), newDependentMember("b", "a")},
+			error:   "members have a dependency cycle: ens-a, ens-b",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			errs := newTestEnsemble(test.members...).validateEnsemble()
+			if test.error == "" {
+				if len(errs) > 0 {
+					t.Fatalf("expected no errors, got %v", errs)
+				}
+				return
+			}
+			if len(errs) == 0 || !strings.Contains(errs.ToAggregate().Error(), test.error) {
+				t.Fatalf("expected error %q, got %v", test.error, errs)
+			}
+		})
+	}
+}
+
+func TestValidateExternalServiceType(t *testing.T) {
+	tests := []struct {
+		name        string
+		serviceType corev1.ServiceType
+		tls         bool
+		error       bool
+	}{
+		{name: "default cluster IP"},
+		{name: "load balancer without tls", serviceType: corev1.ServiceTypeLoadBalancer, error: true},
+		{name: "node port without tls", serviceType: corev1.ServiceTypeNodePort, error: true},
+		{name: "load balancer with tls", serviceType: corev1.ServiceTypeLoadBalancer, tls: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			member := newTestMember("sim", 0, nil)
+			member.External.ServiceType = test.serviceType
+			e := newTestEnsemble(member)
+			if test.tls {
+				e.Spec.Sidecar.TLS = &SidecarTLS{Enabled: true}
+			}
+			if e.Spec.Members[0].External.ServiceType == "" {
+				t.Fatal("expected a default service type")
+			}
+			errs := e.validateEnsemble()
+			if test.error != (len(errs) > 0) {
+				t.Fatalf("expected error to be %t, got %v", test.error, errs)
+			}
+		})
+	}
+}
@@ -29,16 +29,19 @@ import (
 	api "github.com/converged-computing/ensemble-operator/api/v1alpha1"
 	controller "github.com/converged-computing/ensemble-operator/controllers/ensemble"
 	minicluster "github.com/flux-framework/flux-operator/api/v1alpha2"
+	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/apimachinery/pkg/runtime/serializer"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/client/apiutil"
 	"sigs.k8s.io/controller-runtime/pkg/healthz"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
 	metricsserver "sigs.k8s.io/controller-runtime/pkg/metrics/server"
+	jobset "sigs.k8s.io/jobset/api/jobset/v1alpha2"
 
 	"sigs.k8s.io/controller-runtime/pkg/webhook"
 	//+kubebuilder:scaffold:imports
@@ -56,6 +59,7 @@ func init() {
 
 	utilruntime.Must(api.AddToScheme(scheme))
 	utilruntime.Must(minicluster.AddToScheme(scheme))
+	utilruntime.Must(jobset.AddToScheme(scheme))
 
 	//+kubebuilder:scaffold:scheme
 }
@@ -125,6 +129,14 @@ func main() {
 		// if you are doing or is intended to do any operation such as perform cleanups
 		// after the manager stops then its usage might be unsafe.
 		// LeaderElectionReleaseOnCancel: true,
+
+		// Secrets are read from the API server instead of a cache of every
+		// Secret in the cluster (the controller only watches their metadata)
+		Client: client.Options{
+			Cache: &client.CacheOptions{
+				DisableFor: []client.Object{&corev1.Secret{}},
+			},
+		},
 	})
 	if err != nil {
 		setupLog.Error(err, "unable to start manager")
@@ -154,10 +166,19 @@ func main() {
 		Log:        ctrl.Log.WithName("ensemble"),
 		RESTClient: restClient,
 		RESTConfig: mgr.GetConfig(),
+		Recorder:   mgr.GetEventRecorderFor("ensemble-controller"),
 	}).SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "Ensemble")
 		os.Exit(1)
 	}
+
+	// Webhooks can be disabled when running the manager locally (make run)
+	if os.Getenv("ENABLE_WEBHOOKS") != "false" {
+		if err = (&api.Ensemble{}).SetupWebhookWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create webhook", "webhook", "Ensemble")
+			os.Exit(1)
+		}
+	}
 	//+kubebuilder:scaffold:builder
 
 	if err := mgr.AddHealthzCheck("healthz", healthz.Ping); err != nil {
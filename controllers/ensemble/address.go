@@ -0,0 +1,125 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	api "github.com/converged-computing/ensemble-operator/api/v1alpha1"
+)
+
+var (
+	// The member reads the address of the ensemble service from this file
+	// in the config map, so it can be changed without recreating the member
+	ensembleHostName = "host"
+
+	// The config map records the address the running member was given
+	appliedHostAnnotation = "ensemble.flux-framework.org/applied-host"
+)
+
+// getMemberHost returns the address members use for the ensemble service
+func (r *EnsembleReconciler) getMemberHost(
+	ctx context.Context,
+	ensemble *api.Ensemble,
+) (string, error) {
+	switch ensemble.Spec.Sidecar.AddressMode {
+	case api.AddressClusterIP:
+		return r.getServiceAddress(ctx, ensemble)
+	case api.AddressPodIP:
+		return r.getDeploymentAddress(ctx, ensemble)
+	}
+	return ensemble.ServiceHost(), nil
+}
+
+// ensureMemberHost writes the address of the ensemble service to the config
+// map of a member. When it changes (e.g., the service was recreated with a new
+// ClusterIP) the running member is restarted to read the new address.
+func (r *EnsembleReconciler) ensureMemberHost(
+	ctx context.Context,
+	name string,
+	ensemble *api.Ensemble,
+	member *api.Member,
+	backend MemberBackend,
+) (ctrl.Result, error) {
+
+	// External members are given the address of their own service
+	if member.Type() == api.ExternalType {
+		return ctrl.Result{}, nil
+	}
+	cm := &corev1.ConfigMap{}
+	err := r.getMemberObject(ctx, name, ensemble, cm, &corev1.ConfigMapList{})
+	if err != nil {
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+
+	// We need the address of the grpc service
+	// if this fails, we try again - it might not be ready
+	host, err := r.getMemberHost(ctx, ensemble)
+	if err != nil {
+		return ctrl.Result{Requeue: true}, err
+	}
+	current, ok := cm.Data[ensembleHostName]
+	applied := cm.Annotations[appliedHostAnnotation]
+	if ok && current == host && applied == host {
+		return ctrl.Result{}, nil
+	}
+
+	patch := client.MergeFrom(cm.DeepCopy())
+	if cm.Annotations == nil {
+		cm.Annotations = map[string]string{}
+	}
+	if cm.Data == nil {
+		cm.Data = map[string]string{}
+	}
+	cm.Data[ensembleHostName] = host
+
+	// A member that doesn't exist yet reads the address when it is created, and
+	// a member from an older operator (without the file) has it in the command
+	result := ctrl.Result{}
+	_, err = backend.Get(ctx, name, ensemble)
+	if err != nil && !errors.IsNotFound(err) {
+		return ctrl.Result{}, err
+	}
+	if err == nil && ok && applied != host {
+		fmt.Printf("      Ensemble service address for %s changed from %s to %s\n", name, applied, host)
+		err = backend.Restart(ctx, name, ensemble, member)
+		if err != nil {
+			r.Log.Error(err, "      Member could not be restarted with the new address", "Member", name)
+			if r.Recorder != nil {
+				r.Recorder.Eventf(
+					ensemble, corev1.EventTypeWarning, "ServiceAddressFailed",
+					"Member %s could not be restarted with ensemble service address %s: %s", name, host, err,
+				)
+			}
+			result = ctrl.Result{RequeueAfter: configRetryInterval}
+			host = applied
+		} else if r.Recorder != nil {
+			r.Recorder.Eventf(
+				ensemble, corev1.EventTypeNormal, "ServiceAddressChanged",
+				"Member %s was restarted with ensemble service address %s", name, host,
+			)
+		}
+	}
+	cm.Annotations[appliedHostAnnotation] = host
+	return result, r.Patch(ctx, cm, patch)
+}
@@ -3,9 +3,11 @@ package controller
 import (
 	"context"
 	"fmt"
+	"sort"
 	"strconv"
 
 	api "github.com/converged-computing/ensemble-operator/api/v1alpha1"
+	ensembleClient "github.com/converged-computing/ensemble-operator/pkg/client"
 	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
 	rbacv1 "k8s.io/api/rbac/v1"
@@ -14,7 +16,6 @@ import (
 	"k8s.io/apimachinery/pkg/util/intstr"
 	"k8s.io/client-go/kubernetes"
 
-	"k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/types"
 	ctrl "sigs.k8s.io/controller-runtime"
 )
@@ -44,31 +45,37 @@ func (r *EnsembleReconciler) getDeploymentAddress(
 		return "", err
 	}
 
-	// Get the ip address of the first (only for now) pod
-	var ipAddress string
-	for i, pod := range pods.Items {
-		pod, err := clientset.CoreV1().Pods(ensemble.Namespace).Get(ctx, pod.Name, metav1.GetOptions{})
-		if err != nil {
-			fmt.Printf("      Error with getting pods %s\n", err)
-			return "", err
+	// Get the ip address of the oldest ready pod (by name when they are the
+	// same age), so the address is the same across reconciles
+	var chosen *corev1.Pod
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+		if pod.DeletionTimestamp != nil || pod.Status.PodIP == "" || !isPodReady(pod) {
+			continue
 		}
-		fmt.Printf("      Pod IP Address %s\n", pod.Status.PodIP)
-		ipAddress = pod.Status.PodIP
-
-		// We only need the first pod, if there is more than one
-		// I don't think we will need to scale this, but can
-		// figure out how to handle that if it comes to that.
-		if i > 0 {
-			break
+		if chosen == nil || pod.CreationTimestamp.Before(&chosen.CreationTimestamp) ||
+			(pod.CreationTimestamp.Equal(&chosen.CreationTimestamp) && pod.Name < chosen.Name) {
+			chosen = pod
 		}
 	}
 
 	// If we don't have an ip address yet, try again later
-	if ipAddress == "" {
-		fmt.Println("      No pods found")
-		return "", fmt.Errorf("no pods found, not ready yet")
+	if chosen == nil {
+		fmt.Println("      No ready pods found")
+		return "", fmt.Errorf("no ready pods found, not ready yet")
 	}
-	return ipAddress, nil
+	fmt.Printf("      Pod IP Address %s\n", chosen.Status.PodIP)
+	return chosen.Status.PodIP, nil
+}
+
+// isPodReady determines if a pod has the Ready condition
+func isPodReady(pod *corev1.Pod) bool {
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type == corev1.PodReady {
+			return condition.Status == corev1.ConditionTrue
+		}
+	}
+	return false
 }
 
 // getServiceAddress gets the service ClusterIP serving the grpc endpoint
@@ -109,211 +116,156 @@ func (r *EnsembleReconciler) getServiceAddress(
 	return ipAddress, nil
 }
 
-func (r *EnsembleReconciler) createServiceAccount(
+// getEnsembleClient connects to the grpc endpoint of the ensemble service
+// The caller is responsible for closing the client
+func (r *EnsembleReconciler) getEnsembleClient(
 	ctx context.Context,
 	ensemble *api.Ensemble,
-) (ctrl.Result, error) {
+) (ensembleClient.Client, error) {
+	ipAddress, err := r.getServiceAddress(ctx, ensemble)
+	if err != nil {
+		return nil, err
+	}
+	host := fmt.Sprintf("%s:%s", ipAddress, ensemble.Spec.Sidecar.Port)
+	options, err := r.getClientOptions(ctx, ensemble)
+	if err != nil {
+		return nil, err
+	}
+	return ensembleClient.NewClient(host, options...)
+}
 
-	// First see if we already have it!
-	sa := &corev1.ServiceAccount{}
-	err := r.Get(
-		ctx,
-		types.NamespacedName{
+// applyServiceAccount applies the service account for the ensemble service
+func (r *EnsembleReconciler) applyServiceAccount(
+	ctx context.Context,
+	ensemble *api.Ensemble,
+) error {
+	sa := &corev1.ServiceAccount{
+		ObjectMeta: metav1.ObjectMeta{
 			Name:      ensemble.Name,
 			Namespace: ensemble.Namespace,
 		},
-		sa,
-	)
-
-	// If we haven't found it, create it
-	if err != nil {
-		if errors.IsNotFound(err) {
-			sa = &corev1.ServiceAccount{
-				ObjectMeta: metav1.ObjectMeta{
-					Name:      ensemble.Name,
-					Namespace: ensemble.Namespace,
-				},
-			}
-			ctrl.SetControllerReference(ensemble, sa, r.Scheme)
-
-			// We should not have an error with creation
-			err = r.Create(ctx, sa)
-			if err != nil {
-				return ctrl.Result{}, err
-			}
-
-			// Otherwise, requeue - we'll make another object
-			// the next time around.
-			return ctrl.Result{Requeue: true}, nil
-		}
-		// This means an error that isn't covered
-		return ctrl.Result{}, err
 	}
-	// We already have the service account, no error
-	// and continue to next thing.
-	return ctrl.Result{}, nil
+	return r.applyObject(ctx, ensemble, sa)
 }
 
-// createRole creates the RBAC role that will allow the ensemble service
-// to control the ensemble object (and update it, etc.). See function
-// above for comments about logic of this function.
-func (r *EnsembleReconciler) createRole(
+// applyRole applies the RBAC role that will allow the ensemble service
+// to grow and shrink the members of the ensemble. Rules that are edited
+// or removed are put back, and the role changes with the members.
+func (r *EnsembleReconciler) applyRole(
 	ctx context.Context,
 	ensemble *api.Ensemble,
-) (ctrl.Result, error) {
-
-	role := &rbacv1.Role{}
-	err := r.Get(
-		ctx,
-		types.NamespacedName{
+) error {
+	rules, err := r.getRoleRules(ensemble)
+	if err != nil {
+		return err
+	}
+	role := &rbacv1.Role{
+		ObjectMeta: metav1.ObjectMeta{
 			Name:      ensemble.Name,
 			Namespace: ensemble.Namespace,
 		},
-		role,
-	)
+		Rules: rules,
+	}
+	return r.applyObject(ctx, ensemble, role)
+}
+
+// getRoleRules returns the rules for the ensemble service to act on members.
+// Each member type adds rules for its members by name, so the service can
+// only change members of its own ensemble.
+func (r *EnsembleReconciler) getRoleRules(ensemble *api.Ensemble) ([]rbacv1.PolicyRule, error) {
+	members, err := ensemble.GetMembers()
 	if err != nil {
-		if errors.IsNotFound(err) {
-			role := &rbacv1.Role{
-				ObjectMeta: metav1.ObjectMeta{
-					Name:      ensemble.Name,
-					Namespace: ensemble.Namespace,
-				},
-				Rules: []rbacv1.PolicyRule{
-					{
-						APIGroups: []string{"flux-framework.org"},
-						Resources: []string{"miniclusters"},
-						Verbs:     []string{"get", "list", "create", "update", "delete", "patch"},
-					},
-				},
-			}
-
-			ctrl.SetControllerReference(ensemble, role, r.Scheme)
-			err = r.Create(ctx, role)
-			if err != nil {
-				return ctrl.Result{}, err
-			}
-			return ctrl.Result{Requeue: true}, nil
+		return nil, err
+	}
+	names := map[string][]string{}
+	for _, generated := range members {
+		memberType := generated.Member.Type()
+		names[memberType] = append(names[memberType], generated.Name)
+	}
+
+	// Rules are in a consistent order so the role only changes with members
+	memberTypes := []string{}
+	for memberType := range names {
+		memberTypes = append(memberTypes, memberType)
+	}
+	sort.Strings(memberTypes)
+
+	rules := []rbacv1.PolicyRule{}
+	for _, memberType := range memberTypes {
+		backend, err := r.getBackend(memberType)
+		if err != nil {
+			return nil, err
 		}
-		return ctrl.Result{}, err
+		rules = append(rules, backend.RoleRules(names[memberType])...)
 	}
-	return ctrl.Result{}, nil
 
+	// Replicas of the service elect a leader with the lease
+	rules = append(rules, rbacv1.PolicyRule{
+		APIGroups:     []string{"coordination.k8s.io"},
+		Resources:     []string{"leases"},
+		ResourceNames: []string{ensemble.LeaseName()},
+		Verbs:         []string{"get", "update", "patch"},
+	})
+	return rules, nil
 }
 
-// createRoleBinding will bind the service account to the role we created
+// applyRoleBinding will bind the service account to the role we created
 // This will give the grpc service permission to issue updates to the MiniCluster
-func (r *EnsembleReconciler) createRoleBinding(
+func (r *EnsembleReconciler) applyRoleBinding(
 	ctx context.Context,
 	ensemble *api.Ensemble,
-) (ctrl.Result, error) {
-
-	rb := &rbacv1.RoleBinding{}
-	err := r.Get(
-		ctx,
-		types.NamespacedName{
+) error {
+	rb := &rbacv1.RoleBinding{
+		ObjectMeta: metav1.ObjectMeta{
 			Name:      ensemble.Name,
 			Namespace: ensemble.Namespace,
 		},
-		rb,
-	)
-	if err != nil {
-		if errors.IsNotFound(err) {
-			rb := &rbacv1.RoleBinding{
-				ObjectMeta: metav1.ObjectMeta{
-					Name:      ensemble.Name,
-					Namespace: ensemble.Namespace,
-				},
-				RoleRef: rbacv1.RoleRef{
-					APIGroup: "rbac.authorization.k8s.io",
-					Kind:     "Role",
-					Name:     ensemble.Name,
-				},
-				Subjects: []rbacv1.Subject{
-					{
-						Kind:      "ServiceAccount",
-						Name:      ensemble.Name,
-						Namespace: ensemble.Namespace,
-					},
-				},
-			}
-			ctrl.SetControllerReference(ensemble, rb, r.Scheme)
-			err = r.Create(ctx, rb)
-			if err != nil {
-				return ctrl.Result{}, err
-			}
-			return ctrl.Result{Requeue: true}, nil
-		}
-		return ctrl.Result{}, err
+		RoleRef: rbacv1.RoleRef{
+			APIGroup: "rbac.authorization.k8s.io",
+			Kind:     "Role",
+			Name:     ensemble.Name,
+		},
+		Subjects: []rbacv1.Subject{
+			{
+				Kind:      "ServiceAccount",
+				Name:      ensemble.Name,
+				Namespace: ensemble.Namespace,
+			},
+		},
 	}
-	return ctrl.Result{}, nil
-
+	return r.applyObject(ctx, ensemble, rb)
 }
 
-// createService creates the service for the grpc
+// applyService applies the service for the grpc
 // This is used to expose the port to the cluster
-// TODO stopped here - bring up interactive and debug grpc (it worked before)
-func (r *EnsembleReconciler) createService(
+func (r *EnsembleReconciler) applyService(
 	ctx context.Context,
 	ensemble *api.Ensemble,
-) (ctrl.Result, error) {
+) error {
 
-	// First see if we already have it!
-	svc := &corev1.Service{}
-	err := r.Get(
-		ctx,
-		types.NamespacedName{
+	// Deployment labels to match for service
+	appLabels := getDeploymentLabels(ensemble)
+	port, err := strconv.Atoi(ensemble.Spec.Sidecar.Port)
+	if err != nil {
+		return err
+	}
+	svc := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
 			Name:      ensemble.ServiceName(),
 			Namespace: ensemble.Namespace,
 		},
-		svc,
-	)
-
-	// If we haven't found it, create it
-	if err != nil {
-		if errors.IsNotFound(err) {
-
-			// Deployment labels to match for service
-			appLabels := getDeploymentLabels(ensemble)
-			port, err := strconv.Atoi(ensemble.Spec.Sidecar.Port)
-			if err != nil {
-				return ctrl.Result{}, err
-			}
-
-			svc = &corev1.Service{
-				TypeMeta: metav1.TypeMeta{},
-				ObjectMeta: metav1.ObjectMeta{
-					Name:      ensemble.ServiceName(),
-					Namespace: ensemble.Namespace,
+		Spec: corev1.ServiceSpec{
+			Ports: []corev1.ServicePort{
+				{
+					TargetPort: intstr.FromInt(int(port)),
+					Protocol:   "TCP",
+					Port:       int32(port),
 				},
-				Spec: corev1.ServiceSpec{
-					Ports: []corev1.ServicePort{
-						{
-							TargetPort: intstr.FromInt(int(port)),
-							Protocol:   "TCP",
-							Port:       int32(port),
-						},
-					},
-					Selector: appLabels,
-				},
-			}
-			ctrl.SetControllerReference(ensemble, svc, r.Scheme)
-
-			// We should not have an error with creation
-			err = r.Create(ctx, svc)
-			if err != nil {
-				return ctrl.Result{}, err
-			}
-
-			// Otherwise, requeue - we'll make another object
-			// the next time around.
-			return ctrl.Result{Requeue: true}, nil
-		}
-		// This means an error that isn't covered
-		return ctrl.Result{}, err
+			},
+			Selector: appLabels,
+		},
 	}
-	// We already have the service account, no error
-	// and continue to next thing.
-	return ctrl.Result{Requeue: true}, nil
+	return r.applyObject(ctx, ensemble, svc)
 }
 
 // ensureEnsembleService creates the deployment to run the ensemble service
@@ -331,54 +283,78 @@ func (r *EnsembleReconciler) ensureEnsembleService(
 	// First we care about the service object itself.
 	// This will be generated with rbac so the service has permission
 	// to update the MiniCluster (and eventually other ensemble
-	// members in the space
-	result, err := r.createServiceAccount(ctx, ensemble)
+	// members in the space. Everything is applied (server-side) so
+	// changes to what we own go back to the desired state.
+	err := r.applyServiceAccount(ctx, ensemble)
 	if err != nil {
-		return result, err
+		return ctrl.Result{}, err
 	}
 
 	// Create the service for the deployment
-	result, err = r.createService(ctx, ensemble)
+	err = r.applyService(ctx, ensemble)
 	if err != nil {
-		return result, err
+		return ctrl.Result{}, err
 	}
 
 	// Once we have a service account, create a role for it
-	result, err = r.createRole(ctx, ensemble)
+	err = r.applyRole(ctx, ensemble)
 	if err != nil {
-		return result, err
+		return ctrl.Result{}, err
 	}
 
 	// And the role binding for the TBA grpc deployment
-	result, err = r.createRoleBinding(ctx, ensemble)
+	err = r.applyRoleBinding(ctx, ensemble)
 	if err != nil {
-		return result, err
+		return ctrl.Result{}, err
 	}
 
-	// Next, we want to create a deployment that serves the grpc
-	_, err = r.getExistingDeployment(ctx, ensemble)
+	// Replicas of the service elect a leader, and one is kept available
+	err = r.applyLease(ctx, ensemble)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	err = r.ensureDisruptionBudget(ctx, ensemble)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
 
-	// Create a new job if it does not exist
+	// With TLS, the service and the operator need certificates
+	err = r.ensureServiceTLS(ctx, ensemble)
 	if err != nil {
-		if errors.IsNotFound(err) {
-			mc, err := r.newEnsembleDeployment(ensemble)
-			if err != nil {
-				fmt.Printf("      Failed to create Deployment object: %s\n", err)
-				return ctrl.Result{}, err
-			}
-			fmt.Println("      Creating a new Ensemble Service Deployment")
-			err = r.Create(ctx, mc)
-			if err != nil {
-				fmt.Printf("      Failed to create Ensemble Service Deployment: %s\n", err)
-				return ctrl.Result{}, err
-			}
-			return ctrl.Result{Requeue: true}, nil
-		}
-		// This means an error that isn't covered
 		return ctrl.Result{}, err
 	}
-	// We need to requeue since we check the status with reconcile
-	return ctrl.Result{Requeue: true}, err
+
+	// Next, we want a deployment that serves the grpc. It has no replicas
+	// when the ensemble is suspended, and changes to the sidecar (e.g., the
+	// image or pod template) roll it
+	deployment, err := r.newEnsembleDeployment(ensemble)
+	if err != nil {
+		fmt.Printf("      Failed to create Deployment object: %s\n", err)
+		return ctrl.Result{}, err
+	}
+	err = r.addServerCertHash(ctx, ensemble, &deployment.Spec.Template)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	err = r.applyObject(ctx, ensemble, deployment)
+	if err != nil {
+		fmt.Printf("      Failed to apply Ensemble Service Deployment: %s\n", err)
+		return ctrl.Result{}, err
+	}
+
+	// Changes to the deployment status come from the watch
+	return ctrl.Result{}, nil
+}
+
+// getDeploymentReplicas returns the replicas for the ensemble service deployment
+func getDeploymentReplicas(ensemble *api.Ensemble) int32 {
+	if ensemble.Spec.Suspend {
+		return 0
+	}
+	if ensemble.Spec.Sidecar.Replicas < 1 {
+		return 1
+	}
+	return ensemble.Spec.Sidecar.Replicas
 }
 
 // getExistingDeployment gets an existing deployment service
@@ -437,8 +413,8 @@ func (r *EnsembleReconciler) newEnsembleDeployment(ensemble *api.Ensemble) (*app
 		"--workers", workers,
 	}
 
-	// Assume 1 replica for now, we can always expose this
-	replicas := int32(1)
+	// Replicas from the sidecar (or 0 if suspended)
+	replicas := getDeploymentReplicas(ensemble)
 	deployment := &appsv1.Deployment{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      ensemble.Name,
@@ -461,7 +437,7 @@ func (r *EnsembleReconciler) newEnsembleDeployment(ensemble *api.Ensemble) (*app
 					Containers: []corev1.Container{
 						{
 							// matches the service
-							Name:            "ensemble-service",
+							Name:            api.SidecarContainerName,
 							Image:           ensemble.Spec.Sidecar.Image,
 							ImagePullPolicy: corev1.PullPolicy(imagePullPolicy),
 							Command:         command,
@@ -473,12 +449,48 @@ func (r *EnsembleReconciler) newEnsembleDeployment(ensemble *api.Ensemble) (*app
 									ContainerPort: int32(port),
 								},
 							},
+
+							// The service only routes to replicas that are serving
+							ReadinessProbe: &corev1.Probe{
+								ProbeHandler: corev1.ProbeHandler{
+									TCPSocket: &corev1.TCPSocketAction{Port: intstr.FromInt(int(port))},
+								},
+								PeriodSeconds: 5,
+							},
+
+							// The replicas elect a leader with the lease, by pod name
+							Env: []corev1.EnvVar{
+								{Name: "ENSEMBLE_LEASE_NAME", Value: ensemble.LeaseName()},
+								{
+									Name: "POD_NAME",
+									ValueFrom: &corev1.EnvVarSource{
+										FieldRef: &corev1.ObjectFieldSelector{FieldPath: "metadata.name"},
+									},
+								},
+								{
+									Name: "POD_NAMESPACE",
+									ValueFrom: &corev1.EnvVarSource{
+										FieldRef: &corev1.ObjectFieldSelector{FieldPath: "metadata.namespace"},
+									},
+								},
+							},
 						},
 					},
 				},
 			},
 		},
 	}
+
+	// With TLS, the service requires members to have a certificate
+	addTLSToDeployment(&deployment.Spec.Template.Spec, ensemble)
+
+	// The user can customize the pod (e.g., resources, or a nodeSelector)
+	generated := deployment.Spec.Template.DeepCopy()
+	err = mergePodTemplate(&deployment.Spec.Template, ensemble.Spec.Sidecar.PodTemplate)
+	if err != nil {
+		return nil, err
+	}
+	keepServiceFields(&deployment.Spec.Template, generated)
 	ctrl.SetControllerReference(ensemble, deployment, r.Scheme)
 	return deployment, nil
 }
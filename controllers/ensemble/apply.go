@@ -0,0 +1,55 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/apiutil"
+
+	api "github.com/converged-computing/ensemble-operator/api/v1alpha1"
+)
+
+// fieldOwner is the field manager for the objects the operator applies
+var fieldOwner = client.FieldOwner("ensemble-operator")
+
+// applyObject applies the desired state of an object owned by the ensemble
+// with server-side apply. The operator owns the fields it sets, so if they
+// are changed or removed (e.g., rules of the role, or the service port) they
+// go back to the desired state, and fields set by others are kept.
+func (r *EnsembleReconciler) applyObject(
+	ctx context.Context,
+	ensemble *api.Ensemble,
+	obj client.Object,
+) error {
+
+	// Apply needs the kind, which typed objects don't have set
+	gvk, err := apiutil.GVKForObject(obj, r.Scheme)
+	if err != nil {
+		return err
+	}
+	obj.GetObjectKind().SetGroupVersionKind(gvk)
+	obj.SetManagedFields(nil)
+	obj.SetResourceVersion("")
+	err = ctrl.SetControllerReference(ensemble, obj, r.Scheme)
+	if err != nil {
+		return err
+	}
+	return r.Patch(ctx, obj, client.Apply, fieldOwner, client.ForceOwnership)
+}
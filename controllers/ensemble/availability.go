@@ -0,0 +1,85 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+
+	coordinationv1 "k8s.io/api/coordination/v1"
+	policyv1 "k8s.io/api/policy/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	api "github.com/converged-computing/ensemble-operator/api/v1alpha1"
+)
+
+// applyLease applies the Lease the ensemble service replicas use to elect a
+// leader. The service can only update it (by name), so we create it here, and
+// it is deleted with the Ensemble. The service owns the spec (the holder).
+func (r *EnsembleReconciler) applyLease(
+	ctx context.Context,
+	ensemble *api.Ensemble,
+) error {
+	lease := &coordinationv1.Lease{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      ensemble.LeaseName(),
+			Namespace: ensemble.Namespace,
+			Labels:    getDeploymentLabels(ensemble),
+		},
+	}
+	return r.applyObject(ctx, ensemble, lease)
+}
+
+// ensureDisruptionBudget keeps one replica of the ensemble service available
+// during voluntary disruptions (e.g., a node drain). With one replica (or when
+// suspended) it would block the drain, so we only have it with more than one.
+func (r *EnsembleReconciler) ensureDisruptionBudget(
+	ctx context.Context,
+	ensemble *api.Ensemble,
+) error {
+
+	pdb := &policyv1.PodDisruptionBudget{}
+	err := r.Get(ctx, client.ObjectKey{Name: ensemble.Name, Namespace: ensemble.Namespace}, pdb)
+	if err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+	exists := err == nil
+
+	if getDeploymentReplicas(ensemble) <= 1 {
+		if !exists || !metav1.IsControlledBy(pdb, ensemble) {
+			return nil
+		}
+		fmt.Println("      Deleting Ensemble Service PodDisruptionBudget")
+		return client.IgnoreNotFound(r.Delete(ctx, pdb))
+	}
+
+	minAvailable := intstr.FromInt(1)
+	pdb = &policyv1.PodDisruptionBudget{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      ensemble.Name,
+			Namespace: ensemble.Namespace,
+		},
+		Spec: policyv1.PodDisruptionBudgetSpec{
+			MinAvailable: &minAvailable,
+			Selector:     &metav1.LabelSelector{MatchLabels: getDeploymentLabels(ensemble)},
+		},
+	}
+	return r.applyObject(ctx, ensemble, pdb)
+}
@@ -0,0 +1,252 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	corev1 "k8s.io/api/core/v1"
+	policyv1 "k8s.io/api/policy/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/rest"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/client/interceptor"
+
+	api "github.com/converged-computing/ensemble-operator/api/v1alpha1"
+)
+
+// newApplyReconciler returns a reconciler with a fake client. The fake client
+// doesn't support server-side apply, so an apply creates or replaces the object.
+func newApplyReconciler(t *testing.T) *EnsembleReconciler {
+	t.Helper()
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	if err := api.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	apply := func(ctx context.Context, c client.WithWatch, obj client.Object, patch client.Patch, opts ...client.PatchOption) error {
+		if patch.Type() != types.ApplyPatchType {
+			return c.Patch(ctx, obj, patch, opts...)
+		}
+		existing := obj.DeepCopyObject().(client.Object)
+		err := c.Get(ctx, client.ObjectKeyFromObject(obj), existing)
+		if errors.IsNotFound(err) {
+			return c.Create(ctx, obj)
+		}
+		if err != nil {
+			return err
+		}
+		obj.SetResourceVersion(existing.GetResourceVersion())
+		return c.Update(ctx, obj)
+	}
+	c := fake.NewClientBuilder().
+		WithScheme(scheme).
+		WithInterceptorFuncs(interceptor.Funcs{Patch: apply}).
+		Build()
+	return &EnsembleReconciler{Client: c, Scheme: scheme}
+}
+
+// newReplicatedEnsemble returns a defaulted ensemble with service replicas
+func newReplicatedEnsemble(replicas int32) *api.Ensemble {
+	ensemble := &api.Ensemble{
+		ObjectMeta: metav1.ObjectMeta{Name: "ens", Namespace: "default", UID: "ens-uid"},
+		Spec:       api.EnsembleSpec{Sidecar: api.Sidecar{Replicas: replicas}},
+	}
+	ensemble.Default()
+	return ensemble
+}
+
+func TestApplyLease(t *testing.T) {
+	ctx := context.Background()
+	r := newApplyReconciler(t)
+	ensemble := newReplicatedEnsemble(2)
+
+	err := r.applyLease(ctx, ensemble)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lease := &coordinationv1.Lease{}
+	err = r.Get(ctx, client.ObjectKey{Name: ensemble.LeaseName(), Namespace: "default"}, lease)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !metav1.IsControlledBy(lease, ensemble) {
+		t.Fatal("expected the lease to be owned by the ensemble")
+	}
+
+	// The service pods are selected by the same labels
+	for key, value := range getDeploymentLabels(ensemble) {
+		if lease.Labels[key] != value {
+			t.Fatalf("expected lease label %s=%s, got %v", key, value, lease.Labels)
+		}
+	}
+}
+
+// TestDisruptionBudget checks the budget is only kept with more than one
+// replica, so it doesn't block a node drain
+func TestDisruptionBudget(t *testing.T) {
+	ctx := context.Background()
+	r := newApplyReconciler(t)
+	key := client.ObjectKey{Name: "ens", Namespace: "default"}
+
+	tests := []struct {
+		name     string
+		replicas int32
+		suspend  bool
+		exists   bool
+	}{
+		{name: "one replica", replicas: 1},
+		{name: "more replicas", replicas: 3, exists: true},
+		{name: "suspended", replicas: 3, suspend: true},
+		{name: "more replicas again", replicas: 2, exists: true},
+		{name: "back to one replica", replicas: 1},
+	}
+	for _, test := range tests {
+		ensemble := newReplicatedEnsemble(test.replicas)
+		ensemble.Spec.Suspend = test.suspend
+		err := r.ensureDisruptionBudget(ctx, ensemble)
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		pdb := &policyv1.PodDisruptionBudget{}
+		err = r.Get(ctx, key, pdb)
+		if test.exists != (err == nil) {
+			t.Fatalf("%s: expected the budget to exist to be %t, got %v", test.name, test.exists, err)
+		}
+		if test.exists && pdb.Spec.MinAvailable.IntValue() != 1 {
+			t.Fatalf("%s: expected one replica to be available, got %s", test.name, pdb.Spec.MinAvailable.String())
+		}
+	}
+
+	// A budget the ensemble doesn't own is left alone
+	other := &policyv1.PodDisruptionBudget{ObjectMeta: metav1.ObjectMeta{Name: "ens", Namespace: "default"}}
+	if err := r.Create(ctx, other); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.ensureDisruptionBudget(ctx, newReplicatedEnsemble(1)); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Get(ctx, key, other); err != nil {
+		t.Fatalf("expected a budget the ensemble doesn't own to be kept, got %v", err)
+	}
+}
+
+// TestDeploymentReplicas checks each replica of the service has a readiness
+// probe on its port, and what it needs to elect a leader
+func TestDeploymentReplicas(t *testing.T) {
+	r := newApplyReconciler(t)
+	ensemble := newReplicatedEnsemble(2)
+
+	deployment, err := r.newEnsembleDeployment(ensemble)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *deployment.Spec.Replicas != 2 {
+		t.Fatalf("expected 2 replicas, got %d", *deployment.Spec.Replicas)
+	}
+	container := deployment.Spec.Template.Spec.Containers[0]
+	probe := container.ReadinessProbe
+	if probe == nil || probe.TCPSocket == nil || probe.TCPSocket.Port.String() != ensemble.Spec.Sidecar.Port {
+		t.Fatalf("expected a readiness probe on port %s, got %v", ensemble.Spec.Sidecar.Port, probe)
+	}
+
+	env := map[string]corev1.EnvVar{}
+	for _, variable := range container.Env {
+		env[variable.Name] = variable
+	}
+	if env["ENSEMBLE_LEASE_NAME"].Value != ensemble.LeaseName() {
+		t.Fatalf("expected the lease name %s, got %v", ensemble.LeaseName(), env["ENSEMBLE_LEASE_NAME"])
+	}
+	for _, name := range []string{"POD_NAME", "POD_NAMESPACE"} {
+		if env[name].ValueFrom == nil || env[name].ValueFrom.FieldRef == nil {
+			t.Fatalf("expected %s from the pod, got %v", name, env[name])
+		}
+	}
+
+	// A suspended ensemble has no replicas
+	ensemble.Spec.Suspend = true
+	deployment, err = r.newEnsembleDeployment(ensemble)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *deployment.Spec.Replicas != 0 {
+		t.Fatalf("expected no replicas when suspended, got %d", *deployment.Spec.Replicas)
+	}
+}
+
+// TestServiceReadinessCached checks the service is only health checked when
+// the deployment changes, and not again for the same deployment state
+func TestServiceReadinessCached(t *testing.T) {
+	ctx := context.Background()
+	r := newApplyReconciler(t)
+
+	// Nothing is listening, so a health check fails
+	r.RESTConfig = &rest.Config{Host: "http://127.0.0.1:1"}
+	ensemble := newReplicatedEnsemble(1)
+	deployment, err := r.newEnsembleDeployment(ensemble)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deployment.Status = appsv1.DeploymentStatus{
+		ObservedGeneration: 1,
+		ReadyReplicas:      1,
+		AvailableReplicas:  1,
+		Conditions: []appsv1.DeploymentCondition{
+			{Type: appsv1.DeploymentAvailable, Status: corev1.ConditionTrue},
+		},
+	}
+	if err := r.Create(ctx, deployment); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Get(ctx, client.ObjectKeyFromObject(deployment), deployment); err != nil {
+		t.Fatal(err)
+	}
+
+	// The deployment state passed a health check before
+	key := client.ObjectKeyFromObject(ensemble)
+	r.healthChecks.Store(key, getDeploymentState(deployment))
+	readiness, _ := r.getServiceReadiness(ctx, ensemble)
+	if !readiness.ready {
+		t.Fatalf("expected the service to be ready without a health check, got %s", readiness.reason)
+	}
+
+	// A replica that restarted is checked again
+	deployment.Status.ReadyReplicas = 0
+	if err := r.Status().Update(ctx, deployment); err != nil {
+		t.Fatal(err)
+	}
+	readiness, result := r.getServiceReadiness(ctx, ensemble)
+	if readiness.ready || readiness.reason != "HealthCheckFailed" {
+		t.Fatalf("expected a failed health check, got %s", readiness.reason)
+	}
+	if result.RequeueAfter == 0 {
+		t.Fatal("expected to check again after a failed health check")
+	}
+	if _, ok := r.healthChecks.Load(key); ok {
+		t.Fatal("expected the failed health check to be forgotten")
+	}
+}
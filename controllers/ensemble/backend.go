@@ -0,0 +1,253 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	api "github.com/converged-computing/ensemble-operator/api/v1alpha1"
+)
+
+// A MemberBackend knows how to manage one type of ensemble member (e.g., a
+// MiniCluster). The reconciler looks up the backend by member type, so new
+// kinds of members can be added by registering a backend in an init.
+type MemberBackend interface {
+
+	// Ensure creates the member workload if it does not exist yet
+	Ensure(ctx context.Context, name string, ensemble *api.Ensemble, member *api.Member) (ctrl.Result, error)
+
+	// Get returns the existing member workload
+	Get(ctx context.Context, name string, ensemble *api.Ensemble) (client.Object, error)
+
+	// Scale changes the size of the member workload, within the member bounds
+	Scale(ctx context.Context, name string, ensemble *api.Ensemble, member *api.Member, size int32) error
+
+	// Status derives the member status from the workload
+	Status(ctx context.Context, name string, ensemble *api.Ensemble, member *api.Member) (api.MemberStatus, error)
+
+	// Delete removes the member workload
+	Delete(ctx context.Context, name string, ensemble *api.Ensemble) error
+
+	// List returns the member workloads that are labeled for the ensemble
+	List(ctx context.Context, ensemble *api.Ensemble) ([]client.Object, error)
+
+	// Restart restarts the ensemble in the member (e.g., the lead broker)
+	// so it reads a new ensemble.yaml
+	Restart(ctx context.Context, name string, ensemble *api.Ensemble, member *api.Member) error
+
+	// RoleRules returns the rules the ensemble service needs to grow and
+	// shrink the members with these names (and no others)
+	RoleRules(names []string) []rbacv1.PolicyRule
+}
+
+// A MemberSuspender is a backend that can suspend its workload in place,
+// which is used for a suspend instead of scaling it to its minimum size
+type MemberSuspender interface {
+
+	// Suspend suspends (or resumes) the member workload, and only resumes
+	// a workload that it suspended
+	Suspend(ctx context.Context, name string, ensemble *api.Ensemble, suspend bool) error
+}
+
+// BackendFactory creates a member backend that uses the reconciler client
+type BackendFactory func(r *EnsembleReconciler) MemberBackend
+
+// Registry of member backends, keyed by member type
+var backends = map[string]BackendFactory{}
+
+// RegisterBackend adds a member backend for a member type
+func RegisterBackend(memberType string, factory BackendFactory) {
+	backends[memberType] = factory
+}
+
+// getBackend returns the member backend for a member type
+func (r *EnsembleReconciler) getBackend(memberType string) (MemberBackend, error) {
+	factory, ok := backends[memberType]
+	if !ok {
+		return nil, fmt.Errorf("member type %s does not have a registered backend", memberType)
+	}
+	return factory(r), nil
+}
+
+// getMemberLabels returns the labels that match the children of a member
+func getMemberLabels(ensemble *api.Ensemble, name string) map[string]string {
+	return map[string]string{
+		api.EnsembleLabel: ensemble.Name,
+		api.MemberLabel:   name,
+	}
+}
+
+// setMemberLabels adds the member labels to a child of the member
+func setMemberLabels(obj metav1.Object, ensemble *api.Ensemble, name string) {
+	labels := obj.GetLabels()
+	if labels == nil {
+		labels = map[string]string{}
+	}
+	for key, value := range getMemberLabels(ensemble, name) {
+		labels[key] = value
+	}
+	obj.SetLabels(labels)
+}
+
+// listMemberObjects lists the children labeled for an ensemble, of any member
+func (r *EnsembleReconciler) listMemberObjects(
+	ctx context.Context,
+	ensemble *api.Ensemble,
+	list client.ObjectList,
+) ([]client.Object, error) {
+
+	err := r.List(
+		ctx, list,
+		client.InNamespace(ensemble.Namespace),
+		client.MatchingLabels{api.EnsembleLabel: ensemble.Name},
+	)
+	if err != nil {
+		return nil, err
+	}
+	items, err := meta.ExtractList(list)
+	if err != nil {
+		return nil, err
+	}
+	objects := []client.Object{}
+	for _, item := range items {
+		obj, ok := item.(client.Object)
+		if ok {
+			objects = append(objects, obj)
+		}
+	}
+	return objects, nil
+}
+
+// getMemberObject finds the child of a member by its labels, and not by
+// its position in the list of members. A child without labels (created by
+// an older operator) is found by name, and adopted if the ensemble owns it.
+func (r *EnsembleReconciler) getMemberObject(
+	ctx context.Context,
+	name string,
+	ensemble *api.Ensemble,
+	obj client.Object,
+	list client.ObjectList,
+) error {
+
+	err := r.List(
+		ctx, list,
+		client.InNamespace(ensemble.Namespace),
+		client.MatchingLabels(getMemberLabels(ensemble, name)),
+	)
+	if err != nil {
+		return err
+	}
+	items, err := meta.ExtractList(list)
+	if err != nil {
+		return err
+	}
+	if len(items) > 0 {
+		found, ok := items[0].(client.Object)
+		if !ok {
+			return fmt.Errorf("member %s child is not an object", name)
+		}
+		return r.Get(ctx, client.ObjectKeyFromObject(found), obj)
+	}
+
+	err = r.Get(ctx, types.NamespacedName{Name: name, Namespace: ensemble.Namespace}, obj)
+	if err != nil {
+		return err
+	}
+	if !metav1.IsControlledBy(obj, ensemble) {
+		return errors.NewNotFound(schema.GroupResource{}, name)
+	}
+	fmt.Printf("      Adopting %s with member labels\n", name)
+	patch := client.MergeFrom(obj.DeepCopyObject().(client.Object))
+	setMemberLabels(obj, ensemble, name)
+	return r.Patch(ctx, obj, patch)
+}
+
+// deletePods deletes the pods that match labels, so their controller recreates them
+func (r *EnsembleReconciler) deletePods(
+	ctx context.Context,
+	namespace string,
+	labels map[string]string,
+) error {
+	pods := &corev1.PodList{}
+	err := r.List(ctx, pods, client.InNamespace(namespace), client.MatchingLabels(labels))
+	if err != nil {
+		return err
+	}
+	for i := range pods.Items {
+		fmt.Printf("      Deleting pod %s to restart it\n", pods.Items[i].Name)
+		err = client.IgnoreNotFound(r.Delete(ctx, &pods.Items[i]))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ensureRequestedSize scales a member if the ensemble service has requested a
+// new size with an annotation on the workload, and then clears the request.
+func (r *EnsembleReconciler) ensureRequestedSize(
+	ctx context.Context,
+	name string,
+	ensemble *api.Ensemble,
+	member *api.Member,
+	backend MemberBackend,
+) error {
+
+	obj, err := backend.Get(ctx, name, ensemble)
+	if err != nil {
+		return client.IgnoreNotFound(err)
+	}
+	value, ok := obj.GetAnnotations()[api.RequestedSizeAnnotation]
+	if !ok {
+		return nil
+	}
+
+	// An invalid request is logged and cleared, it would never succeed
+	size, err := strconv.Atoi(value)
+	if err != nil {
+		r.Log.Error(err, "      Invalid requested size for member", "Member", name, "Size", value)
+	} else {
+		fmt.Printf("      Member %s requested size %d\n", name, size)
+		err = backend.Scale(ctx, name, ensemble, member, int32(size))
+		if err != nil {
+			return err
+		}
+	}
+
+	// Clear the request if the workload still exists
+	obj, err = backend.Get(ctx, name, ensemble)
+	if err != nil {
+		return client.IgnoreNotFound(err)
+	}
+	patch := client.MergeFrom(obj.DeepCopyObject().(client.Object))
+	annotations := obj.GetAnnotations()
+	delete(annotations, api.RequestedSizeAnnotation)
+	obj.SetAnnotations(annotations)
+	return r.Patch(ctx, obj, patch)
+}
@@ -0,0 +1,147 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	api "github.com/converged-computing/ensemble-operator/api/v1alpha1"
+)
+
+// ensureFinishedTTL deletes the children of a finished ensemble once the
+// ttlSecondsAfterFinished is up. It returns true if the ensemble is done
+// (and there is nothing else to reconcile), and otherwise a requeue for
+// when the TTL will be up.
+func (r *EnsembleReconciler) ensureFinishedTTL(
+	ctx context.Context,
+	ensemble *api.Ensemble,
+) (bool, ctrl.Result, error) {
+
+	ttl := ensemble.Spec.TTLSecondsAfterFinished
+	completed := meta.IsStatusConditionTrue(ensemble.Status.Conditions, api.ConditionCompleted)
+	if ttl == nil || !completed || ensemble.Status.CompletionTime == nil {
+		return false, ctrl.Result{}, nil
+	}
+	expires := ensemble.Status.CompletionTime.Add(time.Duration(*ttl) * time.Second)
+	remaining := time.Until(expires)
+	if remaining > 0 {
+		return false, ctrl.Result{RequeueAfter: remaining}, nil
+	}
+
+	fmt.Println("      Ensemble has finished, deleting children after TTL")
+	deleted, err := r.deleteChildren(ctx, ensemble)
+	if err != nil {
+		return true, ctrl.Result{}, err
+	}
+	if deleted > 0 && r.Recorder != nil {
+		r.Recorder.Eventf(
+			ensemble, corev1.EventTypeNormal, "DeletedAfterFinished",
+			"Deleted %d children %d seconds after the ensemble finished", deleted, *ttl,
+		)
+	}
+	return true, ctrl.Result{}, nil
+}
+
+// deleteChildren deletes the members, their config maps, and the ensemble
+// service deployment. The service and rbac are small, and are kept.
+func (r *EnsembleReconciler) deleteChildren(
+	ctx context.Context,
+	ensemble *api.Ensemble,
+) (int, error) {
+
+	memberTypes := []string{}
+	for memberType := range backends {
+		memberTypes = append(memberTypes, memberType)
+	}
+	sort.Strings(memberTypes)
+
+	deleted := 0
+	for _, memberType := range memberTypes {
+		backend, err := r.getBackend(memberType)
+		if err != nil {
+			return deleted, err
+		}
+		objects, err := backend.List(ctx, ensemble)
+		if meta.IsNoMatchError(err) {
+			continue
+		}
+		if err != nil {
+			return deleted, err
+		}
+		for _, obj := range objects {
+			if !metav1.IsControlledBy(obj, ensemble) || obj.GetDeletionTimestamp() != nil {
+				continue
+			}
+			err = backend.Delete(ctx, obj.GetLabels()[api.MemberLabel], ensemble)
+			if err != nil {
+				return deleted, err
+			}
+			deleted += 1
+		}
+	}
+
+	configMaps, err := r.listMemberObjects(ctx, ensemble, &corev1.ConfigMapList{})
+	if err != nil {
+		return deleted, err
+	}
+	for _, obj := range configMaps {
+		if !metav1.IsControlledBy(obj, ensemble) || obj.GetDeletionTimestamp() != nil {
+			continue
+		}
+		err = client.IgnoreNotFound(r.Delete(ctx, obj))
+		if err != nil {
+			return deleted, err
+		}
+		deleted += 1
+	}
+
+	deployment, err := r.getExistingDeployment(ctx, ensemble)
+	if err == nil && deployment.GetDeletionTimestamp() == nil {
+		fmt.Println("      Deleting Ensemble Service Deployment")
+		err = client.IgnoreNotFound(r.Delete(ctx, deployment))
+		if err != nil {
+			return deleted, err
+		}
+		deleted += 1
+	}
+	return deleted, client.IgnoreNotFound(err)
+}
+
+// mapToEnsemble maps a child with the ensemble label (e.g., the job for a
+// MiniCluster, which the ensemble does not own) to a request for the ensemble
+func mapToEnsemble() handler.MapFunc {
+	return func(ctx context.Context, obj client.Object) []reconcile.Request {
+		name, ok := obj.GetLabels()[api.EnsembleLabel]
+		if !ok {
+			return nil
+		}
+		return []reconcile.Request{
+			{NamespacedName: client.ObjectKey{Name: name, Namespace: obj.GetNamespace()}},
+		}
+	}
+}
@@ -18,22 +18,45 @@ package controller
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"strconv"
+	"time"
 
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 
 	"k8s.io/apimachinery/pkg/api/errors"
-	"k8s.io/apimachinery/pkg/types"
 
 	api "github.com/converged-computing/ensemble-operator/api/v1alpha1"
+	pb "github.com/converged-computing/ensemble-operator/protos"
 )
 
 var (
 	ensembleYamlName    = "ensemble.yaml"
-	ensembleYamlDirName = "/ensemble-entrypoint"
+	ensembleYamlDirName = api.EnsembleVolumePath
+	ensembleVolumeName  = api.EnsembleVolumeName
+
+	// The config map records the size of members that must be recreated to scale
+	memberSizeAnnotation = "ensemble.flux-framework.org/size"
+
+	// The config map records the size of members before the ensemble was suspended
+	suspendedSizeAnnotation = "ensemble.flux-framework.org/suspended-size"
+
+	// The config map records the hash of the ensemble yaml, and the hash the
+	// running member was last given (they differ until the member is updated)
+	configHashAnnotation  = "ensemble.flux-framework.org/config-hash"
+	appliedHashAnnotation = "ensemble.flux-framework.org/applied-hash"
+
+	// Option for the ensemble service to update the ensemble yaml of a member,
+	// and how long to wait to try again if it fails
+	updateConfigOption  = "update-config"
+	configRetryInterval = 10 * time.Second
 )
 
 // getConfigMap gets the entrypoint config map
@@ -44,17 +67,10 @@ func (r *EnsembleReconciler) ensureEnsembleConfig(
 	member *api.Member,
 ) (ctrl.Result, error) {
 
-	// Look for the config map by name
+	// Look for the config map by member labels
 	r.Log.Info("👀️ Looking for Ensemble YAML 👀️")
 	existing := &corev1.ConfigMap{}
-	err := r.Get(
-		ctx,
-		types.NamespacedName{
-			Name:      name,
-			Namespace: ensemble.Namespace,
-		},
-		existing,
-	)
+	err := r.getMemberObject(ctx, name, ensemble, existing, &corev1.ConfigMapList{})
 
 	if err != nil {
 
@@ -77,7 +93,145 @@ func (r *EnsembleReconciler) ensureEnsembleConfig(
 		}
 
 	}
-	return ctrl.Result{}, err
+
+	// The ensemble yaml can change (e.g., the spec, or the ConfigMap or Secret
+	// it is from). We update the content and hash here, and the running member
+	// is given the change when the applied hash is behind.
+	hash := getConfigHash(member.Ensemble)
+	content := getConfigContent(member)
+	current, ok := existing.Annotations[configHashAnnotation]
+	if ok && current == hash && existing.Data[ensembleYamlName] == content {
+		return ctrl.Result{}, nil
+	}
+
+	// A config map from an older operator doesn't have a hash, and if the
+	// content is the same, the member already has it
+	unchanged := existing.Data[ensembleYamlName] == content
+	patch := client.MergeFrom(existing.DeepCopy())
+	if existing.Annotations == nil {
+		existing.Annotations = map[string]string{}
+	}
+	if existing.Data == nil {
+		existing.Data = map[string]string{}
+	}
+	if content == "" {
+		delete(existing.Data, ensembleYamlName)
+	} else {
+		existing.Data[ensembleYamlName] = content
+	}
+	existing.Annotations[configHashAnnotation] = hash
+	if !ok && unchanged {
+		existing.Annotations[appliedHashAnnotation] = hash
+	} else {
+		r.Log.Info("✨ Updating Ensemble YAML ✨", "Revision", hash)
+	}
+	err = r.Patch(ctx, existing, patch)
+	if err != nil {
+		r.Log.Error(err, "❌ Failed to update Ensemble YAML")
+		return ctrl.Result{}, err
+	}
+	return ctrl.Result{}, nil
+}
+
+// ensureConfigApplied gives a running member the ensemble yaml when it has
+// changed, either by sending it to the ensemble service (Notify) or by
+// restarting the ensemble (Restart). It returns the revision the member has.
+func (r *EnsembleReconciler) ensureConfigApplied(
+	ctx context.Context,
+	name string,
+	ensemble *api.Ensemble,
+	member *api.Member,
+	backend MemberBackend,
+) (string, ctrl.Result, error) {
+
+	cm := &corev1.ConfigMap{}
+	err := r.getMemberObject(ctx, name, ensemble, cm, &corev1.ConfigMapList{})
+	if err != nil {
+		return "", ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+	hash := cm.Annotations[configHashAnnotation]
+	applied := cm.Annotations[appliedHashAnnotation]
+	if hash == applied {
+		return applied, ctrl.Result{}, nil
+	}
+
+	// A member that doesn't exist yet will read the new ensemble yaml when created
+	_, err = backend.Get(ctx, name, ensemble)
+	if err != nil && !errors.IsNotFound(err) {
+		return applied, ctrl.Result{}, err
+	}
+	if err == nil {
+		if member.ConfigUpdatePolicy == api.ConfigUpdateRestart {
+			err = backend.Restart(ctx, name, ensemble, member)
+		} else {
+			err = r.notifyConfig(ctx, name, ensemble, member, member.Ensemble, hash)
+		}
+
+		// The ensemble service might not be ready, so we try again later
+		if err != nil {
+			r.Log.Error(err, "      Member could not be given the new ensemble yaml", "Member", name)
+			if r.Recorder != nil {
+				r.Recorder.Eventf(
+					ensemble, corev1.EventTypeWarning, "ConfigUpdateFailed",
+					"Member %s could not be given ensemble yaml revision %s: %s", name, hash, err,
+				)
+			}
+			return applied, ctrl.Result{RequeueAfter: configRetryInterval}, nil
+		}
+		if r.Recorder != nil {
+			r.Recorder.Eventf(
+				ensemble, corev1.EventTypeNormal, "ConfigUpdated",
+				"Member %s was given ensemble yaml revision %s (%s)", name, hash, member.ConfigUpdatePolicy,
+			)
+		}
+	}
+
+	patch := client.MergeFrom(cm.DeepCopy())
+	cm.Annotations[appliedHashAnnotation] = hash
+	err = r.Patch(ctx, cm, patch)
+	if err != nil {
+		return applied, ctrl.Result{}, err
+	}
+	return hash, ctrl.Result{}, nil
+}
+
+// notifyConfig sends the new ensemble yaml for a member to the ensemble service
+func (r *EnsembleReconciler) notifyConfig(
+	ctx context.Context,
+	name string,
+	ensemble *api.Ensemble,
+	member *api.Member,
+	content string,
+	revision string,
+) error {
+
+	payload, err := json.Marshal(map[string]string{
+		"member":   name,
+		"revision": revision,
+		"ensemble": content,
+	})
+	if err != nil {
+		return err
+	}
+	c, err := r.getEnsembleClient(ctx, ensemble)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	fmt.Printf("      Sending ensemble yaml revision %s to member %s\n", revision, name)
+	response, err := c.RequestUpdate(ctx, &pb.UpdateRequest{
+		Member:  member.Type(),
+		Options: updateConfigOption,
+		Payload: string(payload),
+	})
+	if err != nil {
+		return err
+	}
+	if response.Status != pb.Response_SUCCESS {
+		return fmt.Errorf("update returned %s: %s", response.Status, response.Payload)
+	}
+	return nil
 }
 
 // createConfigMap generates a config map with some kind of data
@@ -87,18 +241,140 @@ func (r *EnsembleReconciler) createConfigMap(
 	name string,
 ) *corev1.ConfigMap {
 
-	data := map[string]string{
-		ensembleYamlName: member.Ensemble,
+	// The member is created with this ensemble yaml, so it is applied
+	hash := getConfigHash(member.Ensemble)
+	data := map[string]string{}
+	content := getConfigContent(member)
+	if content != "" {
+		data[ensembleYamlName] = content
 	}
 	cm := &corev1.ConfigMap{
 		TypeMeta: metav1.TypeMeta{},
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      name,
 			Namespace: ensemble.Namespace,
+			Annotations: map[string]string{
+				configHashAnnotation:  hash,
+				appliedHashAnnotation: hash,
+			},
 		},
 		Data: data,
 	}
-	fmt.Println(cm.Data)
+	setMemberLabels(cm, ensemble, name)
 	ctrl.SetControllerReference(ensemble, cm, r.Scheme)
 	return cm
 }
+
+// getConfigHash returns a short hash of the ensemble yaml, the config revision
+func getConfigHash(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(sum[:])[:16]
+}
+
+// getConfigContent returns the ensemble yaml for the member config map, which
+// is empty if it is mounted from a Secret (so the Secret isn't copied)
+func getConfigContent(member *api.Member) string {
+	if getEnsembleSecret(member) != nil {
+		return ""
+	}
+	return member.Ensemble
+}
+
+// getConfigItems returns the keys of the member config map to mount
+func getConfigItems(member *api.Member) map[string]string {
+	items := map[string]string{ensembleHostName: ensembleHostName}
+	if getEnsembleSecret(member) == nil {
+		items[ensembleYamlName] = ensembleYamlName
+	}
+	return items
+}
+
+// getEnsembleVolume returns the config map volume with the ensemble.yaml (unless
+// it is from a Secret) and host, for members that are not a MiniCluster (and use a pod spec)
+func getEnsembleVolume(name string, member *api.Member) (corev1.Volume, corev1.VolumeMount) {
+	items := []corev1.KeyToPath{{Key: ensembleHostName, Path: ensembleHostName}}
+	if getEnsembleSecret(member) == nil {
+		items = append([]corev1.KeyToPath{{Key: ensembleYamlName, Path: ensembleYamlName}}, items...)
+	}
+	volume := corev1.Volume{
+		Name: ensembleVolumeName,
+		VolumeSource: corev1.VolumeSource{
+			ConfigMap: &corev1.ConfigMapVolumeSource{
+				LocalObjectReference: corev1.LocalObjectReference{Name: name},
+				Items:                items,
+			},
+		},
+	}
+	mount := corev1.VolumeMount{
+		Name:      ensembleVolumeName,
+		MountPath: ensembleYamlDirName,
+		ReadOnly:  true,
+	}
+	return volume, mount
+}
+
+// getMemberSize returns the size saved for a member, or 0 if not set
+func (r *EnsembleReconciler) getMemberSize(
+	ctx context.Context,
+	name string,
+	ensemble *api.Ensemble,
+) (int32, error) {
+	return r.getConfigSize(ctx, name, ensemble, memberSizeAnnotation)
+}
+
+// setMemberSize saves the size for a member on its config map
+func (r *EnsembleReconciler) setMemberSize(
+	ctx context.Context,
+	name string,
+	ensemble *api.Ensemble,
+	size int32,
+) error {
+	return r.setConfigSize(ctx, name, ensemble, memberSizeAnnotation, size)
+}
+
+// getConfigSize returns a size saved in an annotation on the member config map,
+// or 0 if not set
+func (r *EnsembleReconciler) getConfigSize(
+	ctx context.Context,
+	name string,
+	ensemble *api.Ensemble,
+	annotation string,
+) (int32, error) {
+	cm := &corev1.ConfigMap{}
+	err := r.getMemberObject(ctx, name, ensemble, cm, &corev1.ConfigMapList{})
+	if err != nil {
+		return 0, err
+	}
+	value, ok := cm.Annotations[annotation]
+	if !ok {
+		return 0, nil
+	}
+	size, err := strconv.Atoi(value)
+	return int32(size), err
+}
+
+// setConfigSize saves a size in an annotation on the member config map,
+// and a size of 0 removes it
+func (r *EnsembleReconciler) setConfigSize(
+	ctx context.Context,
+	name string,
+	ensemble *api.Ensemble,
+	annotation string,
+	size int32,
+) error {
+	cm := &corev1.ConfigMap{}
+	err := r.getMemberObject(ctx, name, ensemble, cm, &corev1.ConfigMapList{})
+	if err != nil {
+		return err
+	}
+	patch := client.MergeFrom(cm.DeepCopy())
+	if cm.Annotations == nil {
+		cm.Annotations = map[string]string{}
+	}
+	if size > 0 {
+		cm.Annotations[annotation] = strconv.Itoa(int(size))
+	} else {
+		delete(cm.Annotations, annotation)
+	}
+	return r.Patch(ctx, cm, patch)
+}
@@ -0,0 +1,74 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"fmt"
+
+	api "github.com/converged-computing/ensemble-operator/api/v1alpha1"
+)
+
+// getBlockedPhase returns the phase of a member that is waiting on the members
+// it depends on (Blocked), and why, or an empty phase if it is not waiting.
+// The phases are for the members that were already handled, by their index in
+// the spec (members are ordered so dependencies come first). If a dependency
+// failed (or was failed by a failure it depended on) the member can never run,
+// and the phase is Failed.
+func getBlockedPhase(
+	ensemble *api.Ensemble,
+	member *api.Member,
+	phases map[int][]api.MemberPhase,
+) (api.MemberPhase, string) {
+
+	for _, dependency := range member.DependsOn {
+		index := ensemble.GetMemberIndex(dependency.Name)
+		if index < 0 {
+			return api.MemberPhaseBlocked, fmt.Sprintf("member %s does not exist", dependency.Name)
+		}
+		found := phases[index]
+		if len(found) < ensemble.Spec.Members[index].CountMembers() {
+			return api.MemberPhaseBlocked, fmt.Sprintf("waiting for member %s", dependency.Name)
+		}
+		for _, phase := range found {
+			if !isDependencyMet(dependency.Condition, phase) {
+				if phase == api.MemberPhaseFailed {
+					return api.MemberPhaseFailed, fmt.Sprintf("member %s has failed", dependency.Name)
+				}
+				return api.MemberPhaseBlocked, fmt.Sprintf(
+					"waiting for member %s to be %s", dependency.Name, getDependencyCondition(dependency),
+				)
+			}
+		}
+	}
+	return "", ""
+}
+
+// getDependencyCondition returns the condition for a dependency (default Completed)
+func getDependencyCondition(dependency api.Dependency) api.DependencyCondition {
+	if dependency.Condition == "" {
+		return api.DependencyCompleted
+	}
+	return dependency.Condition
+}
+
+// isDependencyMet determines if a member phase satisfies a dependency condition
+func isDependencyMet(condition api.DependencyCondition, phase api.MemberPhase) bool {
+	if condition == api.DependencyReady {
+		return phase == api.MemberPhaseRunning || phase == api.MemberPhaseCompleted
+	}
+	return phase == api.MemberPhaseCompleted
+}
@@ -0,0 +1,136 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"testing"
+
+	api "github.com/converged-computing/ensemble-operator/api/v1alpha1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestGetBlockedPhase(t *testing.T) {
+	ensemble := &api.Ensemble{
+		ObjectMeta: metav1.ObjectMeta{Name: "ens"},
+		Spec: api.EnsembleSpec{
+			Members: []api.Member{
+				{Name: "preprocess"},
+				{Name: "simulation", Replicas: 2},
+				{Name: "analysis", DependsOn: []api.Dependency{{Name: "simulation"}}},
+				{Name: "monitor", DependsOn: []api.Dependency{{Name: "simulation", Condition: api.DependencyReady}}},
+				{Name: "report", DependsOn: []api.Dependency{{Name: "preprocess"}, {Name: "analysis"}}},
+				{Name: "orphan", DependsOn: []api.Dependency{{Name: "missing"}}},
+			},
+		},
+	}
+	running := api.MemberPhaseRunning
+	completed := api.MemberPhaseCompleted
+	failed := api.MemberPhaseFailed
+
+	tests := []struct {
+		name    string
+		member  int
+		phases  map[int][]api.MemberPhase
+		phase   api.MemberPhase
+		message string
+	}{
+		{
+			name:   "no dependencies",
+			member: 0,
+		},
+		{
+			name:    "dependency not handled yet",
+			member:  2,
+			phases:  map[int][]api.MemberPhase{},
+			phase:   api.MemberPhaseBlocked,
+			message: "waiting for member simulation",
+		},
+		{
+			name:    "only some replicas of the dependency handled",
+			member:  2,
+			phases:  map[int][]api.MemberPhase{1: {completed}},
+			phase:   api.MemberPhaseBlocked,
+			message: "waiting for member simulation",
+		},
+		{
+			name:    "dependency running, waiting for completed",
+			member:  2,
+			phases:  map[int][]api.MemberPhase{1: {completed, running}},
+			phase:   api.MemberPhaseBlocked,
+			message: "waiting for member simulation to be Completed",
+		},
+		{
+			name:   "dependency completed",
+			member: 2,
+			phases: map[int][]api.MemberPhase{1: {completed, completed}},
+		},
+		{
+			name:   "dependency running is ready",
+			member: 3,
+			phases: map[int][]api.MemberPhase{1: {running, completed}},
+		},
+		{
+			name:    "dependency pending is not ready",
+			member:  3,
+			phases:  map[int][]api.MemberPhase{1: {running, api.MemberPhasePending}},
+			phase:   api.MemberPhaseBlocked,
+			message: "waiting for member simulation to be Ready",
+		},
+		{
+			name:    "dependency failed",
+			member:  2,
+			phases:  map[int][]api.MemberPhase{1: {completed, failed}},
+			phase:   api.MemberPhaseFailed,
+			message: "member simulation has failed",
+		},
+		{
+			name:    "failed dependency is not ready",
+			member:  3,
+			phases:  map[int][]api.MemberPhase{1: {running, failed}},
+			phase:   api.MemberPhaseFailed,
+			message: "member simulation has failed",
+		},
+		{
+			name:    "failure of a dependency of a dependency",
+			member:  4,
+			phases:  map[int][]api.MemberPhase{0: {completed}, 1: {failed, completed}, 2: {failed}},
+			phase:   api.MemberPhaseFailed,
+			message: "member analysis has failed",
+		},
+		{
+			name:    "blocked dependency",
+			member:  4,
+			phases:  map[int][]api.MemberPhase{0: {completed}, 2: {api.MemberPhaseBlocked}},
+			phase:   api.MemberPhaseBlocked,
+			message: "waiting for member analysis to be Completed",
+		},
+		{
+			name:    "unknown dependency",
+			member:  5,
+			phase:   api.MemberPhaseBlocked,
+			message: "member missing does not exist",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			phase, message := getBlockedPhase(ensemble, &ensemble.Spec.Members[test.member], test.phases)
+			if phase != test.phase || message != test.message {
+				t.Fatalf("expected %q (%q), got %q (%q)", test.phase, test.message, phase, message)
+			}
+		})
+	}
+}
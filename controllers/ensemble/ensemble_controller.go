@@ -19,17 +19,24 @@ package controller
 import (
 	"context"
 	"fmt"
-	"reflect"
+	"sync"
 
 	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
 	corev1 "k8s.io/api/core/v1"
+	policyv1 "k8s.io/api/policy/v1"
 	rbacv1 "k8s.io/api/rbac/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/record"
 	ctrl "sigs.k8s.io/controller-runtime"
+	ctrlbuilder "sigs.k8s.io/controller-runtime/pkg/builder"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/log"
+	jobset "sigs.k8s.io/jobset/api/jobset/v1alpha2"
 
 	api "github.com/converged-computing/ensemble-operator/api/v1alpha1"
 	minicluster "github.com/flux-framework/flux-operator/api/v1alpha2"
@@ -43,6 +50,11 @@ type EnsembleReconciler struct {
 	Log        logr.Logger
 	RESTClient rest.Interface
 	RESTConfig *rest.Config
+	Recorder   record.EventRecorder
+
+	// healthChecks holds the deployment state each ensemble service last
+	// passed a health check in, so it is only checked when that changes
+	healthChecks sync.Map
 }
 
 //+kubebuilder:rbac:groups=ensemble.flux-framework.org,resources=ensembles,verbs=get;list;watch;create;update;patch;delete
@@ -53,6 +65,12 @@ type EnsembleReconciler struct {
 //+kubebuilder:rbac:groups=flux-framework.org,resources=miniclusters/status,verbs=get;list;watch;create;update;patch;delete
 //+kubebuilder:rbac:groups=flux-framework.org,resources=miniclusters/finalizers,verbs=get;list;watch;create;update;patch;delete
 
+//+kubebuilder:rbac:groups=jobset.x-k8s.io,resources=jobsets,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=jobset.x-k8s.io,resources=jobsets/status,verbs=get
+
+//+kubebuilder:rbac:groups=batch,resources=jobs,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=batch,resources=jobs/status,verbs=get
+
 //+kubebuilder:rbac:groups=core,resources=pods/log,verbs=get;list;watch;create;update;patch;delete
 //+kubebuilder:rbac:groups=core,resources=pods/exec,verbs=get;list;watch;create;update;patch;delete
 //+kubebuilder:rbac:groups=core,resources=pods,verbs=get;list;watch;create;update;patch;delete
@@ -64,8 +82,13 @@ type EnsembleReconciler struct {
 //+kubebuilder:rbac:groups="",resources=roles,verbs=get;list;watch;create;update;patch;delete
 //+kubebuilder:rbac:groups="",resources=rolebindings,verbs=get;list;watch;create;update;patch;delete
 //+kubebuilder:rbac:groups=core,resources=serviceaccounts,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=core,resources=secrets,verbs=get;list;watch;create;update;patch;delete;deletecollection
 //+kubebuilder:rbac:groups=core,resources=configmaps,verbs=get;list;watch;create;update;patch;delete
 //+kubebuilder:rbac:groups=apps,resources=deployments,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=core,resources=events,verbs=create;patch
+//+kubebuilder:rbac:groups=coordination.k8s.io,resources=leases,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=policy,resources=poddisruptionbudgets,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=cert-manager.io,resources=certificates,verbs=get;list;watch;create;update;patch;delete
 
 // Reconcile until the cluster matches the state of the desired Ensemble
 // For more details, check Reconcile and its Result here:
@@ -89,6 +112,7 @@ func (r *EnsembleReconciler) Reconcile(ctx context.Context, req ctrl.Request) (c
 		// Create it, doesn't exist yet
 		if errors.IsNotFound(err) {
 			fmt.Println("      Ensemble not found. Ignoring since object must be deleted.")
+			r.healthChecks.Delete(req.NamespacedName)
 			return ctrl.Result{}, nil
 		}
 		fmt.Println("      Failed to get Ensemble. Re-running reconcile.")
@@ -103,6 +127,12 @@ func (r *EnsembleReconciler) Reconcile(ctx context.Context, req ctrl.Request) (c
 	}
 	fmt.Printf("      Members %d\n", len(ensemble.Spec.Members))
 
+	// A finished ensemble has its children deleted after the TTL
+	finished, requeue, err := r.ensureFinishedTTL(ctx, &ensemble)
+	if err != nil || finished {
+		return requeue, err
+	}
+
 	// First create the grpc service that will coordinate with all ensembles
 	// This takes stress off of the operator to do the individual updaters,
 	// and we only need to change here to request changes to the elements
@@ -115,45 +145,260 @@ func (r *EnsembleReconciler) Reconcile(ctx context.Context, req ctrl.Request) (c
 		return result, err
 	}
 
-	// Ensure we have the MiniCluster (get or create!)
-	// We only have MiniCluster now, but this design can be extended to others
-	for i, member := range ensemble.Spec.Members {
+	// Members are only created when the service is ready, so requests are not lost.
+	// We watch the deployment, so we hear when it becomes available.
+	readiness, result := r.getServiceReadiness(ctx, &ensemble)
+	requeue = soonerResult(requeue, result)
 
-		// This indicates the ensemble member is a MiniCluster
-		if !reflect.DeepEqual(member.MiniCluster, minicluster.MiniClusterSpec{}) {
+	// Ensure we have each member (get or create!)
+	// Each member type has a backend that knows how to manage it
+	// Replicas and the matrix generate more than one member from an entry
+	// The ensemble yaml can come from a ConfigMap or Secret (ensembleFrom)
+	resolved, err := r.resolveEnsembleFrom(ctx, &ensemble)
+	if err != nil {
+		r.Log.Error(err, "      Ensemble yaml could not be read for members")
+		return ctrl.Result{}, err
+	}
+	err = resolved.Validate()
+	if err != nil {
+		r.Log.Error(err, "      Your ensemble yaml did not validate")
+		return ctrl.Result{}, err
+	}
+	members, err := resolved.GetMembers()
+	if err != nil {
+		r.Log.Error(err, "      Ensemble members could not be generated")
+		return ctrl.Result{}, err
+	}
+	err = r.setEnsembleFrom(&ensemble, resolved, members)
+	if err != nil {
+		r.Log.Error(err, "      Ensemble yaml could not be mounted for members")
+		return ctrl.Result{}, err
+	}
 
-			// Name is the index + ensemble name
-			name := fmt.Sprintf("%s-%d", ensemble.Name, i)
+	// Members are handled after the members they depend on
+	order, err := ensemble.MemberOrder()
+	if err != nil {
+		r.Log.Error(err, "      Ensemble members could not be ordered")
+		return ctrl.Result{}, err
+	}
+	byIndex := map[int][]api.GeneratedMember{}
+	for _, generated := range members {
+		byIndex[generated.Index] = append(byIndex[generated.Index], generated)
+	}
 
-			// Create the config map volume (the ensemble.yaml)
-			// for the MiniCluster to run as the entrypoint
-			result, err := r.ensureEnsembleConfig(ctx, name, &ensemble, &member)
+	// Phases of generated members, by the index of the member in the spec
+	phases := map[int][]api.MemberPhase{}
+	found := map[string]api.MemberStatus{}
+	for _, index := range order {
+		for _, generated := range byIndex[index] {
+			status, result, err := r.ensureMember(ctx, &ensemble, generated, phases, readiness)
 			if err != nil {
 				return result, err
 			}
 
-			result, err = r.ensureMiniClusterEnsemble(ctx, name, &ensemble, &member)
-			if err != nil {
-				return result, err
-			}
+			// Some members need to be checked again (e.g., for a heartbeat)
+			requeue = soonerResult(requeue, result)
+			phases[index] = append(phases[index], status.Phase)
+			found[generated.Name] = status
+		}
+	}
+
+	// Status is in the order of the members (not the order they were handled)
+	statuses := []api.MemberStatus{}
+	for _, generated := range members {
+		statuses = append(statuses, found[generated.Name])
+	}
+
+	// Members removed from the spec have children that need to be cleaned up
+	result, err = r.deleteOrphanedMembers(ctx, &ensemble)
+	if err != nil {
+		return result, err
+	}
+	requeue = soonerResult(requeue, result)
+
+	// Update the ensemble status with what we found for members and the service
+	err = r.updateStatus(ctx, &ensemble, statuses, readiness)
+	if err != nil {
+		if errors.IsConflict(err) {
+			return ctrl.Result{Requeue: true}, nil
 		}
+		return ctrl.Result{}, err
 	}
 	fmt.Println("      Ensemble is Ready!")
 
 	// If we've run updates across them, should requeue per preference of ensemble check frequency
-	return ctrl.Result{}, nil
+	return requeue, nil
+}
+
+// ensureMember creates (or waits to create) a generated member, and returns its status
+func (r *EnsembleReconciler) ensureMember(
+	ctx context.Context,
+	ensemble *api.Ensemble,
+	generated api.GeneratedMember,
+	phases map[int][]api.MemberPhase,
+	readiness serviceReadiness,
+) (api.MemberStatus, ctrl.Result, error) {
+
+	member := generated.Member
+	backend, err := r.getBackend(member.Type())
+	if err != nil {
+		r.Log.Error(err, "      Ensemble member cannot be managed", "Index", generated.Index)
+		return api.MemberStatus{}, ctrl.Result{}, err
+	}
+
+	// Name is the ensemble name + member name (or index), and replica
+	name := generated.Name
+
+	// A member that finished stays finished, and is not created again
+	// (its children might have been deleted after the ensemble finished)
+	previous := getMemberStatus(ensemble, name)
+	if previous != nil && previous.Phase.IsFinished() {
+		return *previous, ctrl.Result{}, nil
+	}
+
+	// A member that is waiting on others is not created until they are done.
+	// Once created, we keep managing it, even if the others change.
+	phase, blocked := getBlockedPhase(ensemble, &member, phases)
+	if phase != "" {
+		_, err := backend.Get(ctx, name, ensemble)
+		if errors.IsNotFound(err) {
+			fmt.Printf("      Member %s is blocked: %s\n", name, blocked)
+			status := api.MemberStatus{
+				Name:       name,
+				Type:       member.Type(),
+				Size:       member.Size(),
+				Phase:      phase,
+				Message:    blocked,
+				Parameters: generated.Parameters,
+			}
+			return status, ctrl.Result{}, nil
+		}
+		if err != nil {
+			return api.MemberStatus{}, ctrl.Result{}, err
+		}
+	}
+
+	// A suspended ensemble keeps members at their minimum (or deletes them)
+	if ensemble.Spec.Suspend {
+		status, err := r.suspendMember(ctx, name, ensemble, &member, backend)
+		status.Parameters = generated.Parameters
+		return status, ctrl.Result{}, err
+	}
+
+	// A new member is created when the ensemble service is ready, so it
+	// doesn't send requests (e.g., to grow) that are lost
+	if !readiness.ready {
+		_, err := backend.Get(ctx, name, ensemble)
+		if errors.IsNotFound(err) {
+			fmt.Printf("      Member %s is waiting for the ensemble service\n", name)
+			return api.MemberStatus{
+				Name:       name,
+				Type:       member.Type(),
+				Size:       member.Size(),
+				Phase:      api.MemberPhasePending,
+				Message:    fmt.Sprintf("Waiting for the ensemble service: %s", readiness.message),
+				Parameters: generated.Parameters,
+			}, ctrl.Result{}, nil
+		}
+		if err != nil {
+			return api.MemberStatus{}, ctrl.Result{}, err
+		}
+	}
+
+	// Create the config map volume (the ensemble.yaml)
+	// for the member to run as the entrypoint
+	result, err := r.ensureEnsembleConfig(ctx, name, ensemble, &member)
+	if err != nil {
+		return api.MemberStatus{}, result, err
+	}
+
+	// The address of the ensemble service is in the config map too
+	hostResult, err := r.ensureMemberHost(ctx, name, ensemble, &member, backend)
+	if err != nil {
+		return api.MemberStatus{}, hostResult, err
+	}
+
+	// With TLS, the member needs a certificate for the ensemble service
+	err = r.ensureMemberTLS(ctx, name, ensemble, &member)
+	if err != nil {
+		return api.MemberStatus{}, ctrl.Result{}, err
+	}
+
+	result, err = backend.Ensure(ctx, name, ensemble, &member)
+	if err != nil {
+		return api.MemberStatus{}, result, err
+	}
+
+	// A running member is given the ensemble yaml when it changes
+	revision, configResult, err := r.ensureConfigApplied(ctx, name, ensemble, &member, backend)
+	if err != nil {
+		return api.MemberStatus{}, ctrl.Result{}, err
+	}
+	result = soonerResult(soonerResult(result, configResult), hostResult)
+
+	// A member that was scaled down for a suspend goes back to its size
+	resumeResult, err := r.resumeMember(ctx, name, ensemble, &member, backend)
+	if err != nil {
+		return api.MemberStatus{}, ctrl.Result{}, err
+	}
+	result = soonerResult(result, resumeResult)
+
+	// The ensemble service can request a new size (grow / shrink)
+	err = r.ensureRequestedSize(ctx, name, ensemble, &member, backend)
+	if err != nil {
+		return api.MemberStatus{}, ctrl.Result{}, err
+	}
+
+	status, err := backend.Status(ctx, name, ensemble, &member)
+	if err != nil {
+		return api.MemberStatus{}, ctrl.Result{}, err
+	}
+	status.Parameters = generated.Parameters
+	status.ConfigRevision = revision
+	return status, result, nil
 }
 
 // SetupWithManager sets up the controller with the Manager.
 func (r *EnsembleReconciler) SetupWithManager(mgr ctrl.Manager) error {
-	return ctrl.NewControllerManagedBy(mgr).
+
+	// Ensembles are found by the ConfigMap or Secret with their ensemble yaml
+	err := mgr.GetFieldIndexer().IndexField(
+		context.Background(), &api.Ensemble{}, ensembleFromIndex, indexEnsembleFrom,
+	)
+	if err != nil {
+		return err
+	}
+
+	// Secrets are only watched by their metadata (and read from the API server,
+	// see the manager), so the operator doesn't keep the data of every Secret
+	// in the cluster. ConfigMaps are cached with their data, which the member
+	// config maps need, and ensembleFrom shares that cache.
+	builder := ctrl.NewControllerManagedBy(mgr).
 		For(&api.Ensemble{}).
 		Owns(&minicluster.MiniCluster{}).
+		Watches(&batchv1.Job{}, handler.EnqueueRequestsFromMapFunc(mapToEnsemble())).
 		Owns(&corev1.Service{}).
 		Owns(&corev1.ServiceAccount{}).
 		Owns(&rbacv1.RoleBinding{}).
 		Owns(&appsv1.Deployment{}).
 		Owns(&corev1.ConfigMap{}).
+		Owns(&corev1.Secret{}, ctrlbuilder.OnlyMetadata).
 		Owns(&rbacv1.Role{}).
-		Complete(r)
+		Owns(&policyv1.PodDisruptionBudget{}).
+		Watches(&corev1.ConfigMap{}, handler.EnqueueRequestsFromMapFunc(r.mapEnsembleFrom("ConfigMap"))).
+		WatchesMetadata(&corev1.Secret{}, handler.EnqueueRequestsFromMapFunc(r.mapEnsembleFrom("Secret")))
+
+	// JobSet is optional, so we only watch it if it is installed
+	if isInstalled(mgr, jobset.GroupVersion.WithKind("JobSet")) {
+		builder = builder.Owns(&jobset.JobSet{})
+	} else {
+		r.Log.Info("JobSet is not installed, jobset members will not be watched")
+	}
+	return builder.Complete(r)
+}
+
+// isInstalled determines if the API for a kind is served by the cluster
+func isInstalled(mgr ctrl.Manager, gvk schema.GroupVersionKind) bool {
+	_, err := mgr.GetRESTMapper().RESTMapping(gvk.GroupKind(), gvk.Version)
+	return err == nil
 }
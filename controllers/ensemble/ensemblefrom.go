@@ -0,0 +1,241 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+
+	minicluster "github.com/flux-framework/flux-operator/api/v1alpha2"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	api "github.com/converged-computing/ensemble-operator/api/v1alpha1"
+)
+
+var (
+	// Ensembles are indexed by the objects their members reference for the
+	// ensemble yaml, e.g., ConfigMap/<name> or Secret/<name>
+	ensembleFromIndex = "spec.members.ensembleFrom"
+
+	// An ensemble yaml from a Secret is mounted here instead of the config map
+	ensembleSecretDirName    = api.EnsembleSecretVolumePath
+	ensembleSecretVolumeName = api.EnsembleSecretVolumeName
+)
+
+// resolveEnsembleFrom returns a copy of the ensemble with the ensemble yaml of
+// each member that uses ensembleFrom read from the ConfigMap or Secret. The
+// copy is only used to generate members (and validate them), and is never saved.
+// A Secret is read to validate it, but it is mounted in the member, not copied.
+func (r *EnsembleReconciler) resolveEnsembleFrom(
+	ctx context.Context,
+	ensemble *api.Ensemble,
+) (*api.Ensemble, error) {
+
+	resolved := ensemble.DeepCopy()
+	for i := range resolved.Spec.Members {
+		member := &resolved.Spec.Members[i]
+		if member.EnsembleFrom == nil {
+			continue
+		}
+		content, err := r.getEnsembleFrom(ctx, ensemble.Namespace, member.EnsembleFrom)
+		if err != nil {
+			if r.Recorder != nil {
+				r.Recorder.Eventf(
+					ensemble, corev1.EventTypeWarning, "EnsembleFromFailed",
+					"Member %s ensemble yaml could not be read: %s", ensemble.MemberName(i), err,
+				)
+			}
+			return nil, err
+		}
+		member.Ensemble = content
+		member.EnsembleFrom = nil
+	}
+	return resolved, nil
+}
+
+// setEnsembleFrom gives generated members the source of their ensemble yaml,
+// so one from a Secret is mounted instead of copied to the config map. The
+// Secret is mounted as is, so it can't use template values (e.g., for a matrix).
+func (r *EnsembleReconciler) setEnsembleFrom(
+	ensemble *api.Ensemble,
+	resolved *api.Ensemble,
+	members []api.GeneratedMember,
+) error {
+
+	for i := range members {
+		generated := &members[i]
+		source := ensemble.Spec.Members[generated.Index].EnsembleFrom
+		generated.Member.EnsembleFrom = source
+		if source == nil || source.SecretKeyRef == nil {
+			continue
+		}
+		if generated.Member.Ensemble != resolved.Spec.Members[generated.Index].Ensemble {
+			err := fmt.Errorf("ensemble yaml from secret %s is mounted as is, and cannot use template values", source.SecretKeyRef.Name)
+			if r.Recorder != nil {
+				r.Recorder.Eventf(
+					ensemble, corev1.EventTypeWarning, "EnsembleFromFailed",
+					"Member %s ensemble yaml could not be mounted: %s", generated.Name, err,
+				)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// getEnsembleFrom reads the ensemble yaml from a ConfigMap or Secret key
+func (r *EnsembleReconciler) getEnsembleFrom(
+	ctx context.Context,
+	namespace string,
+	source *api.EnsembleSource,
+) (string, error) {
+
+	if source.ConfigMapKeyRef != nil {
+		ref := source.ConfigMapKeyRef
+		cm := &corev1.ConfigMap{}
+		err := r.Get(ctx, client.ObjectKey{Name: ref.Name, Namespace: namespace}, cm)
+		if err != nil {
+			return "", err
+		}
+		content, ok := cm.Data[ref.Key]
+		if !ok {
+			return "", fmt.Errorf("configmap %s does not have key %s", ref.Name, ref.Key)
+		}
+		return content, nil
+	}
+	if source.SecretKeyRef != nil {
+		ref := source.SecretKeyRef
+		secret := &corev1.Secret{}
+		err := r.Get(ctx, client.ObjectKey{Name: ref.Name, Namespace: namespace}, secret)
+		if err != nil {
+			return "", err
+		}
+		content, ok := secret.Data[ref.Key]
+		if !ok {
+			return "", fmt.Errorf("secret %s does not have key %s", ref.Name, ref.Key)
+		}
+		return string(content), nil
+	}
+	return "", fmt.Errorf("ensembleFrom does not have a configMapKeyRef or secretKeyRef")
+}
+
+// getEnsembleSecret returns the Secret key with the ensemble yaml of a member,
+// or nil if the ensemble yaml is in the member config map
+func getEnsembleSecret(member *api.Member) *corev1.SecretKeySelector {
+	if member.EnsembleFrom == nil {
+		return nil
+	}
+	return member.EnsembleFrom.SecretKeyRef
+}
+
+// getEnsembleYamlPath returns where the member reads the ensemble yaml
+func getEnsembleYamlPath(member *api.Member) string {
+	secret := getEnsembleSecret(member)
+	if secret != nil {
+		return filepath.Join(ensembleSecretDirName, secret.Key)
+	}
+	return filepath.Join(ensembleYamlDirName, ensembleYamlName)
+}
+
+// addEnsembleSecretToPodSpec mounts the key of the Secret with the ensemble
+// yaml to the container that runs the ensemble, so it isn't copied
+func addEnsembleSecretToPodSpec(podSpec *corev1.PodSpec, container *corev1.Container, member *api.Member) {
+	secret := getEnsembleSecret(member)
+	if secret == nil {
+		return
+	}
+	podSpec.Volumes = append(podSpec.Volumes, corev1.Volume{
+		Name: ensembleSecretVolumeName,
+		VolumeSource: corev1.VolumeSource{
+			Secret: &corev1.SecretVolumeSource{
+				SecretName: secret.Name,
+				Items:      []corev1.KeyToPath{{Key: secret.Key, Path: secret.Key}},
+			},
+		},
+	})
+	container.VolumeMounts = append(container.VolumeMounts, corev1.VolumeMount{
+		Name:      ensembleSecretVolumeName,
+		MountPath: ensembleSecretDirName,
+		ReadOnly:  true,
+	})
+}
+
+// addEnsembleSecretToMiniCluster mounts the key of the Secret with the ensemble
+// yaml to the container that runs the ensemble. The Flux Operator we build
+// with only uses items for a ConfigMap, so it mounts all keys of the Secret
+// until it supports them for a Secret too.
+func addEnsembleSecretToMiniCluster(container *minicluster.MiniClusterContainer, member *api.Member) {
+	secret := getEnsembleSecret(member)
+	if secret == nil {
+		return
+	}
+	container.Volumes[ensembleSecretVolumeName] = minicluster.ContainerVolume{
+		SecretName: secret.Name,
+		Path:       ensembleSecretDirName,
+		Items:      map[string]string{secret.Key: secret.Key},
+		ReadOnly:   true,
+	}
+}
+
+// indexEnsembleFrom returns the objects an ensemble references for the ensemble yaml
+func indexEnsembleFrom(obj client.Object) []string {
+	ensemble, ok := obj.(*api.Ensemble)
+	if !ok {
+		return nil
+	}
+	keys := []string{}
+	for _, member := range ensemble.Spec.Members {
+		if member.EnsembleFrom == nil {
+			continue
+		}
+		if member.EnsembleFrom.ConfigMapKeyRef != nil {
+			keys = append(keys, "ConfigMap/"+member.EnsembleFrom.ConfigMapKeyRef.Name)
+		}
+		if member.EnsembleFrom.SecretKeyRef != nil {
+			keys = append(keys, "Secret/"+member.EnsembleFrom.SecretKeyRef.Name)
+		}
+	}
+	return keys
+}
+
+// mapEnsembleFrom maps a ConfigMap or Secret to requests for the ensembles
+// that reference it for the ensemble yaml
+func (r *EnsembleReconciler) mapEnsembleFrom(kind string) handler.MapFunc {
+	return func(ctx context.Context, obj client.Object) []reconcile.Request {
+		ensembles := &api.EnsembleList{}
+		err := r.List(
+			ctx, ensembles,
+			client.InNamespace(obj.GetNamespace()),
+			client.MatchingFields{ensembleFromIndex: kind + "/" + obj.GetName()},
+		)
+		if err != nil {
+			r.Log.Error(err, "Failed to list ensembles for ensembleFrom", kind, obj.GetName())
+			return nil
+		}
+		requests := []reconcile.Request{}
+		for _, ensemble := range ensembles.Items {
+			requests = append(requests, reconcile.Request{
+				NamespacedName: client.ObjectKey{Name: ensemble.Name, Namespace: ensemble.Namespace},
+			})
+		}
+		return requests
+	}
+}
@@ -0,0 +1,184 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"strings"
+	"testing"
+
+	minicluster "github.com/flux-framework/flux-operator/api/v1alpha2"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+
+	api "github.com/converged-computing/ensemble-operator/api/v1alpha1"
+)
+
+const testEnsembleFromYaml = `jobs:
+  - name: sleep
+    command: sleep 10
+rules:
+  - trigger: start
+    action:
+      name: submit
+      label: sleep
+`
+
+// TestEnsembleFromSecret checks an ensemble yaml from a Secret is mounted in
+// the member, and only one from the spec or a ConfigMap is in the config map
+func TestEnsembleFromSecret(t *testing.T) {
+	scheme := runtime.NewScheme()
+	if err := api.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	r := &EnsembleReconciler{Scheme: scheme}
+	secret := &api.EnsembleSource{
+		SecretKeyRef: &corev1.SecretKeySelector{
+			LocalObjectReference: corev1.LocalObjectReference{Name: "private"},
+			Key:                  "rules.yaml",
+		},
+	}
+	configMap := &api.EnsembleSource{
+		ConfigMapKeyRef: &corev1.ConfigMapKeySelector{
+			LocalObjectReference: corev1.LocalObjectReference{Name: "public"},
+			Key:                  "rules.yaml",
+		},
+	}
+
+	tests := []struct {
+		name   string
+		source *api.EnsembleSource
+
+		// Where the member reads the ensemble yaml
+		path string
+	}{
+		{name: "ensemble in the spec", path: "/ensemble-entrypoint/ensemble.yaml"},
+		{name: "ensemble from a config map", source: configMap, path: "/ensemble-entrypoint/ensemble.yaml"},
+		{name: "ensemble from a secret", source: secret, path: "/ensemble-secret/rules.yaml"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ensemble := &api.Ensemble{ObjectMeta: metav1.ObjectMeta{Name: "ens", Namespace: "default"}}
+			ensemble.Default()
+			fromSecret := test.source == secret
+			member := &api.Member{Ensemble: testEnsembleFromYaml, EnsembleFrom: test.source}
+
+			// The config map only has the content if it isn't from a Secret
+			cm := r.createConfigMap(ensemble, member, "ens-sim")
+			_, ok := cm.Data[ensembleYamlName]
+			if ok == fromSecret {
+				t.Fatalf("expected ensemble.yaml in the config map to be %t, got %v", !fromSecret, cm.Data)
+			}
+			if cm.Annotations[configHashAnnotation] != getConfigHash(testEnsembleFromYaml) {
+				t.Fatal("expected the config revision to be the hash of the ensemble yaml")
+			}
+
+			// A MiniCluster mounts the Secret, and runs the ensemble yaml from it
+			mcMember := member.DeepCopy()
+			mcMember.MiniCluster = &minicluster.MiniCluster{
+				Spec: minicluster.MiniClusterSpec{
+					Containers: []minicluster.MiniClusterContainer{{Image: "ghcr.io/converged-computing/metric-lammps:latest"}},
+				},
+			}
+			mc := r.newMiniCluster("ens-sim", ensemble, mcMember, mcMember.MiniCluster.DeepCopy())
+			container := mc.Spec.Containers[0]
+			volume, ok := container.Volumes[api.EnsembleSecretVolumeName]
+			if ok != fromSecret || (fromSecret && (volume.SecretName != "private" || volume.Items["rules.yaml"] != "rules.yaml")) {
+				t.Fatalf("expected the secret volume to be %t, got %v", fromSecret, container.Volumes)
+			}
+			if _, ok := container.Volumes["ens-sim"].Items[ensembleYamlName]; ok == fromSecret {
+				t.Fatalf("expected the config map item to be %t, got %v", !fromSecret, container.Volumes["ens-sim"].Items)
+			}
+			if !strings.HasSuffix(container.Command, " "+test.path) {
+				t.Fatalf("expected the ensemble to run %s, got %s", test.path, container.Command)
+			}
+
+			// A Job mounts the key of the Secret in the ensemble container
+			jobMember := member.DeepCopy()
+			jobMember.Job = &api.JobMember{Spec: batchv1.JobSpec{
+				Template: corev1.PodTemplateSpec{
+					Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "worker", Image: "busybox"}}},
+				},
+			}}
+			job := (&JobBackend{r: r}).newJob("ens-sim", ensemble, jobMember)
+			podSpec := job.Spec.Template.Spec
+			mounted := false
+			for _, volume := range podSpec.Volumes {
+				if volume.Secret != nil && volume.Secret.SecretName == "private" {
+					mounted = len(volume.Secret.Items) == 1 && volume.Secret.Items[0].Key == "rules.yaml"
+				}
+			}
+			if mounted != fromSecret {
+				t.Fatalf("expected the secret key to be mounted to be %t, got %v", fromSecret, podSpec.Volumes)
+			}
+			if !strings.Contains(podSpec.Containers[0].Command[2], " "+test.path) {
+				t.Fatalf("expected the ensemble to run %s, got %s", test.path, podSpec.Containers[0].Command[2])
+			}
+		})
+	}
+}
+
+// TestSetEnsembleFrom checks an ensemble yaml from a Secret can't be rendered
+// with template values, since it is mounted as is
+func TestSetEnsembleFrom(t *testing.T) {
+	r := &EnsembleReconciler{}
+	secret := &api.EnsembleSource{
+		SecretKeyRef: &corev1.SecretKeySelector{
+			LocalObjectReference: corev1.LocalObjectReference{Name: "private"},
+			Key:                  "rules.yaml",
+		},
+	}
+	templated := strings.ReplaceAll(testEnsembleFromYaml, "sleep 10", "sleep {{ .Parameters.time }}")
+
+	tests := []struct {
+		name    string
+		content string
+		matrix  map[string][]string
+		error   bool
+	}{
+		{name: "replicas without template values", content: testEnsembleFromYaml},
+		{name: "matrix without template values", content: testEnsembleFromYaml, matrix: map[string][]string{"time": {"1", "2"}}},
+		{name: "matrix with template values", content: templated, matrix: map[string][]string{"time": {"1", "2"}}, error: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ensemble := &api.Ensemble{
+				ObjectMeta: metav1.ObjectMeta{Name: "ens", Namespace: "default"},
+				Spec: api.EnsembleSpec{
+					Members: []api.Member{
+						{Name: "sim", Replicas: 2, Matrix: test.matrix, EnsembleFrom: secret, External: &api.ExternalMember{}},
+					},
+				},
+			}
+			resolved := ensemble.DeepCopy()
+			resolved.Spec.Members[0].Ensemble = test.content
+			resolved.Spec.Members[0].EnsembleFrom = nil
+			members, err := resolved.GetMembers()
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = r.setEnsembleFrom(ensemble, resolved, members)
+			if test.error != (err != nil) {
+				t.Fatalf("expected an error to be %t, got %v", test.error, err)
+			}
+			if err == nil && members[0].Member.EnsembleFrom != secret {
+				t.Fatal("expected the generated member to have the ensemble source")
+			}
+		})
+	}
+}
@@ -0,0 +1,526 @@
+package controller
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	api "github.com/converged-computing/ensemble-operator/api/v1alpha1"
+	pb "github.com/converged-computing/ensemble-operator/protos"
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	ensembleTypes "github.com/converged-computing/ensemble-operator/pkg/types"
+)
+
+var (
+	// Set on the credentials secret when the ensemble service knows the member
+	registeredAnnotation = "ensemble.flux-framework.org/registered"
+
+	// Set on the external service with the last size requested for the member
+	recordedSizeAnnotation = "ensemble.flux-framework.org/recorded-size"
+
+	// Options for update requests to register an external member
+	registerOption = "register"
+)
+
+func init() {
+	RegisterBackend(api.ExternalType, func(r *EnsembleReconciler) MemberBackend {
+		return &ExternalBackend{r: r}
+	})
+}
+
+// ExternalBackend manages members that run outside of the cluster. There is
+// no workload, just credentials and a service for the member to connect to.
+type ExternalBackend struct {
+	r *EnsembleReconciler
+}
+
+// Ensure creates the credentials and service, and registers the member
+// with the ensemble service. We requeue to check on the heartbeat.
+func (b *ExternalBackend) Ensure(
+	ctx context.Context,
+	name string,
+	ensemble *api.Ensemble,
+	member *api.Member,
+) (ctrl.Result, error) {
+
+	fmt.Println("✨ Ensuring Ensemble External Member")
+	secret, err := b.ensureCredentials(ctx, name, ensemble)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	err = b.ensureCredentialsTLS(ctx, name, ensemble, secret)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	_, err = b.ensureService(ctx, name, ensemble, member)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+
+	// The heartbeat is checked at half the timeout
+	requeue := ctrl.Result{
+		RequeueAfter: time.Duration(member.External.HeartbeatTimeoutSeconds) * time.Second / 2,
+	}
+	if secret.Annotations[registeredAnnotation] == "true" {
+		fmt.Println("      Found registered Ensemble External Member")
+		return requeue, nil
+	}
+
+	// If the ensemble service isn't ready, we try again later
+	err = b.register(ctx, name, ensemble, secret)
+	if err != nil {
+		fmt.Printf("      Failed to register External Member %s: %s\n", name, err)
+		return ctrl.Result{RequeueAfter: 10 * time.Second}, nil
+	}
+	patch := client.MergeFrom(secret.DeepCopy())
+	if secret.Annotations == nil {
+		secret.Annotations = map[string]string{}
+	}
+	secret.Annotations[registeredAnnotation] = "true"
+	err = b.r.Patch(ctx, secret, patch)
+	return requeue, err
+}
+
+// Get returns the service that exposes the ensemble service to the member
+func (b *ExternalBackend) Get(
+	ctx context.Context,
+	name string,
+	ensemble *api.Ensemble,
+) (client.Object, error) {
+	svc := &corev1.Service{}
+	err := b.r.getMemberObject(ctx, name, ensemble, svc, &corev1.ServiceList{})
+	return svc, err
+}
+
+// Status asks the ensemble service for the last heartbeat of the member
+func (b *ExternalBackend) Status(
+	ctx context.Context,
+	name string,
+	ensemble *api.Ensemble,
+	member *api.Member,
+) (api.MemberStatus, error) {
+
+	status := api.MemberStatus{
+		Name:    name,
+		Type:    api.ExternalType,
+		Size:    member.External.Size,
+		MinSize: member.External.MinSize,
+		MaxSize: member.External.MaxSize,
+		Phase:   api.MemberPhasePending,
+	}
+
+	// Keep the last heartbeat we saw, in case the service is not reachable
+	previous := getMemberStatus(ensemble, name)
+	if previous != nil {
+		status.LastHeartbeatTime = previous.LastHeartbeatTime
+	}
+
+	obj, err := b.Get(ctx, name, ensemble)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			status.Message = "External member service has not been created"
+			return status, nil
+		}
+		return status, err
+	}
+	svc := obj.(*corev1.Service)
+	status.Address = getExternalAddress(svc)
+	if value, ok := svc.Annotations[recordedSizeAnnotation]; ok {
+		size, err := strconv.Atoi(value)
+		if err == nil {
+			status.RequestedSize = int32(size)
+		}
+	}
+
+	reported, err := b.requestStatus(ctx, name, ensemble)
+	if err != nil {
+		status.Message = fmt.Sprintf("Ensemble service did not return member status: %s", err)
+		return status, nil
+	}
+	if reported.Heartbeat > 0 {
+		heartbeat := metav1.NewTime(time.Unix(reported.Heartbeat, 0))
+		status.LastHeartbeatTime = &heartbeat
+	}
+	if reported.Size > 0 {
+		status.Size = reported.Size
+	}
+
+	timeout := time.Duration(member.External.HeartbeatTimeoutSeconds) * time.Second
+	switch {
+	case reported.Phase == "completed":
+		status.Phase = api.MemberPhaseCompleted
+		status.Message = "External member has completed"
+	case reported.Phase == "failed":
+		status.Phase = api.MemberPhaseFailed
+		status.Message = "External member has failed"
+	case status.LastHeartbeatTime == nil:
+		status.Message = "Waiting for external member to connect"
+	case time.Since(status.LastHeartbeatTime.Time) > timeout:
+		status.Message = fmt.Sprintf("No heartbeat from external member in %s", timeout)
+	default:
+		status.Phase = api.MemberPhaseRunning
+		status.Message = "External member is running"
+	}
+	return status, nil
+}
+
+// Scale cannot change an external member, so the request is recorded
+// on the service and reported in status for the member (or a human) to act on
+func (b *ExternalBackend) Scale(
+	ctx context.Context,
+	name string,
+	ensemble *api.Ensemble,
+	member *api.Member,
+	size int32,
+) error {
+	obj, err := b.Get(ctx, name, ensemble)
+	if err != nil {
+		return err
+	}
+	if size < member.External.MinSize {
+		size = member.External.MinSize
+	}
+	if member.External.MaxSize > 0 && size > member.External.MaxSize {
+		size = member.External.MaxSize
+	}
+
+	fmt.Printf("      Recording requested size %d for External Member %s\n", size, name)
+	patch := client.MergeFrom(obj.DeepCopyObject().(client.Object))
+	annotations := obj.GetAnnotations()
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+	annotations[recordedSizeAnnotation] = strconv.Itoa(int(size))
+	obj.SetAnnotations(annotations)
+	return b.r.Patch(ctx, obj, patch)
+}
+
+// List returns the services that belong to the ensemble
+func (b *ExternalBackend) List(
+	ctx context.Context,
+	ensemble *api.Ensemble,
+) ([]client.Object, error) {
+	return b.r.listMemberObjects(ctx, ensemble, &corev1.ServiceList{})
+}
+
+// Restart is not possible, the ensemble runs outside of the cluster
+func (b *ExternalBackend) Restart(
+	ctx context.Context,
+	name string,
+	ensemble *api.Ensemble,
+	member *api.Member,
+) error {
+	return fmt.Errorf("external member %s cannot be restarted by the operator", name)
+}
+
+// RoleRules lets the ensemble service request a size for its own external
+// members, which are represented by their service
+func (b *ExternalBackend) RoleRules(names []string) []rbacv1.PolicyRule {
+	return []rbacv1.PolicyRule{
+		{
+			APIGroups:     []string{""},
+			Resources:     []string{"services"},
+			ResourceNames: names,
+			Verbs:         []string{"get", "patch"},
+		},
+	}
+}
+
+// Delete removes the service and credentials for the member
+func (b *ExternalBackend) Delete(
+	ctx context.Context,
+	name string,
+	ensemble *api.Ensemble,
+) error {
+	fmt.Printf("      Deleting External Member %s\n", name)
+	err := b.r.DeleteAllOf(
+		ctx, &corev1.Secret{},
+		client.InNamespace(ensemble.Namespace),
+		client.MatchingLabels(getMemberLabels(ensemble, name)),
+	)
+	if err != nil {
+		return err
+	}
+	svc, err := b.Get(ctx, name, ensemble)
+	if err != nil {
+		return client.IgnoreNotFound(err)
+	}
+	return client.IgnoreNotFound(b.r.Delete(ctx, svc))
+}
+
+// ensureCredentials creates the secret with a token for the member
+func (b *ExternalBackend) ensureCredentials(
+	ctx context.Context,
+	name string,
+	ensemble *api.Ensemble,
+) (*corev1.Secret, error) {
+
+	secret := &corev1.Secret{}
+	err := b.r.getMemberObject(ctx, name, ensemble, secret, &corev1.SecretList{})
+	if err == nil || !errors.IsNotFound(err) {
+		return secret, err
+	}
+
+	token, err := newToken()
+	if err != nil {
+		return nil, err
+	}
+	secret = &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      getCredentialsName(name),
+			Namespace: ensemble.Namespace,
+		},
+		StringData: map[string]string{
+			"member": name,
+			"token":  token,
+			"port":   ensemble.Spec.Sidecar.Port,
+		},
+	}
+	setMemberLabels(secret, ensemble, name)
+	ctrl.SetControllerReference(ensemble, secret, b.r.Scheme)
+	fmt.Println("      Creating External Member credentials")
+	err = b.r.Create(ctx, secret)
+	return secret, err
+}
+
+// ensureCredentialsTLS copies the client certificate of the member (with TLS)
+// into its credentials, with the name to verify the ensemble service with,
+// so the member has everything it needs to connect in one secret
+func (b *ExternalBackend) ensureCredentialsTLS(
+	ctx context.Context,
+	name string,
+	ensemble *api.Ensemble,
+	secret *corev1.Secret,
+) error {
+	if !ensemble.TLSEnabled() {
+		return nil
+	}
+
+	// cert-manager might not have issued the certificate yet, and the data
+	// of new credentials is only populated from the server
+	certificate := &corev1.Secret{}
+	err := b.r.Get(ctx, client.ObjectKey{Name: getMemberTLSName(name), Namespace: ensemble.Namespace}, certificate)
+	if errors.IsNotFound(err) || secret.Data == nil {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	data := map[string][]byte{
+		corev1.TLSCertKey:       certificate.Data[corev1.TLSCertKey],
+		corev1.TLSPrivateKeyKey: certificate.Data[corev1.TLSPrivateKeyKey],
+		caCertKey:               certificate.Data[caCertKey],
+		"serverName":            []byte(ensemble.ServiceHost()),
+	}
+	patch := client.MergeFrom(secret.DeepCopy())
+	changed := false
+	for key, value := range data {
+		if !bytes.Equal(secret.Data[key], value) {
+			secret.Data[key] = value
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+	fmt.Printf("      Adding certificate to External Member %s credentials\n", name)
+	return b.r.Patch(ctx, secret, patch)
+}
+
+// ensureService exposes the ensemble service for the member to connect to
+func (b *ExternalBackend) ensureService(
+	ctx context.Context,
+	name string,
+	ensemble *api.Ensemble,
+	member *api.Member,
+) (*corev1.Service, error) {
+
+	obj, err := b.Get(ctx, name, ensemble)
+	if err == nil || !errors.IsNotFound(err) {
+		return obj.(*corev1.Service), err
+	}
+
+	port, err := strconv.Atoi(ensemble.Spec.Sidecar.Port)
+	if err != nil {
+		return nil, err
+	}
+	svc := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: ensemble.Namespace,
+		},
+		Spec: corev1.ServiceSpec{
+			Type: member.External.ServiceType,
+			Ports: []corev1.ServicePort{
+				{
+					TargetPort: intstr.FromInt(port),
+					Protocol:   "TCP",
+					Port:       int32(port),
+				},
+			},
+			Selector: getDeploymentLabels(ensemble),
+		},
+	}
+	setMemberLabels(svc, ensemble, name)
+	ctrl.SetControllerReference(ensemble, svc, b.r.Scheme)
+	fmt.Println("      Creating External Member service")
+	err = b.r.Create(ctx, svc)
+	return svc, err
+}
+
+// register tells the ensemble service to expect the member and its token
+func (b *ExternalBackend) register(
+	ctx context.Context,
+	name string,
+	ensemble *api.Ensemble,
+	secret *corev1.Secret,
+) error {
+
+	// The secret data is only populated from the server
+	token := string(secret.Data["token"])
+	if token == "" {
+		return fmt.Errorf("credentials for %s do not have a token yet", name)
+	}
+	payload, err := json.Marshal(map[string]string{"member": name, "token": token})
+	if err != nil {
+		return err
+	}
+
+	c, err := b.r.getEnsembleClient(ctx, ensemble)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	response, err := c.RequestUpdate(ctx, &pb.UpdateRequest{
+		Member:  api.ExternalType,
+		Options: registerOption,
+		Payload: string(payload),
+	})
+	if err != nil {
+		return err
+	}
+	if response.Status != pb.Response_SUCCESS && response.Status != pb.Response_EXISTS {
+		return fmt.Errorf("registration returned %s: %s", response.Status, response.Payload)
+	}
+	return nil
+}
+
+// requestStatus asks the ensemble service for the status of the member
+func (b *ExternalBackend) requestStatus(
+	ctx context.Context,
+	name string,
+	ensemble *api.Ensemble,
+) (*ensembleTypes.ExternalMemberStatus, error) {
+
+	c, err := b.r.getEnsembleClient(ctx, ensemble)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	response, err := c.RequestStatus(ctx, &pb.StatusRequest{Member: name})
+	if err != nil {
+		return nil, err
+	}
+	if response.Status != pb.Response_SUCCESS {
+		return nil, fmt.Errorf("status returned %s: %s", response.Status, response.Payload)
+	}
+	status := &ensembleTypes.ExternalMemberStatus{}
+	err = json.Unmarshal([]byte(response.Payload), status)
+	return status, err
+}
+
+// getExternalHosts returns the addresses external members connect to the
+// ensemble service with, from their spec and LoadBalancer services, in order
+func (r *EnsembleReconciler) getExternalHosts(
+	ctx context.Context,
+	ensemble *api.Ensemble,
+) ([]string, error) {
+
+	seen := map[string]bool{}
+	for _, member := range ensemble.Spec.Members {
+		if member.External == nil {
+			continue
+		}
+		for _, host := range member.External.Hosts {
+			seen[host] = true
+		}
+	}
+	services, err := r.listMemberObjects(ctx, ensemble, &corev1.ServiceList{})
+	if err != nil {
+		return nil, err
+	}
+	for _, obj := range services {
+		svc := obj.(*corev1.Service)
+		if svc.Spec.Type != corev1.ServiceTypeLoadBalancer {
+			continue
+		}
+		for _, ingress := range svc.Status.LoadBalancer.Ingress {
+			if ingress.IP != "" {
+				seen[ingress.IP] = true
+			}
+			if ingress.Hostname != "" {
+				seen[ingress.Hostname] = true
+			}
+		}
+	}
+	hosts := []string{}
+	for host := range seen {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	return hosts, nil
+}
+
+// getExternalAddress returns the address a member outside the cluster uses
+func getExternalAddress(svc *corev1.Service) string {
+	if len(svc.Spec.Ports) == 0 {
+		return ""
+	}
+	port := svc.Spec.Ports[0]
+	switch svc.Spec.Type {
+	case corev1.ServiceTypeLoadBalancer:
+		for _, ingress := range svc.Status.LoadBalancer.Ingress {
+			if ingress.IP != "" {
+				return fmt.Sprintf("%s:%d", ingress.IP, port.Port)
+			}
+			if ingress.Hostname != "" {
+				return fmt.Sprintf("%s:%d", ingress.Hostname, port.Port)
+			}
+		}
+		return ""
+	case corev1.ServiceTypeNodePort:
+		return fmt.Sprintf("<node-address>:%d", port.NodePort)
+	}
+	if svc.Spec.ClusterIP == "" {
+		return ""
+	}
+	return fmt.Sprintf("%s:%d", svc.Spec.ClusterIP, port.Port)
+}
+
+// getCredentialsName returns the name of the secret for a member
+func getCredentialsName(name string) string {
+	return fmt.Sprintf("%s-credentials", name)
+}
+
+// newToken generates a random token for a member to authenticate
+func newToken() (string, error) {
+	token := make([]byte, 32)
+	_, err := rand.Read(token)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(token), nil
+}
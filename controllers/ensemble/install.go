@@ -0,0 +1,192 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	minicluster "github.com/flux-framework/flux-operator/api/v1alpha2"
+	corev1 "k8s.io/api/core/v1"
+
+	api "github.com/converged-computing/ensemble-operator/api/v1alpha1"
+)
+
+var (
+	// Assume the user chose the wrong view, and install python3 cffi
+	preCommand = `
+apt-get update && apt-get install -y python3-cffi || yum update && yum install -y python3-cffi
+python3 -m pip install %s || echo "please install ensemble-python"
+`
+
+	// Custom install from a branch
+	branchPreCommand = `
+apt-get update && apt-get install -y python3-cffi git || yum update && yum install -y python3-cffi git
+git clone -b %s --depth 1 https://github.com/converged-computing/ensemble-python.git /tmp/ensemble-python
+cd /tmp/ensemble-python
+python3 -m pip install . || echo "please install ensemble-python"
+cd -
+`
+
+	// Offline install from a wheel (or a directory of wheels), without a package manager
+	wheelPreCommand = `
+python3 -m pip install --no-index --find-links %s %s || echo "please install ensemble-python"
+`
+
+	// Use ensemble-python copied from an image (installed with pip install --target)
+	initContainerPreCommand = `
+export PYTHONPATH=%s:${PYTHONPATH}
+export PATH=%s/bin:${PATH}
+`
+
+	// The wheel (or copied ensemble-python) is mounted here
+	installVolumeName = api.InstallVolumeName
+	installDirName    = api.InstallVolumePath
+)
+
+// getInstall returns how to install ensemble-python for a member (pip if not set)
+func getInstall(member *api.Member) *api.Install {
+	if member.Install != nil && member.Install.Mode != "" {
+		return member.Install
+	}
+	if member.Branch != "" {
+		return &api.Install{Mode: api.InstallBranch, Branch: member.Branch}
+	}
+	return &api.Install{Mode: api.InstallPip}
+}
+
+// getInstallCommand returns the command to install ensemble python,
+// which is run before the ensemble in the member
+func getInstallCommand(member *api.Member) string {
+	install := getInstall(member)
+	switch install.Mode {
+	case api.InstallBranch:
+		return fmt.Sprintf(branchPreCommand, install.Branch)
+	case api.InstallPreinstalled:
+		return ""
+	case api.InstallWheelFromConfigMap, api.InstallWheelFromVolume:
+		findLinks, target := getWheelPaths(install)
+		return fmt.Sprintf(wheelPreCommand, findLinks, target)
+	case api.InstallInitContainer:
+
+		// A MiniCluster has it in the flux view (already on the paths)
+		if member.Type() == api.MiniclusterType {
+			return ""
+		}
+		return fmt.Sprintf(initContainerPreCommand, installDirName, installDirName)
+	}
+	requirement := "ensemble-python"
+	if install.Version != "" {
+		requirement = fmt.Sprintf("ensemble-python==%s", install.Version)
+	}
+	return fmt.Sprintf(preCommand, requirement)
+}
+
+// getWheelPaths returns where pip finds wheels (for dependencies) and what to
+// install. A directory of wheels is searched for ensemble-python.
+func getWheelPaths(install *api.Install) (string, string) {
+	if install.Mode == api.InstallWheelFromConfigMap {
+		return installDirName, filepath.Join(installDirName, install.ConfigMap.Key)
+	}
+	path := filepath.Join(installDirName, install.Volume.Path)
+	if strings.HasSuffix(path, ".whl") {
+		return filepath.Dir(path), path
+	}
+	return path, "ensemble-python"
+}
+
+// addInstallToMiniCluster adds the volume with the wheel to the MiniCluster
+// container, or the image with ensemble-python as the flux view
+func addInstallToMiniCluster(
+	spec *minicluster.MiniCluster,
+	container *minicluster.MiniClusterContainer,
+	member *api.Member,
+) {
+	install := getInstall(member)
+	switch install.Mode {
+	case api.InstallWheelFromConfigMap:
+		container.Volumes[installVolumeName] = minicluster.ContainerVolume{
+			ConfigMapName: install.ConfigMap.Name,
+			Path:          installDirName,
+			Items:         map[string]string{install.ConfigMap.Key: install.ConfigMap.Key},
+		}
+	case api.InstallWheelFromVolume:
+		container.Volumes[installVolumeName] = minicluster.ContainerVolume{
+			ClaimName: install.Volume.ClaimName,
+			HostPath:  install.Volume.HostPath,
+			Path:      installDirName,
+			ReadOnly:  true,
+		}
+	case api.InstallInitContainer:
+		spec.Spec.Flux.Container.Image = install.Image
+	}
+}
+
+// addInstallToPodSpec adds the volume with the wheel to the pod and container
+// that runs the ensemble, or an init container that copies ensemble-python
+// from an image to a shared volume
+func addInstallToPodSpec(
+	podSpec *corev1.PodSpec,
+	container *corev1.Container,
+	member *api.Member,
+) {
+	install := getInstall(member)
+	volume := corev1.Volume{Name: installVolumeName}
+	switch install.Mode {
+	case api.InstallWheelFromConfigMap:
+		volume.VolumeSource = corev1.VolumeSource{
+			ConfigMap: &corev1.ConfigMapVolumeSource{
+				LocalObjectReference: corev1.LocalObjectReference{Name: install.ConfigMap.Name},
+				Items: []corev1.KeyToPath{
+					{Key: install.ConfigMap.Key, Path: install.ConfigMap.Key},
+				},
+			},
+		}
+	case api.InstallWheelFromVolume:
+		if install.Volume.ClaimName != "" {
+			volume.VolumeSource = corev1.VolumeSource{
+				PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{
+					ClaimName: install.Volume.ClaimName,
+					ReadOnly:  true,
+				},
+			}
+		} else {
+			volume.VolumeSource = corev1.VolumeSource{
+				HostPath: &corev1.HostPathVolumeSource{Path: install.Volume.HostPath},
+			}
+		}
+	case api.InstallInitContainer:
+		volume.VolumeSource = corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}}
+		podSpec.InitContainers = append(podSpec.InitContainers, corev1.Container{
+			Name:    installVolumeName,
+			Image:   install.Image,
+			Command: []string{"/bin/sh", "-c", fmt.Sprintf("cp -R %s/. %s", install.Path, installDirName)},
+			VolumeMounts: []corev1.VolumeMount{
+				{Name: installVolumeName, MountPath: installDirName},
+			},
+		})
+	default:
+		return
+	}
+	podSpec.Volumes = append(podSpec.Volumes, volume)
+	container.VolumeMounts = append(container.VolumeMounts, corev1.VolumeMount{
+		Name:      installVolumeName,
+		MountPath: installDirName,
+		ReadOnly:  install.Mode != api.InstallInitContainer,
+	})
+}
@@ -0,0 +1,310 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	api "github.com/converged-computing/ensemble-operator/api/v1alpha1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+var (
+	// Index 0 runs the ensemble, and other indices run the original command (if any)
+	// The original command and args are passed as arguments to the script
+	jobEntrypoint = `
+if [ "${JOB_COMPLETION_INDEX}" = "0" ]; then
+%s
+%s
+elif [ $# -gt 0 ]; then
+exec "$@"
+fi
+`
+)
+
+func init() {
+	RegisterBackend(api.JobType, func(r *EnsembleReconciler) MemberBackend {
+		return &JobBackend{r: r}
+	})
+}
+
+// JobBackend manages Indexed Job members
+type JobBackend struct {
+	r *EnsembleReconciler
+}
+
+// Ensure creates the Job if it does not exist
+func (b *JobBackend) Ensure(
+	ctx context.Context,
+	name string,
+	ensemble *api.Ensemble,
+	member *api.Member,
+) (ctrl.Result, error) {
+
+	fmt.Println("✨ Ensuring Ensemble Job")
+	_, err := b.getExistingJob(ctx, name, ensemble)
+	if err == nil {
+		fmt.Println("      Found existing Ensemble Job")
+		return ctrl.Result{}, nil
+	}
+	if !errors.IsNotFound(err) {
+		return ctrl.Result{}, err
+	}
+
+	job := b.newJob(name, ensemble, member)
+	fmt.Println("      Creating a new Ensemble Job")
+	err = b.r.Create(ctx, job)
+	if err != nil {
+		fmt.Println("      Failed to create Ensemble Job")
+		return ctrl.Result{}, err
+	}
+	return ctrl.Result{Requeue: true}, nil
+}
+
+// Get returns the existing Job
+func (b *JobBackend) Get(
+	ctx context.Context,
+	name string,
+	ensemble *api.Ensemble,
+) (client.Object, error) {
+	return b.getExistingJob(ctx, name, ensemble)
+}
+
+// Status derives the member status from the Job conditions
+func (b *JobBackend) Status(
+	ctx context.Context,
+	name string,
+	ensemble *api.Ensemble,
+	member *api.Member,
+) (api.MemberStatus, error) {
+
+	status := api.MemberStatus{
+		Name:    name,
+		Type:    api.JobType,
+		Size:    member.Size(),
+		MinSize: member.Job.MinSize,
+		MaxSize: member.Job.MaxSize,
+		Phase:   api.MemberPhasePending,
+	}
+
+	job, err := b.getExistingJob(ctx, name, ensemble)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			status.Message = "Job has not been created"
+			return status, nil
+		}
+		return status, err
+	}
+	if job.Spec.Parallelism != nil {
+		status.Size = *job.Spec.Parallelism
+	}
+
+	// The ensemble terminates by exiting index 0 of the job
+	if isJobConditionTrue(job, batchv1.JobComplete) {
+		status.Phase = api.MemberPhaseCompleted
+		status.Message = "Job has completed"
+	} else if isJobConditionTrue(job, batchv1.JobFailed) {
+		status.Phase = api.MemberPhaseFailed
+		status.Message = "Job has failed"
+	} else if hasCompletedIndex(job, 0) {
+		status.Phase = api.MemberPhaseCompleted
+		status.Message = "Job ensemble (index 0) has finished"
+	} else if job.Status.Active > 0 {
+		status.Phase = api.MemberPhaseRunning
+		status.Message = fmt.Sprintf("Job has %d active pods", job.Status.Active)
+	} else {
+		status.Message = "Job is waiting for resources"
+	}
+	return status, nil
+}
+
+// Scale changes the parallelism (and completions) of the Indexed Job,
+// which can be updated together when they are equal (elastic jobs).
+// Completions that differ (e.g., a job created without the webhook) are
+// left alone, and only the parallelism changes.
+func (b *JobBackend) Scale(
+	ctx context.Context,
+	name string,
+	ensemble *api.Ensemble,
+	member *api.Member,
+	size int32,
+) error {
+	job, err := b.getExistingJob(ctx, name, ensemble)
+	if err != nil {
+		return err
+	}
+	if size < member.Job.MinSize {
+		size = member.Job.MinSize
+	}
+	if member.Job.MaxSize > 0 && size > member.Job.MaxSize {
+		size = member.Job.MaxSize
+	}
+	if job.Spec.Parallelism != nil && *job.Spec.Parallelism == size {
+		return nil
+	}
+
+	fmt.Printf("      Scaling Job %s to %d\n", name, size)
+	patch := client.MergeFrom(job.DeepCopy())
+	if job.Spec.Completions != nil && job.Spec.Parallelism != nil && *job.Spec.Completions == *job.Spec.Parallelism {
+		completions := size
+		job.Spec.Completions = &completions
+	}
+	parallelism := size
+	job.Spec.Parallelism = &parallelism
+	return b.r.Patch(ctx, job, patch)
+}
+
+// List returns the Jobs that belong to the ensemble
+func (b *JobBackend) List(
+	ctx context.Context,
+	ensemble *api.Ensemble,
+) ([]client.Object, error) {
+	return b.r.listMemberObjects(ctx, ensemble, &batchv1.JobList{})
+}
+
+// Delete removes the Job and its pods (and is not an error if it is already gone)
+func (b *JobBackend) Delete(
+	ctx context.Context,
+	name string,
+	ensemble *api.Ensemble,
+) error {
+	job, err := b.getExistingJob(ctx, name, ensemble)
+	if err != nil {
+		return client.IgnoreNotFound(err)
+	}
+	fmt.Printf("      Deleting Job %s\n", name)
+	return client.IgnoreNotFound(
+		b.r.Delete(ctx, job, client.PropagationPolicy(metav1.DeletePropagationBackground)),
+	)
+}
+
+// Restart deletes the pod for index 0, which runs the ensemble
+func (b *JobBackend) Restart(
+	ctx context.Context,
+	name string,
+	ensemble *api.Ensemble,
+	member *api.Member,
+) error {
+	job, err := b.getExistingJob(ctx, name, ensemble)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("      Restarting Job %s index 0\n", name)
+	return b.r.deletePods(ctx, job.Namespace, map[string]string{
+		batchv1.JobNameLabel:                 job.Name,
+		batchv1.JobCompletionIndexAnnotation: "0",
+	})
+}
+
+// RoleRules lets the ensemble service request a size for its own Jobs
+// (with an annotation)
+func (b *JobBackend) RoleRules(names []string) []rbacv1.PolicyRule {
+	return []rbacv1.PolicyRule{
+		{
+			APIGroups:     []string{"batch"},
+			Resources:     []string{"jobs"},
+			ResourceNames: names,
+			Verbs:         []string{"get", "patch"},
+		},
+	}
+}
+
+// getExistingJob gets an existing Job member by its labels
+func (b *JobBackend) getExistingJob(
+	ctx context.Context,
+	name string,
+	ensemble *api.Ensemble,
+) (*batchv1.Job, error) {
+
+	existing := &batchv1.Job{}
+	err := b.r.getMemberObject(ctx, name, ensemble, existing, &batchv1.JobList{})
+	return existing, err
+}
+
+// newJob creates a new ensemble Indexed Job. The ensemble container gets the
+// ensemble.yaml, and index 0 runs the ensemble instead of the command.
+func (b *JobBackend) newJob(
+	name string,
+	ensemble *api.Ensemble,
+	member *api.Member,
+) *batchv1.Job {
+
+	job := &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: ensemble.Namespace},
+		Spec:       *member.Job.Spec.DeepCopy(),
+	}
+	setMemberLabels(job, ensemble, name)
+	mode := batchv1.IndexedCompletion
+	job.Spec.CompletionMode = &mode
+
+	// Add the config map as a volume to the ensemble container
+	volume, mount := getEnsembleVolume(name, member)
+	podSpec := &job.Spec.Template.Spec
+	podSpec.Volumes = append(podSpec.Volumes, volume)
+	container := &podSpec.Containers[member.GetEnsembleContainer()]
+	container.VolumeMounts = append(container.VolumeMounts, mount)
+	addInstallToPodSpec(podSpec, container, member)
+	addTLSToPodSpec(podSpec, container, ensemble, name)
+	addEnsembleSecretToPodSpec(podSpec, container, member)
+
+	// The original command is passed through for the other indices
+	script := fmt.Sprintf(
+		jobEntrypoint,
+		getInstallCommand(member),
+		getRunCommand(ensemble, member, api.JobType, name),
+	)
+	original := append([]string{}, container.Command...)
+	original = append(original, container.Args...)
+	container.Command = []string{"/bin/bash", "-c", script, "--"}
+	container.Args = original
+
+	// A Job requires a restart policy of Never or OnFailure
+	if podSpec.RestartPolicy == "" {
+		podSpec.RestartPolicy = corev1.RestartPolicyNever
+	}
+	ctrl.SetControllerReference(ensemble, job, b.r.Scheme)
+	return job
+}
+
+// hasCompletedIndex determines if an index of an Indexed Job has completed.
+// Completed indexes are a list of ranges, e.g., "0-3,5"
+func hasCompletedIndex(job *batchv1.Job, index int) bool {
+	if job.Status.CompletedIndexes == "" {
+		return false
+	}
+	for _, part := range strings.Split(job.Status.CompletedIndexes, ",") {
+		bounds := strings.SplitN(part, "-", 2)
+		start, err := strconv.Atoi(bounds[0])
+		if err != nil {
+			continue
+		}
+		end := start
+		if len(bounds) == 2 {
+			end, err = strconv.Atoi(bounds[1])
+			if err != nil {
+				continue
+			}
+		}
+		if index >= start && index <= end {
+			return true
+		}
+	}
+	return false
+}
+
+// isJobConditionTrue determines if a Job has a condition that is true
+func isJobConditionTrue(job *batchv1.Job, conditionType batchv1.JobConditionType) bool {
+	for _, condition := range job.Status.Conditions {
+		if condition.Type == conditionType && condition.Status == corev1.ConditionTrue {
+			return true
+		}
+	}
+	return false
+}
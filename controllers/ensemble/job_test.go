@@ -0,0 +1,76 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"testing"
+
+	batchv1 "k8s.io/api/batch/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	api "github.com/converged-computing/ensemble-operator/api/v1alpha1"
+)
+
+// TestJobScale checks completions are only changed with the parallelism
+// when the two are equal
+func TestJobScale(t *testing.T) {
+	ctx := context.Background()
+	ensemble := newReplicatedEnsemble(1)
+	member := &api.Member{Name: "sim", Job: &api.JobMember{MaxSize: 4}}
+
+	tests := []struct {
+		name        string
+		completions int32
+		expected    int32
+	}{
+		{name: "equal", completions: 2, expected: 3},
+		{name: "different", completions: 10, expected: 10},
+	}
+	for _, test := range tests {
+		b := &JobBackend{r: newApplyReconciler(t)}
+		name := "ens-sim"
+		parallelism := int32(2)
+		completions := test.completions
+		job := &batchv1.Job{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: ensemble.Namespace},
+			Spec: batchv1.JobSpec{
+				Parallelism: &parallelism,
+				Completions: &completions,
+			},
+		}
+		setMemberLabels(job, ensemble, name)
+		if err := b.r.Create(ctx, job); err != nil {
+			t.Fatal(err)
+		}
+
+		err := b.Scale(ctx, name, ensemble, member, 3)
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		job, err = b.getExistingJob(ctx, name, ensemble)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if *job.Spec.Parallelism != 3 {
+			t.Fatalf("%s: expected a parallelism of 3, got %d", test.name, *job.Spec.Parallelism)
+		}
+		if *job.Spec.Completions != test.expected {
+			t.Fatalf("%s: expected %d completions, got %d", test.name, test.expected, *job.Spec.Completions)
+		}
+	}
+}
@@ -0,0 +1,363 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+
+	api "github.com/converged-computing/ensemble-operator/api/v1alpha1"
+	batchv1 "k8s.io/api/batch/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	jobset "sigs.k8s.io/jobset/api/jobset/v1alpha2"
+)
+
+var (
+	// Set on a JobSet that was suspended for the ensemble, so it's resumed
+	suspendedAnnotation = "ensemble.flux-framework.org/suspended"
+)
+
+func init() {
+	RegisterBackend(api.JobSetType, func(r *EnsembleReconciler) MemberBackend {
+		return &JobSetBackend{r: r}
+	})
+}
+
+// JobSetBackend manages JobSet members
+type JobSetBackend struct {
+	r *EnsembleReconciler
+}
+
+// Ensure creates the JobSet if it does not exist
+func (b *JobSetBackend) Ensure(
+	ctx context.Context,
+	name string,
+	ensemble *api.Ensemble,
+	member *api.Member,
+) (ctrl.Result, error) {
+
+	fmt.Println("✨ Ensuring Ensemble JobSet")
+	existing, err := b.getExistingJobSet(ctx, name, ensemble)
+	if err == nil {
+
+		// A JobSet being deleted (to scale) still has its jobs, so they
+		// are adopted by the new JobSet when it's gone
+		if existing.DeletionTimestamp != nil {
+			fmt.Println("      Waiting for Ensemble JobSet to be deleted")
+			return ctrl.Result{RequeueAfter: recreateInterval}, nil
+		}
+		fmt.Println("      Found existing Ensemble JobSet")
+		return ctrl.Result{}, b.adoptJobs(ctx, existing, member)
+	}
+	if !errors.IsNotFound(err) {
+		return ctrl.Result{}, err
+	}
+
+	// If the JobSet was recreated to scale, the size is saved on the config map
+	size, err := b.r.getMemberSize(ctx, name, ensemble)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+
+	js := b.newJobSet(name, ensemble, member, size)
+	fmt.Println("      Creating a new Ensemble JobSet")
+	err = b.r.Create(ctx, js)
+	if err != nil {
+		fmt.Println("      Failed to create Ensemble JobSet")
+		return ctrl.Result{}, err
+	}
+	return ctrl.Result{Requeue: true}, b.adoptJobs(ctx, js, member)
+}
+
+// Get returns the existing JobSet
+func (b *JobSetBackend) Get(
+	ctx context.Context,
+	name string,
+	ensemble *api.Ensemble,
+) (client.Object, error) {
+	return b.getExistingJobSet(ctx, name, ensemble)
+}
+
+// Status derives the member status from the JobSet conditions
+func (b *JobSetBackend) Status(
+	ctx context.Context,
+	name string,
+	ensemble *api.Ensemble,
+	member *api.Member,
+) (api.MemberStatus, error) {
+
+	status := api.MemberStatus{
+		Name:    name,
+		Type:    api.JobSetType,
+		Size:    member.Size(),
+		MinSize: member.JobSet.MinSize,
+		MaxSize: member.JobSet.MaxSize,
+		Phase:   api.MemberPhasePending,
+	}
+
+	js, err := b.getExistingJobSet(ctx, name, ensemble)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			status.Message = "JobSet has not been created"
+			return status, nil
+		}
+		return status, err
+	}
+	job := getReplicatedJob(js, member.JobSet.ScaleJob)
+	if job != nil {
+		status.Size = job.Replicas
+	}
+
+	conditions := js.Status.Conditions
+	if meta.IsStatusConditionTrue(conditions, string(jobset.JobSetCompleted)) {
+		status.Phase = api.MemberPhaseCompleted
+		status.Message = "JobSet has completed"
+	} else if meta.IsStatusConditionTrue(conditions, string(jobset.JobSetFailed)) {
+		status.Phase = api.MemberPhaseFailed
+		status.Message = "JobSet has failed"
+	} else {
+		for _, jobStatus := range js.Status.ReplicatedJobsStatus {
+			if jobStatus.Active > 0 || jobStatus.Ready > 0 {
+				status.Phase = api.MemberPhaseRunning
+				status.Message = "JobSet is running"
+				break
+			}
+		}
+	}
+	return status, nil
+}
+
+// Scale changes the replicas of the scale job. Replicated jobs of a JobSet
+// cannot be updated, so we save the new size and delete the JobSet (orphaning
+// its jobs), and it is recreated with the new replicas when the deletion is
+// done. The jobs of the ensemble job are adopted by the new JobSet so the
+// ensemble keeps running, and the jobs of the scale job are recreated.
+func (b *JobSetBackend) Scale(
+	ctx context.Context,
+	name string,
+	ensemble *api.Ensemble,
+	member *api.Member,
+	size int32,
+) error {
+	js, err := b.getExistingJobSet(ctx, name, ensemble)
+	if err != nil {
+		return err
+	}
+	if size < member.JobSet.MinSize {
+		size = member.JobSet.MinSize
+	}
+	if member.JobSet.MaxSize > 0 && size > member.JobSet.MaxSize {
+		size = member.JobSet.MaxSize
+	}
+	job := getReplicatedJob(js, member.JobSet.ScaleJob)
+	if job == nil {
+		return fmt.Errorf("jobset %s does not have scale job %s", name, member.JobSet.ScaleJob)
+	}
+	if job.Replicas == size {
+		return nil
+	}
+
+	fmt.Printf("      Scaling JobSet %s job %s from %d to %d\n", name, job.Name, job.Replicas, size)
+	err = b.r.setMemberSize(ctx, name, ensemble, size)
+	if err != nil {
+		return err
+	}
+	return client.IgnoreNotFound(
+		b.r.Delete(ctx, js, client.PropagationPolicy(metav1.DeletePropagationOrphan)),
+	)
+}
+
+// Suspend sets spec.suspend of the JobSet, which suspends its jobs. Replicated
+// jobs can't be scaled in place (see Scale), so it is used instead for a
+// suspend. A JobSet that was already suspended (e.g., by a queue) is left as is.
+func (b *JobSetBackend) Suspend(
+	ctx context.Context,
+	name string,
+	ensemble *api.Ensemble,
+	suspend bool,
+) error {
+	js, err := b.getExistingJobSet(ctx, name, ensemble)
+	if err != nil {
+		return client.IgnoreNotFound(err)
+	}
+	_, suspended := js.Annotations[suspendedAnnotation]
+	isSuspended := js.Spec.Suspend != nil && *js.Spec.Suspend
+	if suspend == suspended || (suspend && isSuspended) {
+		return nil
+	}
+
+	patch := client.MergeFrom(js.DeepCopy())
+	if suspend {
+		fmt.Printf("      Suspending JobSet %s\n", name)
+		if js.Annotations == nil {
+			js.Annotations = map[string]string{}
+		}
+		js.Annotations[suspendedAnnotation] = "true"
+	} else {
+		fmt.Printf("      Resuming JobSet %s\n", name)
+		delete(js.Annotations, suspendedAnnotation)
+	}
+	js.Spec.Suspend = &suspend
+	return b.r.Patch(ctx, js, patch)
+}
+
+// adoptJobs finds jobs orphaned by a scale. Jobs of the scale job are deleted
+// (the JobSet creates them with the new replicas), and the others are given
+// back to the JobSet, which does not recreate jobs it already owns.
+func (b *JobSetBackend) adoptJobs(
+	ctx context.Context,
+	js *jobset.JobSet,
+	member *api.Member,
+) error {
+	jobs := &batchv1.JobList{}
+	err := b.r.List(
+		ctx, jobs,
+		client.InNamespace(js.Namespace),
+		client.MatchingLabels{jobset.JobSetNameKey: js.Name},
+	)
+	if err != nil {
+		return err
+	}
+	for i := range jobs.Items {
+		job := &jobs.Items[i]
+		if metav1.GetControllerOf(job) != nil || job.DeletionTimestamp != nil {
+			continue
+		}
+		if job.Labels[jobset.ReplicatedJobNameKey] == member.JobSet.ScaleJob {
+			fmt.Printf("      Deleting JobSet %s job %s to scale\n", js.Name, job.Name)
+			err = b.r.Delete(ctx, job, client.PropagationPolicy(metav1.DeletePropagationBackground))
+		} else {
+			fmt.Printf("      Adopting JobSet %s job %s\n", js.Name, job.Name)
+			err = ctrl.SetControllerReference(js, job, b.r.Scheme)
+			if err == nil {
+				err = b.r.Update(ctx, job)
+			}
+		}
+		if client.IgnoreNotFound(err) != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// List returns the JobSets that belong to the ensemble
+func (b *JobSetBackend) List(
+	ctx context.Context,
+	ensemble *api.Ensemble,
+) ([]client.Object, error) {
+	return b.r.listMemberObjects(ctx, ensemble, &jobset.JobSetList{})
+}
+
+// Delete removes the JobSet (and is not an error if it is already gone)
+func (b *JobSetBackend) Delete(
+	ctx context.Context,
+	name string,
+	ensemble *api.Ensemble,
+) error {
+	js, err := b.getExistingJobSet(ctx, name, ensemble)
+	if err != nil {
+		return client.IgnoreNotFound(err)
+	}
+	fmt.Printf("      Deleting JobSet %s\n", name)
+	return client.IgnoreNotFound(
+		b.r.Delete(ctx, js, client.PropagationPolicy(metav1.DeletePropagationForeground)),
+	)
+}
+
+// Restart deletes the pods of the ensemble replicated job, which run the ensemble
+func (b *JobSetBackend) Restart(
+	ctx context.Context,
+	name string,
+	ensemble *api.Ensemble,
+	member *api.Member,
+) error {
+	js, err := b.getExistingJobSet(ctx, name, ensemble)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("      Restarting JobSet %s job %s\n", name, member.JobSet.EnsembleJob)
+	return b.r.deletePods(ctx, js.Namespace, map[string]string{
+		jobset.JobSetNameKey:        js.Name,
+		jobset.ReplicatedJobNameKey: member.JobSet.EnsembleJob,
+	})
+}
+
+// RoleRules lets the ensemble service request a size for its own JobSets
+// (with an annotation)
+func (b *JobSetBackend) RoleRules(names []string) []rbacv1.PolicyRule {
+	return []rbacv1.PolicyRule{
+		{
+			APIGroups:     []string{"jobset.x-k8s.io"},
+			Resources:     []string{"jobsets"},
+			ResourceNames: names,
+			Verbs:         []string{"get", "patch"},
+		},
+	}
+}
+
+// getExistingJobSet gets an existing JobSet member by its labels
+func (b *JobSetBackend) getExistingJobSet(
+	ctx context.Context,
+	name string,
+	ensemble *api.Ensemble,
+) (*jobset.JobSet, error) {
+
+	existing := &jobset.JobSet{}
+	err := b.r.getMemberObject(ctx, name, ensemble, existing, &jobset.JobSetList{})
+	return existing, err
+}
+
+// newJobSet creates a new ensemble JobSet. The ensemble job gets the
+// ensemble.yaml and runs the ensemble, and the scale job starts at the
+// size provided (if it was saved from a previous scale)
+func (b *JobSetBackend) newJobSet(
+	name string,
+	ensemble *api.Ensemble,
+	member *api.Member,
+	size int32,
+) *jobset.JobSet {
+
+	js := &jobset.JobSet{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: ensemble.Namespace},
+		Spec:       *member.JobSet.Spec.DeepCopy(),
+	}
+	setMemberLabels(js, ensemble, name)
+
+	volume, mount := getEnsembleVolume(name, member)
+	for i := range js.Spec.ReplicatedJobs {
+		job := &js.Spec.ReplicatedJobs[i]
+		if job.Name == member.JobSet.ScaleJob && size > 0 {
+			job.Replicas = size
+		}
+		if job.Name != member.JobSet.EnsembleJob {
+			continue
+		}
+
+		// Add the config map as a volume to the ensemble container, and run the ensemble
+		podSpec := &job.Template.Spec.Template.Spec
+		podSpec.Volumes = append(podSpec.Volumes, volume)
+		container := &podSpec.Containers[member.GetEnsembleContainer()]
+		container.VolumeMounts = append(container.VolumeMounts, mount)
+		addInstallToPodSpec(podSpec, container, member)
+		addTLSToPodSpec(podSpec, container, ensemble, name)
+		addEnsembleSecretToPodSpec(podSpec, container, member)
+		command := getInstallCommand(member) + getRunCommand(ensemble, member, api.JobSetType, name)
+		container.Command = []string{"/bin/bash", "-c", command}
+		container.Args = nil
+	}
+	ctrl.SetControllerReference(ensemble, js, b.r.Scheme)
+	return js
+}
+
+// getReplicatedJob returns a replicated job of a JobSet by name, or nil
+func getReplicatedJob(js *jobset.JobSet, name string) *jobset.ReplicatedJob {
+	for i := range js.Spec.ReplicatedJobs {
+		if js.Spec.ReplicatedJobs[i].Name == name {
+			return &js.Spec.ReplicatedJobs[i]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,291 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"testing"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	jobset "sigs.k8s.io/jobset/api/jobset/v1alpha2"
+
+	api "github.com/converged-computing/ensemble-operator/api/v1alpha1"
+)
+
+// newJobSetMember returns a JobSet member with an ensemble job and a scale job
+func newJobSetMember() *api.Member {
+	job := func(name string, replicas int32) jobset.ReplicatedJob {
+		return jobset.ReplicatedJob{
+			Name:     name,
+			Replicas: replicas,
+			Template: batchv1.JobTemplateSpec{
+				Spec: batchv1.JobSpec{
+					Template: corev1.PodTemplateSpec{
+						Spec: corev1.PodSpec{
+							Containers: []corev1.Container{{Name: name, Image: "busybox"}},
+						},
+					},
+				},
+			},
+		}
+	}
+	return &api.Member{
+		Name:     "sim",
+		Ensemble: testEnsembleFromYaml,
+		JobSet: &api.JobSetMember{
+			Spec: jobset.JobSetSpec{
+				ReplicatedJobs: []jobset.ReplicatedJob{job("ensemble", 1), job("workers", 2)},
+			},
+			EnsembleJob: "ensemble",
+			ScaleJob:    "workers",
+			MaxSize:     4,
+		},
+	}
+}
+
+// newJobSetBackend returns a JobSet backend with a fake client, and the
+// config map of the member (where the size is saved to scale)
+func newJobSetBackend(t *testing.T, ensemble *api.Ensemble, name string) *JobSetBackend {
+	t.Helper()
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	if err := api.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	if err := jobset.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	cm := &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: ensemble.Namespace}}
+	setMemberLabels(cm, ensemble, name)
+	c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(cm).Build()
+	return &JobSetBackend{r: &EnsembleReconciler{Client: c, Scheme: scheme}}
+}
+
+// newOrphanedJob returns a job of a replicated job that a scale orphaned
+func newOrphanedJob(js *jobset.JobSet, replicatedJob string) *batchv1.Job {
+	return &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      js.Name + "-" + replicatedJob + "-0",
+			Namespace: js.Namespace,
+			Labels: map[string]string{
+				jobset.JobSetNameKey:        js.Name,
+				jobset.ReplicatedJobNameKey: replicatedJob,
+			},
+		},
+	}
+}
+
+// TestJobSetScale checks a scale saves the size and deletes the JobSet, and
+// the JobSet is recreated with the new replicas and adopts the ensemble job
+func TestJobSetScale(t *testing.T) {
+	ctx := context.Background()
+	ensemble := &api.Ensemble{ObjectMeta: metav1.ObjectMeta{Name: "ens", Namespace: "default", UID: "ens-uid"}}
+	ensemble.Default()
+	member := newJobSetMember()
+	name := "ens-sim"
+	b := newJobSetBackend(t, ensemble, name)
+
+	_, err := b.Ensure(ctx, name, ensemble, member)
+	if err != nil {
+		t.Fatal(err)
+	}
+	js, err := b.getExistingJobSet(ctx, name, ensemble)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if replicas := getReplicatedJob(js, "workers").Replicas; replicas != 2 {
+		t.Fatalf("expected 2 replicas of the scale job, got %d", replicas)
+	}
+
+	// The size is clamped to the maximum and saved, and the JobSet is deleted
+	err = b.Scale(ctx, name, ensemble, member, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	size, err := b.r.getMemberSize(ctx, name, ensemble)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != 4 {
+		t.Fatalf("expected a saved size of 4, got %d", size)
+	}
+	_, err = b.getExistingJobSet(ctx, name, ensemble)
+	if !errors.IsNotFound(err) {
+		t.Fatalf("expected the JobSet to be deleted, got %v", err)
+	}
+
+	// The jobs were orphaned, and the JobSet is recreated with the new size
+	ensembleJob := newOrphanedJob(js, "ensemble")
+	workerJob := newOrphanedJob(js, "workers")
+	for _, job := range []*batchv1.Job{ensembleJob, workerJob} {
+		if err := b.r.Create(ctx, job); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err = b.Ensure(ctx, name, ensemble, member)
+	if err != nil {
+		t.Fatal(err)
+	}
+	js, err = b.getExistingJobSet(ctx, name, ensemble)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if replicas := getReplicatedJob(js, "workers").Replicas; replicas != 4 {
+		t.Fatalf("expected 4 replicas of the scale job, got %d", replicas)
+	}
+
+	// The ensemble job is adopted so it keeps running, and the scale job is
+	// deleted so the JobSet creates it with the new replicas
+	err = b.r.Get(ctx, client.ObjectKeyFromObject(ensembleJob), ensembleJob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !metav1.IsControlledBy(ensembleJob, js) {
+		t.Fatalf("expected the ensemble job to be adopted, got owners %v", ensembleJob.OwnerReferences)
+	}
+	err = b.r.Get(ctx, client.ObjectKeyFromObject(workerJob), workerJob)
+	if !errors.IsNotFound(err) {
+		t.Fatalf("expected the scale job to be deleted, got %v", err)
+	}
+
+	// Scaling to the same size does not delete the JobSet
+	err = b.Scale(ctx, name, ensemble, member, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = b.getExistingJobSet(ctx, name, ensemble); err != nil {
+		t.Fatalf("expected the JobSet to be kept, got %v", err)
+	}
+}
+
+// TestJobSetEnsureDeleting checks jobs are not adopted by a JobSet that is
+// being deleted, and the member waits for it to be gone
+func TestJobSetEnsureDeleting(t *testing.T) {
+	ctx := context.Background()
+	ensemble := &api.Ensemble{ObjectMeta: metav1.ObjectMeta{Name: "ens", Namespace: "default", UID: "ens-uid"}}
+	ensemble.Default()
+	member := newJobSetMember()
+	name := "ens-sim"
+	b := newJobSetBackend(t, ensemble, name)
+
+	// A finalizer keeps the JobSet while it is deleted
+	js := b.newJobSet(name, ensemble, member, 0)
+	js.Finalizers = []string{"example.com/wait"}
+	if err := b.r.Create(ctx, js); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.r.Delete(ctx, js); err != nil {
+		t.Fatal(err)
+	}
+	job := newOrphanedJob(js, "ensemble")
+	if err := b.r.Create(ctx, job); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := b.Ensure(ctx, name, ensemble, member)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.RequeueAfter == 0 {
+		t.Fatal("expected to requeue while the JobSet is deleted")
+	}
+	err = b.r.Get(ctx, client.ObjectKeyFromObject(job), job)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if metav1.GetControllerOf(job) != nil {
+		t.Fatalf("expected the job not to be adopted, got owners %v", job.OwnerReferences)
+	}
+}
+
+// TestJobSetSuspend checks a JobSet is suspended in place (and not scaled,
+// which would recreate it), and only resumed if the ensemble suspended it
+func TestJobSetSuspend(t *testing.T) {
+	ctx := context.Background()
+	ensemble := &api.Ensemble{ObjectMeta: metav1.ObjectMeta{Name: "ens", Namespace: "default", UID: "ens-uid"}}
+	ensemble.Default()
+	member := newJobSetMember()
+	name := "ens-sim"
+
+	for _, suspended := range []bool{false, true} {
+		b := newJobSetBackend(t, ensemble, name)
+		js := b.newJobSet(name, ensemble, member, 0)
+		js.Spec.Suspend = &suspended
+		if err := b.r.Create(ctx, js); err != nil {
+			t.Fatal(err)
+		}
+
+		status, err := b.r.suspendMember(ctx, name, ensemble, member, b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status.Phase != api.MemberPhaseSuspended {
+			t.Fatalf("expected a suspended member, got %s", status.Phase)
+		}
+		js, err = b.getExistingJobSet(ctx, name, ensemble)
+		if err != nil {
+			t.Fatalf("expected the JobSet to be kept, got %v", err)
+		}
+		if js.Spec.Suspend == nil || !*js.Spec.Suspend {
+			t.Fatal("expected the JobSet to be suspended")
+		}
+		if replicas := getReplicatedJob(js, "workers").Replicas; replicas != 2 {
+			t.Fatalf("expected 2 replicas of the scale job, got %d", replicas)
+		}
+
+		// A JobSet that was suspended before the ensemble stays suspended
+		_, err = b.r.resumeMember(ctx, name, ensemble, member, b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		js, err = b.getExistingJobSet(ctx, name, ensemble)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if *js.Spec.Suspend != suspended {
+			t.Fatalf("expected suspend to be %t after resume, got %t", suspended, *js.Spec.Suspend)
+		}
+		if _, ok := js.Annotations[suspendedAnnotation]; ok {
+			t.Fatal("expected the suspended annotation to be removed")
+		}
+	}
+}
+
+// TestResumeMemberWithoutConfig checks a member without a config map yet is
+// not an error to resume, and it is checked again
+func TestResumeMemberWithoutConfig(t *testing.T) {
+	ensemble := &api.Ensemble{ObjectMeta: metav1.ObjectMeta{Name: "ens", Namespace: "default", UID: "ens-uid"}}
+	ensemble.Default()
+	b := newJobSetBackend(t, ensemble, "ens-other")
+
+	result, err := b.r.resumeMember(context.Background(), "ens-sim", ensemble, newJobSetMember(), b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.RequeueAfter == 0 {
+		t.Fatal("expected to requeue without a config map")
+	}
+}
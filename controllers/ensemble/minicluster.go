@@ -2,35 +2,162 @@ package controller
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"path/filepath"
+	"reflect"
+	"strings"
+	"time"
 
 	api "github.com/converged-computing/ensemble-operator/api/v1alpha1"
 	minicluster "github.com/flux-framework/flux-operator/api/v1alpha2"
+	jobctrl "github.com/flux-framework/flux-operator/pkg/job"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 
 	"k8s.io/apimachinery/pkg/api/errors"
-	"k8s.io/apimachinery/pkg/types"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 )
 
 var (
-	// Assume the user chose the wrong view, and install python3 cffi
-	preCommand = `
-apt-get update && apt-get install -y python3-cffi || yum update && yum install -y python3-cffi
-python3 -m pip install ensemble-python || echo "please install ensemble-python"
-`
-
-	// Custom install from a branch
-	branchPreCommand = `
-apt-get update && apt-get install -y python3-cffi git || yum update && yum install -y python3-cffi git
-git clone -b %s --depth 1 https://github.com/converged-computing/ensemble-python.git /tmp/ensemble-python
-cd /tmp/ensemble-python
-python3 -m pip install . || echo "please install ensemble-python"
-cd -
-`
+	// The MiniCluster records a hash of the spec it was created with
+	specHashAnnotation = "ensemble.flux-framework.org/spec-hash"
+
+	// A change that cannot be updated (and is not recreated) is recorded,
+	// so we only warn about it once
+	ignoredChangeAnnotation = "ensemble.flux-framework.org/ignored-change"
+
+	// How often to check on a MiniCluster that is being recreated
+	recreateInterval = 5 * time.Second
 )
 
+func init() {
+	RegisterBackend(api.MiniclusterType, func(r *EnsembleReconciler) MemberBackend {
+		return &MiniClusterBackend{r: r}
+	})
+}
+
+// MiniClusterBackend manages Flux Operator MiniCluster members
+type MiniClusterBackend struct {
+	r *EnsembleReconciler
+}
+
+// Ensure creates the MiniCluster if it does not exist
+func (b *MiniClusterBackend) Ensure(
+	ctx context.Context,
+	name string,
+	ensemble *api.Ensemble,
+	member *api.Member,
+) (ctrl.Result, error) {
+	return b.r.ensureMiniClusterEnsemble(ctx, name, ensemble, member)
+}
+
+// Get returns the existing MiniCluster
+func (b *MiniClusterBackend) Get(
+	ctx context.Context,
+	name string,
+	ensemble *api.Ensemble,
+) (client.Object, error) {
+	return b.r.getExistingMiniCluster(ctx, name, ensemble)
+}
+
+// Status derives the member status from the MiniCluster
+func (b *MiniClusterBackend) Status(
+	ctx context.Context,
+	name string,
+	ensemble *api.Ensemble,
+	member *api.Member,
+) (api.MemberStatus, error) {
+	return b.r.getMiniClusterStatus(ctx, name, ensemble, member)
+}
+
+// Scale patches the MiniCluster size, within the min and max size
+func (b *MiniClusterBackend) Scale(
+	ctx context.Context,
+	name string,
+	ensemble *api.Ensemble,
+	member *api.Member,
+	size int32,
+) error {
+	mc, err := b.r.getExistingMiniCluster(ctx, name, ensemble)
+	if err != nil {
+		return err
+	}
+	if size < mc.Spec.MinSize {
+		size = mc.Spec.MinSize
+	}
+	if mc.Spec.MaxSize > 0 && size > mc.Spec.MaxSize {
+		size = mc.Spec.MaxSize
+	}
+	if size == mc.Spec.Size {
+		return nil
+	}
+	fmt.Printf("      Scaling MiniCluster %s from %d to %d\n", name, mc.Spec.Size, size)
+	patch := client.MergeFrom(mc.DeepCopy())
+	mc.Spec.Size = size
+	return b.r.Patch(ctx, mc, patch)
+}
+
+// List returns the MiniClusters that belong to the ensemble
+func (b *MiniClusterBackend) List(
+	ctx context.Context,
+	ensemble *api.Ensemble,
+) ([]client.Object, error) {
+	return b.r.listMemberObjects(ctx, ensemble, &minicluster.MiniClusterList{})
+}
+
+// Delete removes the MiniCluster (and is not an error if it is already gone)
+func (b *MiniClusterBackend) Delete(
+	ctx context.Context,
+	name string,
+	ensemble *api.Ensemble,
+) error {
+	mc, err := b.r.getExistingMiniCluster(ctx, name, ensemble)
+	if err != nil {
+		return client.IgnoreNotFound(err)
+	}
+	fmt.Printf("      Deleting MiniCluster %s\n", name)
+	return client.IgnoreNotFound(b.r.Delete(ctx, mc))
+}
+
+// Restart deletes the lead broker pod (index 0), which runs the ensemble
+func (b *MiniClusterBackend) Restart(
+	ctx context.Context,
+	name string,
+	ensemble *api.Ensemble,
+	member *api.Member,
+) error {
+	mc, err := b.r.getExistingMiniCluster(ctx, name, ensemble)
+	if err != nil {
+		return err
+	}
+	job, err := b.r.getLeadBrokerJob(ctx, mc)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("      Restarting MiniCluster %s lead broker\n", name)
+	return b.r.deletePods(ctx, job.Namespace, map[string]string{
+		batchv1.JobNameLabel:                 job.Name,
+		batchv1.JobCompletionIndexAnnotation: "0",
+	})
+}
+
+// RoleRules lets the ensemble service grow and shrink its own MiniClusters
+func (b *MiniClusterBackend) RoleRules(names []string) []rbacv1.PolicyRule {
+	return []rbacv1.PolicyRule{
+		{
+			APIGroups:     []string{"flux-framework.org"},
+			Resources:     []string{"miniclusters"},
+			ResourceNames: names,
+			Verbs:         []string{"get", "patch"},
+		},
+	}
+}
+
 // ensureMiniClusterEnsemble ensures that the ensemle is created!
 func (r *EnsembleReconciler) ensureMiniClusterEnsemble(
 	ctx context.Context,
@@ -39,45 +166,170 @@ func (r *EnsembleReconciler) ensureMiniClusterEnsemble(
 	member *api.Member,
 ) (ctrl.Result, error) {
 
-	// This is the Minicluster that we found
-	spec := &member.MiniCluster
+	// This is the Minicluster that we found (copied so we don't edit the spec)
+	spec := member.MiniCluster.DeepCopy()
 	fmt.Println("✨ Ensuring Ensemble MiniCluster")
 
 	// Look for an existing minicluster
-	_, err := r.getExistingMiniCluster(ctx, name, ensemble)
+	existing, err := r.getExistingMiniCluster(ctx, name, ensemble)
 
 	// Create a new job if it does not exist
 	if err != nil {
 		if errors.IsNotFound(err) {
 
-			// We first need the address of the grpc service
-			// if this fails, we try again - it might not be ready
-			ipAddress, err := r.getServiceAddress(ctx, ensemble)
-			if err != nil {
-				return ctrl.Result{Requeue: true}, err
-			}
-
-			// The address si given to the minicluster start command
-			// The MiniCluster queue communicates to it for grow/shrink requests
-			mc := r.newMiniCluster(name, ensemble, member, spec, ipAddress)
+			// The address of the grpc service is read from the config map by the
+			// start command. The MiniCluster queue communicates to it for grow/shrink requests
+			mc := r.newMiniCluster(name, ensemble, member, spec)
 			fmt.Println("      Creating a new Ensemble MiniCluster")
 			err = r.Create(ctx, mc)
 			if err != nil {
 				fmt.Println("      Failed to create Ensemble MiniCluster")
 				return ctrl.Result{}, err
 			}
-			return ctrl.Result{Requeue: true}, nil
+			return ctrl.Result{}, nil
 		}
 		// This means an error that isn't covered
 		return ctrl.Result{}, err
+	}
+	fmt.Println("      Found existing Ensemble MiniCluster")
+
+	// The existing MiniCluster gets changes to the member spec. We watch
+	// MiniClusters, so we hear when its status changes.
+	return r.updateMiniCluster(ctx, name, ensemble, member, existing)
+}
+
+// updateMiniCluster applies changes to the member spec to an existing
+// MiniCluster. The Flux Operator can update the sizes, and we patch them
+// and clamp the size to the new bounds. Other fields (e.g., the image or
+// resources of the job pods) and a larger maxSize (the brokers are set when
+// created) cannot be updated, and need the MiniCluster to be recreated.
+func (r *EnsembleReconciler) updateMiniCluster(
+	ctx context.Context,
+	name string,
+	ensemble *api.Ensemble,
+	member *api.Member,
+	mc *minicluster.MiniCluster,
+) (ctrl.Result, error) {
+
+	// A MiniCluster being deleted (to recreate it) is created when it's gone
+	if mc.DeletionTimestamp != nil {
+		fmt.Println("      Waiting for Ensemble MiniCluster to be deleted")
+		return ctrl.Result{RequeueAfter: recreateInterval}, nil
+	}
+
+	spec := member.MiniCluster.Spec
+	hash, err := getMiniClusterHash(ensemble, member)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	current, hasHash := mc.Annotations[specHashAnnotation]
+	larger := spec.MaxSize > mc.Spec.MaxSize
+	original := mc.DeepCopy()
+	change := ""
+	if (hasHash && current != hash) || larger {
+		if member.RecreatePolicy == api.RecreateRecreate {
+			fmt.Printf("      Recreating MiniCluster %s for a change that cannot be updated\n", name)
+			if r.Recorder != nil {
+				r.Recorder.Eventf(
+					ensemble, corev1.EventTypeNormal, "RecreatingMember",
+					"Deleting MiniCluster %s to recreate it with a spec that cannot be updated", name,
+				)
+			}
+			err = client.IgnoreNotFound(r.Delete(ctx, mc))
+			return ctrl.Result{RequeueAfter: recreateInterval}, err
+		}
+		change = fmt.Sprintf("%s-%d", hash, spec.MaxSize)
+		if r.Recorder != nil && mc.Annotations[ignoredChangeAnnotation] != change {
+			r.Recorder.Eventf(
+				ensemble, corev1.EventTypeWarning, "ImmutableChange",
+				"MiniCluster %s spec changed in a way that cannot be updated, set recreatePolicy to Recreate to apply it", name,
+			)
+		}
+	}
+
+	// Apply the bounds (a larger maxSize can't be), and clamp the size to them
+	mc.Spec.MinSize = spec.MinSize
+	if !larger {
+		mc.Spec.MaxSize = spec.MaxSize
+	}
+	if mc.Spec.Size < mc.Spec.MinSize {
+		mc.Spec.Size = mc.Spec.MinSize
+	}
+	if mc.Spec.MaxSize > 0 && mc.Spec.Size > mc.Spec.MaxSize {
+		mc.Spec.Size = mc.Spec.MaxSize
+	}
+
+	// A MiniCluster from an older operator is assumed to have the spec
+	if mc.Annotations == nil {
+		mc.Annotations = map[string]string{}
+	}
+	if !hasHash {
+		mc.Annotations[specHashAnnotation] = hash
+	}
+	if change == "" {
+		delete(mc.Annotations, ignoredChangeAnnotation)
 	} else {
-		fmt.Println("      Found existing Ensemble MiniCluster")
+		mc.Annotations[ignoredChangeAnnotation] = change
+	}
+	if reflect.DeepEqual(original.Spec, mc.Spec) && reflect.DeepEqual(original.Annotations, mc.Annotations) {
+		return ctrl.Result{}, nil
+	}
+	fmt.Printf(
+		"      Updating MiniCluster %s to size %d (min %d, max %d)\n",
+		name, mc.Spec.Size, mc.Spec.MinSize, mc.Spec.MaxSize,
+	)
+	return ctrl.Result{}, r.Patch(ctx, mc, client.MergeFrom(original))
+}
+
+// getMiniClusterHash returns a hash of the member MiniCluster spec, without
+// the sizes (which can be updated), and of the fields of the member and
+// ensemble that change the container running the ensemble (the install, tls,
+// ensemble container and ensembleFrom). A change means the MiniCluster needs
+// to be recreated to have it. The fields are only added when set (and the
+// install when it isn't the default), so the hash of a member without them
+// is the same as before they were added.
+func getMiniClusterHash(ensemble *api.Ensemble, member *api.Member) (string, error) {
+	spec := member.MiniCluster.Spec.DeepCopy()
+	spec.Size = 0
+	spec.MinSize = 0
+	spec.MaxSize = 0
+	content, err := json.Marshal(spec)
+	if err != nil {
+		return "", err
+	}
+	install := member.Install
+	if isDefaultInstall(member) {
+		install = nil
+	}
+	fields, err := json.Marshal(struct {
+		Install           *api.Install        `json:"install,omitempty"`
+		TLS               bool                `json:"tls,omitempty"`
+		EnsembleContainer string              `json:"ensembleContainer,omitempty"`
+		EnsembleFrom      *api.EnsembleSource `json:"ensembleFrom,omitempty"`
+	}{install, ensemble.TLSEnabled(), member.EnsembleContainer, member.EnsembleFrom})
+	if err != nil {
+		return "", err
+	}
+	if string(fields) != "{}" {
+		content = append(content, fields...)
+	}
+	return getConfigHash(string(content)), nil
+}
+
+// isDefaultInstall determines if the install of a member is the one the
+// webhook defaults to (pip, or the branch of the member)
+func isDefaultInstall(member *api.Member) bool {
+	if member.Install == nil {
+		return true
+	}
+	expected := api.Install{Mode: api.InstallPip}
+	if member.Branch != "" {
+		expected = api.Install{Mode: api.InstallBranch, Branch: member.Branch}
 	}
-	// We need to requeue since we check the status with reconcile
-	return ctrl.Result{Requeue: true}, err
+	return reflect.DeepEqual(*member.Install, expected)
 }
 
-// getExistingPod gets an existing pod service
+// getExistingMiniCluster gets an existing MiniCluster member by its labels
 func (r *EnsembleReconciler) getExistingMiniCluster(
 	ctx context.Context,
 	name string,
@@ -85,67 +337,166 @@ func (r *EnsembleReconciler) getExistingMiniCluster(
 ) (*minicluster.MiniCluster, error) {
 
 	existing := &minicluster.MiniCluster{}
-	err := r.Get(
-		ctx,
-		types.NamespacedName{
-			Name:      name,
-			Namespace: ensemble.Namespace,
-		},
-		existing,
-	)
+	err := r.getMemberObject(ctx, name, ensemble, existing, &minicluster.MiniClusterList{})
 	return existing, err
 }
 
+// getMiniClusterStatus derives the member status from the MiniCluster
+// conditions, falling back to the member spec if it does not exist yet.
+func (r *EnsembleReconciler) getMiniClusterStatus(
+	ctx context.Context,
+	name string,
+	ensemble *api.Ensemble,
+	member *api.Member,
+) (api.MemberStatus, error) {
+
+	status := api.MemberStatus{
+		Name:    name,
+		Type:    api.MiniclusterType,
+		Size:    member.MiniCluster.Spec.Size,
+		MinSize: member.MiniCluster.Spec.MinSize,
+		MaxSize: member.MiniCluster.Spec.MaxSize,
+		Phase:   api.MemberPhasePending,
+	}
+
+	mc, err := r.getExistingMiniCluster(ctx, name, ensemble)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			status.Message = "MiniCluster has not been created"
+			return status, nil
+		}
+		return status, err
+	}
+
+	// The live spec is the source of truth once created (it can grow / shrink)
+	status.Size = mc.Spec.Size
+	status.MinSize = mc.Spec.MinSize
+	status.MaxSize = mc.Spec.MaxSize
+
+	// The ensemble terminates by exiting the lead broker (index 0) of the job
+	job, err := r.getLeadBrokerJob(ctx, mc)
+	if err != nil && !errors.IsNotFound(err) {
+		return status, err
+	}
+	conditions := mc.Status.Conditions
+	if err == nil && isJobConditionTrue(job, batchv1.JobFailed) {
+		status.Phase = api.MemberPhaseFailed
+		status.Message = "MiniCluster job has failed"
+	} else if err == nil && (isJobConditionTrue(job, batchv1.JobComplete) || hasCompletedIndex(job, 0)) {
+		status.Phase = api.MemberPhaseCompleted
+		status.Message = "MiniCluster lead broker has finished"
+	} else if meta.IsStatusConditionTrue(conditions, jobctrl.ConditionJobFinished) {
+		status.Phase = api.MemberPhaseCompleted
+		status.Message = "MiniCluster job has finished"
+	} else if meta.IsStatusConditionTrue(conditions, jobctrl.ConditionJobRunning) ||
+		meta.IsStatusConditionTrue(conditions, jobctrl.ConditionJobReady) {
+		status.Phase = api.MemberPhaseRunning
+		status.Message = "MiniCluster is running"
+	} else {
+		status.Message = "MiniCluster is waiting for resources"
+	}
+	return status, nil
+}
+
+// getLeadBrokerJob gets the indexed job the Flux Operator creates for a MiniCluster
+func (r *EnsembleReconciler) getLeadBrokerJob(
+	ctx context.Context,
+	mc *minicluster.MiniCluster,
+) (*batchv1.Job, error) {
+	job := &batchv1.Job{}
+	err := r.Get(ctx, client.ObjectKeyFromObject(mc), job)
+	if err == nil && !metav1.IsControlledBy(job, mc) {
+		return job, errors.NewNotFound(batchv1.Resource("jobs"), mc.Name)
+	}
+	return job, err
+}
+
 // newMiniCluster creates a new ensemble minicluster
 func (r *EnsembleReconciler) newMiniCluster(
 	name string,
 	ensemble *api.Ensemble,
 	member *api.Member,
 	spec *minicluster.MiniCluster,
-	host string,
 ) *minicluster.MiniCluster {
 
 	// The size should be set to the desired size
+	// The hash of the spec tells us when it changes in a way that can't be updated
 	spec.ObjectMeta = metav1.ObjectMeta{Name: name, Namespace: ensemble.Namespace}
+	setMemberLabels(spec, ensemble, name)
+	hash, err := getMiniClusterHash(ensemble, member)
+	if err == nil {
+		spec.Annotations = map[string]string{specHashAnnotation: hash}
+	}
 
 	// Ensure the service name is the ensemble name so the ensemble service
 	// can share it too!
 	spec.Spec.Network = minicluster.Network{HeadlessName: ensemble.Name}
 
-	// Files to mount from configMap
-	items := map[string]string{
-		ensembleYamlName: ensembleYamlName,
+	// The job gets the member labels so we see changes to the lead broker
+	if spec.Spec.JobLabels == nil {
+		spec.Spec.JobLabels = map[string]string{}
+	}
+	for key, value := range getMemberLabels(ensemble, name) {
+		spec.Spec.JobLabels[key] = value
 	}
 
-	// Add the config map as a volume to the main container
-	container := spec.Spec.Containers[0]
+	// Files to mount from configMap
+	items := getConfigItems(member)
+
+	// Add the config map as a volume to the ensemble container, keeping the user volumes
+	index := member.GetEnsembleContainer()
+	container := spec.Spec.Containers[index]
 	volume := minicluster.ContainerVolume{
 		ConfigMapName: name,
-		Path:          "/ensemble-entrypoint",
+		Path:          ensembleYamlDirName,
 		Items:         items,
 	}
-	container.Volumes = map[string]minicluster.ContainerVolume{name: volume}
+	if container.Volumes == nil {
+		container.Volumes = map[string]minicluster.ContainerVolume{}
+	}
+	container.Volumes[name] = volume
 	container.RunFlux = true
 	container.Launcher = true
 
-	command := preCommand
-	if member.Branch != "" {
-		command = fmt.Sprintf(branchPreCommand, member.Branch)
-	}
-	// Install ensemble via python, either from pip or github
-	container.Commands = minicluster.Commands{Pre: command}
+	// Install ensemble via python (e.g., from pip, github, or a wheel) after the user pre command
+	addInstallToMiniCluster(spec, &container, member)
+	container.Commands.Pre = appendCommand(container.Commands.Pre, getInstallCommand(member))
+	addTLSToMiniCluster(&container, ensemble, name)
+	addEnsembleSecretToMiniCluster(&container, member)
 
 	// Note that we aren't creating a headless service so that the different members are isolated.
 	// Otherwise they would all be on the same service address, which might get ugly.
-	ensembleYamlPath := filepath.Join(ensembleYamlDirName, ensembleYamlName)
-	prefix := "ensemble run --kubernetes --executor minicluster --host"
-	container.Command = fmt.Sprintf("%s %s --port %s --name %s %s",
-		prefix, host,
-		ensemble.Spec.Sidecar.Port, name,
-		ensembleYamlPath,
-	)
-	spec.Spec.Containers[0] = container
+	container.Command = getRunCommand(ensemble, member, api.MiniclusterType, name)
+	spec.Spec.Containers[index] = container
 	fmt.Println(spec.Spec)
 	ctrl.SetControllerReference(ensemble, spec, r.Scheme)
 	return spec
 }
+
+// appendCommand appends a command to a user command (e.g., commands.pre)
+func appendCommand(command, addition string) string {
+	if strings.TrimSpace(command) == "" {
+		return addition
+	}
+	if strings.TrimSpace(addition) == "" {
+		return command
+	}
+	return strings.TrimRight(command, "\n") + "\n" + addition
+}
+
+// getRunCommand returns the command to run the ensemble for a member,
+// which connects to the ensemble service at the host in the config map
+func getRunCommand(
+	ensemble *api.Ensemble,
+	member *api.Member,
+	executor, name string,
+) string {
+	ensembleYamlPath := getEnsembleYamlPath(member)
+	hostPath := filepath.Join(ensembleYamlDirName, ensembleHostName)
+	prefix := fmt.Sprintf("ensemble run --kubernetes --executor %s --host", executor)
+	return fmt.Sprintf("%s $(cat %s) --port %s --name %s %s",
+		prefix, hostPath,
+		ensemble.Spec.Sidecar.Port, name,
+		ensembleYamlPath,
+	)
+}
@@ -0,0 +1,184 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	minicluster "github.com/flux-framework/flux-operator/api/v1alpha2"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+
+	api "github.com/converged-computing/ensemble-operator/api/v1alpha1"
+)
+
+// TestNewMiniClusterCommands checks the user commands are kept around the
+// commands that install and run the ensemble, in the container selected
+func TestNewMiniClusterCommands(t *testing.T) {
+	scheme := runtime.NewScheme()
+	if err := api.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	r := &EnsembleReconciler{Scheme: scheme}
+	pip := &api.Member{}
+	pipCommand := getInstallCommand(pip)
+
+	tests := []struct {
+		name    string
+		install *api.Install
+		pre     string
+		post    string
+
+		// The expected commands.pre of the ensemble container
+		expected string
+	}{
+		{name: "no user commands", expected: pipCommand},
+		{
+			name:     "user pre and post commands",
+			pre:      "echo one\necho two\n",
+			post:     "echo done",
+			expected: "echo one\necho two\n" + pipCommand,
+		},
+		{
+			name:     "preinstalled keeps the user pre command",
+			install:  &api.Install{Mode: api.InstallPreinstalled},
+			pre:      "echo one",
+			post:     "echo done",
+			expected: "echo one",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ensemble := &api.Ensemble{ObjectMeta: metav1.ObjectMeta{Name: "ens", Namespace: "default"}}
+			ensemble.Default()
+			member := &api.Member{
+				Name:              "sim",
+				Install:           test.install,
+				EnsembleContainer: "ensemble",
+				MiniCluster: &minicluster.MiniCluster{
+					Spec: minicluster.MiniClusterSpec{
+						Containers: []minicluster.MiniClusterContainer{
+							{Name: "sidecar", Image: "busybox", Commands: minicluster.Commands{Pre: "echo sidecar"}},
+							{
+								Name:     "ensemble",
+								Image:    "ghcr.io/converged-computing/metric-lammps:latest",
+								Commands: minicluster.Commands{Pre: test.pre, Post: test.post},
+								Volumes:  map[string]minicluster.ContainerVolume{"data": {ClaimName: "data", Path: "/data"}},
+							},
+						},
+					},
+				},
+			}
+			spec := member.MiniCluster.DeepCopy()
+			mc := r.newMiniCluster("ens-sim", ensemble, member, spec)
+
+			sidecar := mc.Spec.Containers[0]
+			if sidecar.Commands.Pre != "echo sidecar" || sidecar.Command != "" || sidecar.RunFlux {
+				t.Fatalf("expected the other container to be unchanged, got %v", sidecar)
+			}
+			container := mc.Spec.Containers[1]
+			if container.Commands.Pre != test.expected {
+				t.Fatalf("expected commands.pre %q, got %q", test.expected, container.Commands.Pre)
+			}
+			if test.pre != "" && !strings.HasPrefix(container.Commands.Pre, test.pre) {
+				t.Fatalf("expected the user pre command first, got %q", container.Commands.Pre)
+			}
+
+			// The Flux Operator runs pre, then the command, then post
+			if container.Commands.Post != test.post {
+				t.Fatalf("expected commands.post %q, got %q", test.post, container.Commands.Post)
+			}
+			if container.Command != getRunCommand(ensemble, member, api.MiniclusterType, "ens-sim") {
+				t.Fatalf("expected the ensemble to be the command, got %q", container.Command)
+			}
+			if _, ok := container.Volumes["data"]; !ok {
+				t.Fatal("expected the user volume to be kept")
+			}
+			if _, ok := container.Volumes["ens-sim"]; !ok {
+				t.Fatal("expected the member config volume")
+			}
+		})
+	}
+}
+
+// TestMiniClusterHash checks the fields that change the container running the
+// ensemble change the hash (so the MiniCluster is recreated), and the sizes don't
+func TestMiniClusterHash(t *testing.T) {
+	newMember := func() *api.Member {
+		return &api.Member{
+			MiniCluster: &minicluster.MiniCluster{
+				Spec: minicluster.MiniClusterSpec{
+					Size:       2,
+					Containers: []minicluster.MiniClusterContainer{{Name: "lammps", Image: "ghcr.io/converged-computing/metric-lammps:latest"}},
+				},
+			},
+		}
+	}
+	ensemble := &api.Ensemble{ObjectMeta: metav1.ObjectMeta{Name: "ens", Namespace: "default"}}
+	original, err := getMiniClusterHash(ensemble, newMember())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A member without the fields has the hash of its spec, as before they were added
+	member := newMember()
+	member.MiniCluster.Spec.Size = 0
+	content, err := json.Marshal(member.MiniCluster.Spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if original != getConfigHash(string(content)) {
+		t.Fatal("expected the hash of a member without the fields to be the hash of its spec")
+	}
+
+	tests := []struct {
+		name    string
+		change  func(*api.Ensemble, *api.Member)
+		changed bool
+	}{
+		{name: "size", change: func(e *api.Ensemble, m *api.Member) { m.MiniCluster.Spec.Size = 4; m.MiniCluster.Spec.MaxSize = 8 }},
+		{name: "image", change: func(e *api.Ensemble, m *api.Member) { m.MiniCluster.Spec.Containers[0].Image = "busybox" }, changed: true},
+		{name: "default install", change: func(e *api.Ensemble, m *api.Member) { m.Install = &api.Install{Mode: api.InstallPip} }},
+		{name: "install", change: func(e *api.Ensemble, m *api.Member) { m.Install = &api.Install{Mode: api.InstallPreinstalled} }, changed: true},
+		{name: "tls", change: func(e *api.Ensemble, m *api.Member) { e.Spec.Sidecar.TLS = &api.SidecarTLS{Enabled: true} }, changed: true},
+		{name: "ensemble container", change: func(e *api.Ensemble, m *api.Member) { m.EnsembleContainer = "lammps" }, changed: true},
+		{
+			name: "ensemble from",
+			change: func(e *api.Ensemble, m *api.Member) {
+				m.EnsembleFrom = &api.EnsembleSource{ConfigMapKeyRef: &corev1.ConfigMapKeySelector{Key: "ensemble.yaml"}}
+			},
+			changed: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			e := ensemble.DeepCopy()
+			m := newMember()
+			test.change(e, m)
+			hash, err := getMiniClusterHash(e, m)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (hash != original) != test.changed {
+				t.Fatalf("expected the hash to change to be %t", test.changed)
+			}
+		})
+	}
+}
@@ -0,0 +1,236 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	api "github.com/converged-computing/ensemble-operator/api/v1alpha1"
+)
+
+// deleteOrphanedMembers finds children labeled for the ensemble that no longer
+// belong to a member in the spec, and deletes them once the grace period is up.
+// If there are children still waiting on the grace period, we requeue for them.
+func (r *EnsembleReconciler) deleteOrphanedMembers(
+	ctx context.Context,
+	ensemble *api.Ensemble,
+) (ctrl.Result, error) {
+
+	// These are the members we expect to have children
+	members, err := ensemble.GetMembers()
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	expected := map[string]bool{}
+	for _, member := range members {
+		expected[member.Name] = true
+	}
+
+	// Sort the member types so we clean up in the same order each time
+	memberTypes := []string{}
+	for memberType := range backends {
+		memberTypes = append(memberTypes, memberType)
+	}
+	sort.Strings(memberTypes)
+
+	result := ctrl.Result{}
+	for _, memberType := range memberTypes {
+		backend, err := r.getBackend(memberType)
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+
+		// A member type might not be installed (e.g., JobSet)
+		objects, err := backend.List(ctx, ensemble)
+		if meta.IsNoMatchError(err) {
+			continue
+		}
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+		for _, obj := range objects {
+			name := obj.GetLabels()[api.MemberLabel]
+			wait, err := r.deleteOrphan(ctx, ensemble, obj, expected[name], func() error {
+				return backend.Delete(ctx, name, ensemble)
+			})
+			if err != nil {
+				return ctrl.Result{}, err
+			}
+			result = soonerResult(result, wait)
+		}
+	}
+
+	// The config maps are cleaned up the same way, after the member
+	configMaps, err := r.listMemberObjects(ctx, ensemble, &corev1.ConfigMapList{})
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	for _, obj := range configMaps {
+		name := obj.GetLabels()[api.MemberLabel]
+		wait, err := r.deleteOrphan(ctx, ensemble, obj, expected[name], func() error {
+			return client.IgnoreNotFound(r.Delete(ctx, obj))
+		})
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+		result = soonerResult(result, wait)
+	}
+
+	// And the certificates of members. With cert-manager, the Certificate is
+	// what the ensemble owns, and we delete the secret it made with it.
+	certificates, err := r.listMemberObjects(ctx, ensemble, &corev1.SecretList{})
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	if r.useCertManager(ensemble) {
+		list := &unstructured.UnstructuredList{}
+		list.SetGroupVersionKind(certificateGVK.GroupVersion().WithKind("CertificateList"))
+		objects, err := r.listMemberObjects(ctx, ensemble, list)
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+		certificates = append(certificates, objects...)
+	}
+	for _, obj := range certificates {
+		name, ok := obj.GetLabels()[tlsMemberLabel]
+		if !ok {
+			continue
+		}
+		wait, err := r.deleteOrphan(ctx, ensemble, obj, expected[name], func() error {
+			err := r.deleteCertificate(ctx, ensemble, getMemberTLSName(name))
+			if err != nil {
+				return err
+			}
+			secret := &corev1.Secret{}
+			secret.SetName(getMemberTLSName(name))
+			secret.SetNamespace(ensemble.Namespace)
+			return client.IgnoreNotFound(r.Delete(ctx, secret))
+		})
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+		result = soonerResult(result, wait)
+	}
+	return result, nil
+}
+
+// deleteOrphan marks a child that isn't expected as orphaned, and deletes it
+// when the grace period is up. A child that is expected again is unmarked.
+func (r *EnsembleReconciler) deleteOrphan(
+	ctx context.Context,
+	ensemble *api.Ensemble,
+	obj client.Object,
+	isExpected bool,
+	deleteFunc func() error,
+) (ctrl.Result, error) {
+
+	// We only delete what the ensemble controls
+	if !metav1.IsControlledBy(obj, ensemble) || obj.GetDeletionTimestamp() != nil {
+		return ctrl.Result{}, nil
+	}
+	kind := r.getObjectKind(obj)
+	orphanedAt, isOrphaned := obj.GetAnnotations()[api.OrphanedAtAnnotation]
+
+	// The member came back before the child was deleted
+	if isExpected {
+		if !isOrphaned {
+			return ctrl.Result{}, nil
+		}
+		fmt.Printf("      %s %s belongs to a member again\n", kind, obj.GetName())
+		return ctrl.Result{}, r.setOrphanedAt(ctx, obj, "")
+	}
+
+	grace := time.Duration(ensemble.Spec.OrphanGracePeriodSeconds) * time.Second
+	if !isOrphaned {
+		orphanedAt = time.Now().UTC().Format(time.RFC3339)
+		fmt.Printf("      %s %s does not belong to a member\n", kind, obj.GetName())
+		err := r.setOrphanedAt(ctx, obj, orphanedAt)
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+
+	// An annotation we can't parse is treated as being orphaned now
+	since, err := time.Parse(time.RFC3339, orphanedAt)
+	if err != nil {
+		since = time.Now()
+	}
+	remaining := grace - time.Since(since)
+	if remaining > 0 {
+		return ctrl.Result{RequeueAfter: remaining}, nil
+	}
+
+	fmt.Printf("      Deleting orphaned %s %s\n", kind, obj.GetName())
+	err = deleteFunc()
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	if r.Recorder != nil {
+		r.Recorder.Eventf(
+			ensemble, corev1.EventTypeNormal, "DeletedOrphan",
+			"Deleted %s %s that was removed from the ensemble members", kind, obj.GetName(),
+		)
+	}
+	return ctrl.Result{}, nil
+}
+
+// setOrphanedAt sets (or removes, if empty) the orphaned-at annotation
+func (r *EnsembleReconciler) setOrphanedAt(
+	ctx context.Context,
+	obj client.Object,
+	orphanedAt string,
+) error {
+	patch := client.MergeFrom(obj.DeepCopyObject().(client.Object))
+	annotations := obj.GetAnnotations()
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+	if orphanedAt == "" {
+		delete(annotations, api.OrphanedAtAnnotation)
+	} else {
+		annotations[api.OrphanedAtAnnotation] = orphanedAt
+	}
+	obj.SetAnnotations(annotations)
+	return client.IgnoreNotFound(r.Patch(ctx, obj, patch))
+}
+
+// getObjectKind returns the kind of an object for messages
+func (r *EnsembleReconciler) getObjectKind(obj client.Object) string {
+	gvks, _, err := r.Scheme.ObjectKinds(obj)
+	if err != nil || len(gvks) == 0 {
+		return "Object"
+	}
+	return gvks[0].Kind
+}
+
+// soonerResult returns the result that requeues first (if any)
+func soonerResult(a, b ctrl.Result) ctrl.Result {
+	if b.RequeueAfter > 0 && (a.RequeueAfter == 0 || b.RequeueAfter < a.RequeueAfter) {
+		return b
+	}
+	return a
+}
@@ -0,0 +1,119 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"encoding/json"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/strategicpatch"
+)
+
+// mergePodTemplate merges an override onto a pod template with a strategic
+// merge patch, so lists like containers, env and tolerations are merged by
+// their keys (e.g., a container by name) instead of being replaced.
+func mergePodTemplate(template *corev1.PodTemplateSpec, override *corev1.PodTemplateSpec) error {
+	if override == nil {
+		return nil
+	}
+	original, err := json.Marshal(template)
+	if err != nil {
+		return err
+	}
+
+	// Fields that are not set are null, which a patch would delete
+	patch, err := json.Marshal(override)
+	if err != nil {
+		return err
+	}
+	var fields map[string]interface{}
+	err = json.Unmarshal(patch, &fields)
+	if err != nil {
+		return err
+	}
+	patch, err = json.Marshal(removeNulls(fields))
+	if err != nil {
+		return err
+	}
+
+	merged, err := strategicpatch.StrategicMergePatch(original, patch, corev1.PodTemplateSpec{})
+	if err != nil {
+		return err
+	}
+	result := corev1.PodTemplateSpec{}
+	err = json.Unmarshal(merged, &result)
+	if err != nil {
+		return err
+	}
+	*template = result
+	return nil
+}
+
+// keepServiceFields sets the fields of the generated pod template that the
+// service and members rely on, if the merge changed them. The webhook rejects
+// a pod template that changes them, but it isn't used when run locally.
+func keepServiceFields(template *corev1.PodTemplateSpec, generated *corev1.PodTemplateSpec) {
+	for key, value := range generated.Labels {
+		template.Labels[key] = value
+	}
+	template.Spec.Subdomain = generated.Spec.Subdomain
+	template.Spec.ServiceAccountName = generated.Spec.ServiceAccountName
+	template.Spec.RestartPolicy = generated.Spec.RestartPolicy
+
+	service := generated.Spec.Containers[0]
+	for i := range template.Spec.Containers {
+		container := &template.Spec.Containers[i]
+		if container.Name != service.Name {
+			continue
+		}
+		container.Image = service.Image
+		container.Command = service.Command
+
+		// Ports are merged by number, so a different http port is added
+		ports := []corev1.ContainerPort{service.Ports[0]}
+		for _, port := range container.Ports {
+			if port.Name != service.Ports[0].Name && port.ContainerPort != service.Ports[0].ContainerPort {
+				ports = append(ports, port)
+			}
+		}
+		container.Ports = ports
+	}
+}
+
+// removeNulls removes null values (and maps left empty) from decoded json
+func removeNulls(value interface{}) interface{} {
+	switch typed := value.(type) {
+	case map[string]interface{}:
+		for key, item := range typed {
+			if item == nil {
+				delete(typed, key)
+				continue
+			}
+			typed[key] = removeNulls(item)
+			if nested, ok := typed[key].(map[string]interface{}); ok && len(nested) == 0 {
+				delete(typed, key)
+			}
+		}
+		return typed
+	case []interface{}:
+		for i, item := range typed {
+			typed[i] = removeNulls(item)
+		}
+		return typed
+	}
+	return value
+}
@@ -0,0 +1,237 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"reflect"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+
+	api "github.com/converged-computing/ensemble-operator/api/v1alpha1"
+)
+
+// newPodTemplateDeployment returns the pod template of the ensemble service
+// deployment, generated with the given pod template override
+func newPodTemplateDeployment(t *testing.T, override *corev1.PodTemplateSpec) (*corev1.PodTemplateSpec, *corev1.PodTemplateSpec) {
+	t.Helper()
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	if err := api.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	r := &EnsembleReconciler{Scheme: scheme}
+	ensemble := &api.Ensemble{ObjectMeta: metav1.ObjectMeta{Name: "ens", Namespace: "default"}}
+	ensemble.Default()
+
+	generated, err := r.newEnsembleDeployment(ensemble)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ensemble.Spec.Sidecar.PodTemplate = override
+	merged, err := r.newEnsembleDeployment(ensemble)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &generated.Spec.Template, &merged.Spec.Template
+}
+
+// getServiceContainer returns the ensemble service container
+func getServiceContainer(t *testing.T, template *corev1.PodTemplateSpec) *corev1.Container {
+	t.Helper()
+	for i, container := range template.Spec.Containers {
+		if container.Name == api.SidecarContainerName {
+			return &template.Spec.Containers[i]
+		}
+	}
+	t.Fatalf("service container %s is missing", api.SidecarContainerName)
+	return nil
+}
+
+func TestMergePodTemplateKeepsUserFields(t *testing.T) {
+	limits := corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("2")}
+	generated, template := newPodTemplateDeployment(t, &corev1.PodTemplateSpec{
+		ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{"team": "hpc"}},
+		Spec: corev1.PodSpec{
+			NodeSelector: map[string]string{"pool": "service"},
+			Volumes: []corev1.Volume{
+				{Name: "data", VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}}},
+			},
+			Containers: []corev1.Container{
+				{
+					Name:         api.SidecarContainerName,
+					Env:          []corev1.EnvVar{{Name: "ENSEMBLE_DEBUG", Value: "true"}},
+					VolumeMounts: []corev1.VolumeMount{{Name: "data", MountPath: "/data"}},
+					Resources:    corev1.ResourceRequirements{Limits: limits},
+				},
+				{Name: "exporter", Image: "exporter:latest"},
+			},
+		},
+	})
+
+	if template.Labels["team"] != "hpc" || template.Spec.NodeSelector["pool"] != "service" {
+		t.Fatalf("expected the user label and node selector, got %v and %v", template.Labels, template.Spec.NodeSelector)
+	}
+	if len(template.Spec.Volumes) != 1 || template.Spec.Volumes[0].Name != "data" {
+		t.Fatalf("expected the user volume, got %v", template.Spec.Volumes)
+	}
+	if len(template.Spec.Containers) != 2 || template.Spec.Containers[1].Name != "exporter" {
+		t.Fatalf("expected the service and sidecar containers, got %d containers", len(template.Spec.Containers))
+	}
+
+	// The user env is added to the generated env, not replacing it
+	container := getServiceContainer(t, template)
+	env := map[string]bool{}
+	for _, item := range container.Env {
+		env[item.Name] = true
+	}
+	for _, name := range []string{"ENSEMBLE_DEBUG", "ENSEMBLE_LEASE_NAME", "POD_NAME", "POD_NAMESPACE"} {
+		if !env[name] {
+			t.Fatalf("expected env %s, got %v", name, container.Env)
+		}
+	}
+	if len(container.VolumeMounts) != 1 || container.VolumeMounts[0].MountPath != "/data" {
+		t.Fatalf("expected the user volume mount, got %v", container.VolumeMounts)
+	}
+	if !container.Resources.Limits.Cpu().Equal(resource.MustParse("2")) {
+		t.Fatalf("expected the user resources, got %v", container.Resources)
+	}
+	if !reflect.DeepEqual(container.Command, getServiceContainer(t, generated).Command) {
+		t.Fatalf("expected the generated command, got %v", container.Command)
+	}
+}
+
+func TestMergePodTemplateKeepsServiceFields(t *testing.T) {
+	generated, template := newPodTemplateDeployment(t, &corev1.PodTemplateSpec{
+		ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{"app": "other"}},
+		Spec: corev1.PodSpec{
+			Subdomain:          "other",
+			ServiceAccountName: "other",
+			RestartPolicy:      corev1.RestartPolicyNever,
+			Containers: []corev1.Container{
+				{
+					Name:    api.SidecarContainerName,
+					Image:   "other:latest",
+					Command: []string{"sleep", "infinity"},
+					Ports:   []corev1.ContainerPort{{Name: "http", ContainerPort: 8080}},
+				},
+			},
+		},
+	})
+
+	if !reflect.DeepEqual(template.Labels, generated.Labels) {
+		t.Fatalf("expected labels %v, got %v", generated.Labels, template.Labels)
+	}
+	if template.Spec.Subdomain != generated.Spec.Subdomain ||
+		template.Spec.ServiceAccountName != generated.Spec.ServiceAccountName ||
+		template.Spec.RestartPolicy != generated.Spec.RestartPolicy {
+		t.Fatal("expected the generated subdomain, service account and restart policy")
+	}
+	if len(template.Spec.Containers) != 1 {
+		t.Fatalf("expected one container, got %d", len(template.Spec.Containers))
+	}
+	container := getServiceContainer(t, template)
+	expected := getServiceContainer(t, generated)
+	if container.Image != expected.Image {
+		t.Fatalf("expected image %s, got %s", expected.Image, container.Image)
+	}
+	if !reflect.DeepEqual(container.Command, expected.Command) {
+		t.Fatalf("expected command %v, got %v", expected.Command, container.Command)
+	}
+	if !reflect.DeepEqual(container.Ports, expected.Ports) {
+		t.Fatalf("expected ports %v, got %v", expected.Ports, container.Ports)
+	}
+}
+
+// TestMergePodTemplateZeroValues checks fields the typed pod template
+// leaves at their zero value don't clear the generated ones
+func TestMergePodTemplateZeroValues(t *testing.T) {
+	tests := []struct {
+		name     string
+		override *corev1.PodTemplateSpec
+	}{
+		{name: "no pod template"},
+		{name: "empty pod template", override: &corev1.PodTemplateSpec{}},
+		{
+			name: "service container with only a name",
+			override: &corev1.PodTemplateSpec{
+				Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: api.SidecarContainerName}}},
+			},
+		},
+		{
+			name: "service container with empty resources and lists",
+			override: &corev1.PodTemplateSpec{
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{
+						{
+							Name:      api.SidecarContainerName,
+							Resources: corev1.ResourceRequirements{Limits: corev1.ResourceList{}},
+							Env:       []corev1.EnvVar{},
+							Ports:     []corev1.ContainerPort{},
+						},
+					},
+				},
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			generated, template := newPodTemplateDeployment(t, test.override)
+			if !reflect.DeepEqual(template, generated) {
+				t.Fatalf("expected the generated pod template\n%v\ngot\n%v", generated, template)
+			}
+		})
+	}
+}
+
+func TestRemoveNulls(t *testing.T) {
+	tests := []struct {
+		name     string
+		value    interface{}
+		expected interface{}
+	}{
+		{name: "value", value: "tty", expected: "tty"},
+		{
+			name:     "nulls and empty maps",
+			value:    map[string]interface{}{"metadata": map[string]interface{}{"creationTimestamp": nil}, "tty": true, "image": nil},
+			expected: map[string]interface{}{"tty": true},
+		},
+		{
+			name: "nulls in lists",
+			value: map[string]interface{}{
+				"containers": []interface{}{map[string]interface{}{"name": "ensemble-service", "resources": map[string]interface{}{}}},
+			},
+			expected: map[string]interface{}{
+				"containers": []interface{}{map[string]interface{}{"name": "ensemble-service"}},
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			result := removeNulls(test.value)
+			if !reflect.DeepEqual(result, test.expected) {
+				t.Fatalf("expected %v, got %v", test.expected, result)
+			}
+		})
+	}
+}
@@ -0,0 +1,215 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	api "github.com/converged-computing/ensemble-operator/api/v1alpha1"
+)
+
+// How long to wait to check the health of an available ensemble service again
+var serviceRetryInterval = 10 * time.Second
+
+// updateStatus sets the ensemble status from the member statuses and the
+// ensemble service deployment, and only issues an update if it changed.
+func (r *EnsembleReconciler) updateStatus(
+	ctx context.Context,
+	ensemble *api.Ensemble,
+	members []api.MemberStatus,
+	readiness serviceReadiness,
+) error {
+
+	original := ensemble.Status.DeepCopy()
+	status := &ensemble.Status
+	status.ObservedGeneration = ensemble.Generation
+	status.Members = members
+	status.TotalMembers = int32(len(members))
+
+	// Count the members that are running or done
+	ready := int32(0)
+	finished := int32(0)
+	failed := int32(0)
+	for _, member := range members {
+		switch member.Phase {
+		case api.MemberPhaseRunning:
+			ready += 1
+		case api.MemberPhaseCompleted:
+			ready += 1
+			finished += 1
+		case api.MemberPhaseFailed:
+			ready += 1
+			finished += 1
+			failed += 1
+		}
+	}
+	status.ReadyMembers = ready
+
+	// The service is ready when the deployment is available and serving
+	r.setCondition(ensemble, api.ConditionServiceReady, readiness.ready, readiness.reason, readiness.message)
+
+	total := int32(len(members))
+	if total > 0 && ready == total {
+		r.setCondition(ensemble, api.ConditionMembersReady, true, "MembersReady", "All members are running or finished")
+	} else {
+		r.setCondition(ensemble, api.ConditionMembersReady, false, "MembersNotReady",
+			fmt.Sprintf("%d of %d members are running or finished", ready, total))
+	}
+
+	// The ensemble is done when every member is, and we remember when
+	if total > 0 && finished == total {
+		if failed > 0 {
+			r.setCondition(ensemble, api.ConditionCompleted, true, "MembersFailed",
+				fmt.Sprintf("All members have finished, and %d failed", failed))
+		} else {
+			r.setCondition(ensemble, api.ConditionCompleted, true, "MembersFinished", "All members have finished")
+		}
+		if status.CompletionTime == nil {
+			now := metav1.Now()
+			status.CompletionTime = &now
+		}
+	} else {
+		status.CompletionTime = nil
+		r.setCondition(ensemble, api.ConditionCompleted, false, "MembersActive",
+			fmt.Sprintf("%d of %d members have finished", finished, total))
+	}
+
+	if ensemble.Spec.Suspend {
+		r.setCondition(ensemble, api.ConditionSuspended, true, "Suspended",
+			fmt.Sprintf("The ensemble is suspended with policy %s", ensemble.Spec.SuspendPolicy))
+	} else {
+		r.setCondition(ensemble, api.ConditionSuspended, false, "Active", "The ensemble is not suspended")
+	}
+
+	if reflect.DeepEqual(original, status) {
+		return nil
+	}
+	fmt.Printf("      Updating Ensemble status (%d/%d members ready)\n", ready, total)
+	return r.Status().Update(ctx, ensemble)
+}
+
+// getMemberStatus returns the last status of a member, or nil
+func getMemberStatus(ensemble *api.Ensemble, name string) *api.MemberStatus {
+	for i := range ensemble.Status.Members {
+		if ensemble.Status.Members[i].Name == name {
+			return &ensemble.Status.Members[i]
+		}
+	}
+	return nil
+}
+
+// serviceReadiness is if the ensemble service can take requests from members,
+// and the reason for the ServiceReady condition
+type serviceReadiness struct {
+	ready   bool
+	reason  string
+	message string
+}
+
+// getServiceReadiness determines if the ensemble service deployment is
+// available and passes a gRPC health check. We hear about changes to the
+// deployment from the watch, so the service is only checked again when the
+// deployment changes (e.g., a replica is ready or restarted), or later if
+// the health check failed.
+func (r *EnsembleReconciler) getServiceReadiness(
+	ctx context.Context,
+	ensemble *api.Ensemble,
+) (serviceReadiness, ctrl.Result) {
+
+	deployment, err := r.getExistingDeployment(ctx, ensemble)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return serviceReadiness{false, "DeploymentNotFound", "The ensemble service deployment does not exist yet"}, ctrl.Result{}
+		}
+		return serviceReadiness{false, "DeploymentError", err.Error()}, ctrl.Result{}
+	}
+	available := false
+	for _, condition := range deployment.Status.Conditions {
+		if condition.Type == appsv1.DeploymentAvailable && condition.Status == corev1.ConditionTrue {
+			available = true
+		}
+	}
+	if !available || deployment.Status.AvailableReplicas < 1 {
+		return serviceReadiness{false, "DeploymentUnavailable", "The ensemble service deployment has no available replicas"}, ctrl.Result{}
+	}
+
+	key := client.ObjectKeyFromObject(ensemble)
+	state := getDeploymentState(deployment)
+	checked, ok := r.healthChecks.Load(key)
+	if ok && checked == state {
+		return serviceReadiness{true, "ServiceServing", "The ensemble service deployment is available and serving"}, ctrl.Result{}
+	}
+
+	c, err := r.getEnsembleClient(ctx, ensemble)
+	if err == nil {
+		defer c.Close()
+		err = c.HealthCheck(ctx)
+	}
+	if err != nil {
+		fmt.Printf("      Ensemble service health check failed: %s\n", err)
+		r.healthChecks.Delete(key)
+		message := fmt.Sprintf("The ensemble service did not pass a health check: %s", err)
+		return serviceReadiness{false, "HealthCheckFailed", message}, ctrl.Result{RequeueAfter: serviceRetryInterval}
+	}
+	r.healthChecks.Store(key, state)
+	return serviceReadiness{true, "ServiceServing", "The ensemble service deployment is available and serving"}, ctrl.Result{}
+}
+
+// getDeploymentState summarizes the deployment state that a health check
+// passed in. A new deployment, spec, or change in ready replicas is checked.
+func getDeploymentState(deployment *appsv1.Deployment) string {
+	return fmt.Sprintf(
+		"%s/%d/%d/%d/%d",
+		deployment.UID,
+		deployment.Status.ObservedGeneration,
+		deployment.Status.ReadyReplicas,
+		deployment.Status.AvailableReplicas,
+		deployment.Status.UpdatedReplicas,
+	)
+}
+
+// setCondition is a shared function to set a condition on the ensemble status
+func (r *EnsembleReconciler) setCondition(
+	ensemble *api.Ensemble,
+	conditionType string,
+	isTrue bool,
+	reason, message string,
+) {
+	status := metav1.ConditionFalse
+	if isTrue {
+		status = metav1.ConditionTrue
+	}
+	meta.SetStatusCondition(&ensemble.Status.Conditions, metav1.Condition{
+		Type:               conditionType,
+		Status:             status,
+		Reason:             reason,
+		Message:            message,
+		ObservedGeneration: ensemble.Generation,
+	})
+}
@@ -0,0 +1,150 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	ctrl "sigs.k8s.io/controller-runtime"
+
+	api "github.com/converged-computing/ensemble-operator/api/v1alpha1"
+)
+
+// suspendMember scales a member to its minimum size (saving the size to
+// restore on the config map) or deletes it, depending on the suspend policy.
+// A member that can be suspended in place (a JobSet) is suspended instead
+// of scaled. A member that doesn't exist is not created while suspended.
+func (r *EnsembleReconciler) suspendMember(
+	ctx context.Context,
+	name string,
+	ensemble *api.Ensemble,
+	member *api.Member,
+	backend MemberBackend,
+) (api.MemberStatus, error) {
+
+	status := api.MemberStatus{
+		Name:    name,
+		Type:    member.Type(),
+		Size:    member.Size(),
+		Phase:   api.MemberPhaseSuspended,
+		Message: "Ensemble is suspended",
+	}
+	_, err := backend.Get(ctx, name, ensemble)
+	if errors.IsNotFound(err) {
+		return status, nil
+	}
+	if err != nil {
+		return status, err
+	}
+
+	if ensemble.Spec.SuspendPolicy == api.SuspendDelete {
+		fmt.Printf("      Deleting member %s for suspend\n", name)
+		status.Message = "Ensemble is suspended, and the member was deleted"
+		return status, backend.Delete(ctx, name, ensemble)
+	}
+
+	// A member that finished while suspended is done
+	current, err := backend.Status(ctx, name, ensemble, member)
+	if err != nil {
+		return status, err
+	}
+	if current.Phase.IsFinished() {
+		return current, nil
+	}
+
+	// Scaling a JobSet recreates it, so it is suspended in place
+	suspender, ok := backend.(MemberSuspender)
+	if ok {
+		err = suspender.Suspend(ctx, name, ensemble, true)
+		if err != nil {
+			return status, err
+		}
+		current.Phase = api.MemberPhaseSuspended
+		current.Message = "Ensemble is suspended, and the member is suspended"
+		return current, nil
+	}
+
+	// Save the size to restore, only the first time
+	saved, err := r.getConfigSize(ctx, name, ensemble, suspendedSizeAnnotation)
+	if err != nil {
+		return status, err
+	}
+	if saved == 0 && current.Size > 0 {
+		err = r.setConfigSize(ctx, name, ensemble, suspendedSizeAnnotation, current.Size)
+		if err != nil {
+			return status, err
+		}
+	}
+
+	// A member cannot have a size of 0, even with a min size of 0
+	size := current.MinSize
+	if size < 1 {
+		size = 1
+	}
+	if current.Size != size {
+		fmt.Printf("      Scaling member %s to %d for suspend\n", name, size)
+	}
+	err = backend.Scale(ctx, name, ensemble, member, size)
+	if err != nil {
+		return status, err
+	}
+	current.Phase = api.MemberPhaseSuspended
+	current.Message = fmt.Sprintf("Ensemble is suspended, and the member is scaled to %d", size)
+	return current, nil
+}
+
+// resumeMember scales a member back to the size it had before the ensemble
+// was suspended, if one was saved, or resumes a member suspended in place
+func (r *EnsembleReconciler) resumeMember(
+	ctx context.Context,
+	name string,
+	ensemble *api.Ensemble,
+	member *api.Member,
+	backend MemberBackend,
+) (ctrl.Result, error) {
+
+	suspender, ok := backend.(MemberSuspender)
+	if ok {
+		err := suspender.Suspend(ctx, name, ensemble, false)
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+
+	// A config map that was just created might not be found yet, and
+	// then we don't know the size to restore
+	saved, err := r.getConfigSize(ctx, name, ensemble, suspendedSizeAnnotation)
+	if errors.IsNotFound(err) {
+		return ctrl.Result{RequeueAfter: configRetryInterval}, nil
+	}
+	if err != nil || saved == 0 {
+		return ctrl.Result{}, err
+	}
+
+	// If the member was just created we will try again next time
+	fmt.Printf("      Scaling member %s back to %d after suspend\n", name, saved)
+	err = backend.Scale(ctx, name, ensemble, member, saved)
+	if errors.IsNotFound(err) {
+		return ctrl.Result{}, nil
+	}
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	return ctrl.Result{}, r.setConfigSize(ctx, name, ensemble, suspendedSizeAnnotation, 0)
+}
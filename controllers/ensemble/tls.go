@@ -0,0 +1,631 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"time"
+
+	minicluster "github.com/flux-framework/flux-operator/api/v1alpha2"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	api "github.com/converged-computing/ensemble-operator/api/v1alpha1"
+	ensembleClient "github.com/converged-computing/ensemble-operator/pkg/client"
+)
+
+var (
+	// The CA certificate is in the secret of each certificate, like cert-manager
+	caCertKey = "ca.crt"
+
+	// How long certificates issued by the operator are valid, and when
+	// they are issued again (before they expire)
+	caDuration      = 10 * 365 * 24 * time.Hour
+	certDuration    = 365 * 24 * time.Hour
+	certRenewBefore = 30 * 24 * time.Hour
+
+	// Member certificates are labeled with the member (for cleanup)
+	tlsMemberLabel = "ensemble.flux-framework.org/tls-member"
+
+	// Set on the ensemble service pods with the hash of their certificate,
+	// so they are restarted when it changes (e.g., for a new external address)
+	serverCertAnnotation = "ensemble.flux-framework.org/server-cert"
+
+	// cert-manager certificates, if it is installed
+	certificateGVK = schema.GroupVersionKind{Group: "cert-manager.io", Version: "v1", Kind: "Certificate"}
+)
+
+// certificateRequest is a certificate for the ensemble service (server) or a
+// client of it (a member or the operator), stored in a secret
+type certificateRequest struct {
+	secretName  string
+	commonName  string
+	dnsNames    []string
+	ipAddresses []string
+	server      bool
+	labels      map[string]string
+}
+
+// getCASecretName returns the name of the secret with the ensemble CA
+func getCASecretName(ensemble *api.Ensemble) string {
+	return fmt.Sprintf("%s-tls-ca", ensemble.Name)
+}
+
+// getServerTLSName returns the name of the secret for the ensemble service
+func getServerTLSName(ensemble *api.Ensemble) string {
+	return fmt.Sprintf("%s-tls-server", ensemble.Name)
+}
+
+// getOperatorTLSName returns the name of the secret the operator uses to
+// connect to the ensemble service
+func getOperatorTLSName(ensemble *api.Ensemble) string {
+	return fmt.Sprintf("%s-tls-operator", ensemble.Name)
+}
+
+// getMemberTLSName returns the name of the secret for a member
+func getMemberTLSName(name string) string {
+	return fmt.Sprintf("%s-tls", name)
+}
+
+// ensureServiceTLS issues the certificates for the ensemble service and the
+// operator, if TLS is enabled. The certificate of the service also has the
+// addresses external members connect with.
+func (r *EnsembleReconciler) ensureServiceTLS(
+	ctx context.Context,
+	ensemble *api.Ensemble,
+) error {
+	if !ensemble.TLSEnabled() {
+		return nil
+	}
+	service := ensemble.ServiceName()
+	request := certificateRequest{
+		secretName: getServerTLSName(ensemble),
+		commonName: service,
+		dnsNames: []string{
+			service,
+			fmt.Sprintf("%s.%s", service, ensemble.Namespace),
+			ensemble.ServiceHost(),
+			fmt.Sprintf("%s.cluster.local", ensemble.ServiceHost()),
+		},
+		server: true,
+	}
+	hosts, err := r.getExternalHosts(ctx, ensemble)
+	if err != nil {
+		return err
+	}
+	for _, host := range hosts {
+		if net.ParseIP(host) != nil {
+			request.ipAddresses = append(request.ipAddresses, host)
+		} else {
+			request.dnsNames = append(request.dnsNames, host)
+		}
+	}
+	err = r.issueCertificate(ctx, ensemble, request)
+	if err != nil {
+		return err
+	}
+	return r.issueCertificate(ctx, ensemble, certificateRequest{
+		secretName: getOperatorTLSName(ensemble),
+		commonName: "ensemble-operator",
+	})
+}
+
+// ensureMemberTLS issues the client certificate for a member, if TLS is enabled.
+// An external member gets it in its credentials too (see ExternalBackend).
+func (r *EnsembleReconciler) ensureMemberTLS(
+	ctx context.Context,
+	name string,
+	ensemble *api.Ensemble,
+	member *api.Member,
+) error {
+	if !ensemble.TLSEnabled() {
+		return nil
+	}
+	return r.issueCertificate(ctx, ensemble, certificateRequest{
+		secretName: getMemberTLSName(name),
+		commonName: name,
+		labels:     map[string]string{api.EnsembleLabel: ensemble.Name, tlsMemberLabel: name},
+	})
+}
+
+// issueCertificate issues a certificate with a cert-manager issuer (if one is
+// set and cert-manager is installed) or with the ensemble CA
+func (r *EnsembleReconciler) issueCertificate(
+	ctx context.Context,
+	ensemble *api.Ensemble,
+	request certificateRequest,
+) error {
+	if r.useCertManager(ensemble) {
+		return r.applyCertificate(ctx, ensemble, request)
+	}
+	ca, key, err := r.ensureCA(ctx, ensemble)
+	if err != nil {
+		return err
+	}
+
+	// A certificate that is valid, from this CA and for the same names is kept
+	existing := &corev1.Secret{}
+	err = r.Get(ctx, client.ObjectKey{Name: request.secretName, Namespace: ensemble.Namespace}, existing)
+	if err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+	exists := err == nil
+	caPEM := encodeCertificate(ca.Raw)
+	if exists && bytes.Equal(existing.Data[caCertKey], caPEM) &&
+		!needsRenewal(existing.Data[corev1.TLSCertKey]) && hasNames(existing.Data[corev1.TLSCertKey], request) {
+		return nil
+	}
+
+	certPEM, keyPEM, err := newCertificate(request, ca, key)
+	if err != nil {
+		return err
+	}
+	data := map[string][]byte{
+		corev1.TLSCertKey:       certPEM,
+		corev1.TLSPrivateKeyKey: keyPEM,
+		caCertKey:               caPEM,
+	}
+	if exists {
+		fmt.Printf("      Renewing certificate %s\n", request.secretName)
+		patch := client.MergeFrom(existing.DeepCopy())
+		existing.Data = data
+		return r.Patch(ctx, existing, patch)
+	}
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      request.secretName,
+			Namespace: ensemble.Namespace,
+			Labels:    request.labels,
+		},
+		Type: corev1.SecretTypeTLS,
+		Data: data,
+	}
+	ctrl.SetControllerReference(ensemble, secret, r.Scheme)
+	fmt.Printf("      Creating certificate %s\n", request.secretName)
+	return r.Create(ctx, secret)
+}
+
+// ensureCA gets (or creates) the CA of the ensemble, which is deleted with it
+func (r *EnsembleReconciler) ensureCA(
+	ctx context.Context,
+	ensemble *api.Ensemble,
+) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+
+	secret := &corev1.Secret{}
+	err := r.Get(ctx, client.ObjectKey{Name: getCASecretName(ensemble), Namespace: ensemble.Namespace}, secret)
+	if err == nil {
+		return parseKeyPair(secret.Data[corev1.TLSCertKey], secret.Data[corev1.TLSPrivateKeyKey])
+	}
+	if !errors.IsNotFound(err) {
+		return nil, nil, err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	serial, err := newSerialNumber()
+	if err != nil {
+		return nil, nil, err
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: getCommonName(fmt.Sprintf("%s-ca", ensemble.Name))},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(caDuration),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyPEM, err := encodeKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	secret = &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      getCASecretName(ensemble),
+			Namespace: ensemble.Namespace,
+		},
+		Type: corev1.SecretTypeTLS,
+		Data: map[string][]byte{
+			corev1.TLSCertKey:       encodeCertificate(der),
+			corev1.TLSPrivateKeyKey: keyPEM,
+		},
+	}
+	ctrl.SetControllerReference(ensemble, secret, r.Scheme)
+	fmt.Println("      Creating Ensemble CA")
+	err = r.Create(ctx, secret)
+	if err != nil {
+		return nil, nil, err
+	}
+	ca, err := x509.ParseCertificate(der)
+	return ca, key, err
+}
+
+// newCertificate creates a certificate signed by the CA, and returns it and its key (PEM)
+func newCertificate(
+	request certificateRequest,
+	ca *x509.Certificate,
+	caKey *ecdsa.PrivateKey,
+) ([]byte, []byte, error) {
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	serial, err := newSerialNumber()
+	if err != nil {
+		return nil, nil, err
+	}
+	usage := x509.ExtKeyUsageClientAuth
+	if request.server {
+		usage = x509.ExtKeyUsageServerAuth
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: getCommonName(request.commonName)},
+		DNSNames:     request.dnsNames,
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(certDuration),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}
+	for _, address := range request.ipAddresses {
+		template.IPAddresses = append(template.IPAddresses, net.ParseIP(address))
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyPEM, err := encodeKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return encodeCertificate(der), keyPEM, nil
+}
+
+// getCommonName returns a common name, which can be at most 64 characters
+func getCommonName(name string) string {
+	if len(name) > 64 {
+		return name[:64]
+	}
+	return name
+}
+
+// sortedKeys returns the keys of a map in order, so lists we generate from
+// it (e.g., environment variables) are the same each time
+func sortedKeys(values map[string]string) []string {
+	keys := []string{}
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// needsRenewal determines if a certificate (PEM) is missing, not valid, or expires soon
+func needsRenewal(certPEM []byte) bool {
+	block, _ := pem.Decode(certPEM)
+	if block == nil {
+		return true
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return true
+	}
+	return time.Now().Add(certRenewBefore).After(cert.NotAfter)
+}
+
+// hasNames determines if a certificate (PEM) has the DNS names and IP
+// addresses of a request, e.g., after an external member is added
+func hasNames(certPEM []byte, request certificateRequest) bool {
+	block, _ := pem.Decode(certPEM)
+	if block == nil {
+		return false
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return false
+	}
+	names := append([]string{}, cert.DNSNames...)
+	for _, address := range cert.IPAddresses {
+		names = append(names, address.String())
+	}
+	expected := append([]string{}, request.dnsNames...)
+	for _, address := range request.ipAddresses {
+		expected = append(expected, net.ParseIP(address).String())
+	}
+	return reflect.DeepEqual(names, expected)
+}
+
+// parseKeyPair parses a certificate and ECDSA key (PEM)
+func parseKeyPair(certPEM, keyPEM []byte) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	certBlock, _ := pem.Decode(certPEM)
+	keyBlock, _ := pem.Decode(keyPEM)
+	if certBlock == nil || keyBlock == nil {
+		return nil, nil, fmt.Errorf("certificate or key is not valid PEM")
+	}
+	cert, err := x509.ParseCertificate(certBlock.Bytes)
+	if err != nil {
+		return nil, nil, err
+	}
+	key, err := x509.ParseECPrivateKey(keyBlock.Bytes)
+	return cert, key, err
+}
+
+// encodeCertificate encodes a certificate (DER) as PEM
+func encodeCertificate(der []byte) []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+// encodeKey encodes an ECDSA key as PEM
+func encodeKey(key *ecdsa.PrivateKey) ([]byte, error) {
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), nil
+}
+
+// newSerialNumber returns a random serial number for a certificate
+func newSerialNumber() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
+
+// useCertManager determines if certificates are issued by cert-manager,
+// which needs an issuer and cert-manager to be installed
+func (r *EnsembleReconciler) useCertManager(ensemble *api.Ensemble) bool {
+	if ensemble.Spec.Sidecar.TLS == nil || ensemble.Spec.Sidecar.TLS.IssuerRef == nil {
+		return false
+	}
+	_, err := r.RESTMapper().RESTMapping(certificateGVK.GroupKind(), certificateGVK.Version)
+	if err != nil {
+		fmt.Println("      cert-manager is not installed, the operator issues certificates")
+		return false
+	}
+	return true
+}
+
+// applyCertificate applies a cert-manager Certificate for the request, and
+// cert-manager creates the secret
+func (r *EnsembleReconciler) applyCertificate(
+	ctx context.Context,
+	ensemble *api.Ensemble,
+	request certificateRequest,
+) error {
+
+	issuer := ensemble.Spec.Sidecar.TLS.IssuerRef
+	usages := []interface{}{"digital signature", "key encipherment", "client auth"}
+	if request.server {
+		usages = []interface{}{"digital signature", "key encipherment", "server auth"}
+	}
+	spec := map[string]interface{}{
+		"secretName": request.secretName,
+		"commonName": getCommonName(request.commonName),
+		"usages":     usages,
+		"issuerRef": map[string]interface{}{
+			"name":  issuer.Name,
+			"kind":  issuer.Kind,
+			"group": certificateGVK.Group,
+		},
+	}
+	if len(request.dnsNames) > 0 {
+		dnsNames := []interface{}{}
+		for _, name := range request.dnsNames {
+			dnsNames = append(dnsNames, name)
+		}
+		spec["dnsNames"] = dnsNames
+	}
+	if len(request.ipAddresses) > 0 {
+		ipAddresses := []interface{}{}
+		for _, address := range request.ipAddresses {
+			ipAddresses = append(ipAddresses, address)
+		}
+		spec["ipAddresses"] = ipAddresses
+	}
+	if len(request.labels) > 0 {
+		labels := map[string]interface{}{}
+		for key, value := range request.labels {
+			labels[key] = value
+		}
+		spec["secretTemplate"] = map[string]interface{}{"labels": labels}
+	}
+
+	certificate := &unstructured.Unstructured{}
+	certificate.SetGroupVersionKind(certificateGVK)
+	certificate.SetName(request.secretName)
+	certificate.SetNamespace(ensemble.Namespace)
+	certificate.SetLabels(request.labels)
+	certificate.Object["spec"] = spec
+	return r.applyObject(ctx, ensemble, certificate)
+}
+
+// deleteCertificate deletes the cert-manager Certificate for a secret, if
+// there is one, so it isn't issued again
+func (r *EnsembleReconciler) deleteCertificate(
+	ctx context.Context,
+	ensemble *api.Ensemble,
+	secretName string,
+) error {
+	if !r.useCertManager(ensemble) {
+		return nil
+	}
+	certificate := &unstructured.Unstructured{}
+	certificate.SetGroupVersionKind(certificateGVK)
+	certificate.SetName(secretName)
+	certificate.SetNamespace(ensemble.Namespace)
+	return client.IgnoreNotFound(r.Delete(ctx, certificate))
+}
+
+// getTLSEnvironment returns the environment for ensemble python to find the
+// certificate of a member, and the name of the ensemble service to verify
+func getTLSEnvironment(ensemble *api.Ensemble) map[string]string {
+	return map[string]string{
+		"ENSEMBLE_TLS_CERT":        filepath.Join(api.TLSVolumePath, corev1.TLSCertKey),
+		"ENSEMBLE_TLS_KEY":         filepath.Join(api.TLSVolumePath, corev1.TLSPrivateKeyKey),
+		"ENSEMBLE_TLS_CA":          filepath.Join(api.TLSVolumePath, caCertKey),
+		"ENSEMBLE_TLS_SERVER_NAME": ensemble.ServiceHost(),
+	}
+}
+
+// addTLSToPodSpec mounts the certificate of a member in the container that
+// runs the ensemble, for a Job or JobSet
+func addTLSToPodSpec(
+	podSpec *corev1.PodSpec,
+	container *corev1.Container,
+	ensemble *api.Ensemble,
+	name string,
+) {
+	if !ensemble.TLSEnabled() {
+		return
+	}
+	podSpec.Volumes = append(podSpec.Volumes, corev1.Volume{
+		Name: api.TLSVolumeName,
+		VolumeSource: corev1.VolumeSource{
+			Secret: &corev1.SecretVolumeSource{SecretName: getMemberTLSName(name)},
+		},
+	})
+	container.VolumeMounts = append(container.VolumeMounts, corev1.VolumeMount{
+		Name:      api.TLSVolumeName,
+		MountPath: api.TLSVolumePath,
+		ReadOnly:  true,
+	})
+	environment := getTLSEnvironment(ensemble)
+	for _, key := range sortedKeys(environment) {
+		container.Env = append(container.Env, corev1.EnvVar{Name: key, Value: environment[key]})
+	}
+}
+
+// addTLSToMiniCluster mounts the certificate of a member in the MiniCluster
+// container that runs the ensemble
+func addTLSToMiniCluster(
+	container *minicluster.MiniClusterContainer,
+	ensemble *api.Ensemble,
+	name string,
+) {
+	if !ensemble.TLSEnabled() {
+		return
+	}
+	container.Volumes[api.TLSVolumeName] = minicluster.ContainerVolume{
+		SecretName: getMemberTLSName(name),
+		Path:       api.TLSVolumePath,
+		ReadOnly:   true,
+	}
+	if container.Environment == nil {
+		container.Environment = map[string]string{}
+	}
+	for key, value := range getTLSEnvironment(ensemble) {
+		container.Environment[key] = value
+	}
+}
+
+// addTLSToDeployment mounts the certificate of the ensemble service, and
+// asks it to require a client certificate (mutual TLS)
+func addTLSToDeployment(podSpec *corev1.PodSpec, ensemble *api.Ensemble) {
+	if !ensemble.TLSEnabled() {
+		return
+	}
+	podSpec.Volumes = append(podSpec.Volumes, corev1.Volume{
+		Name: api.TLSVolumeName,
+		VolumeSource: corev1.VolumeSource{
+			Secret: &corev1.SecretVolumeSource{SecretName: getServerTLSName(ensemble)},
+		},
+	})
+	container := &podSpec.Containers[0]
+	container.VolumeMounts = append(container.VolumeMounts, corev1.VolumeMount{
+		Name:      api.TLSVolumeName,
+		MountPath: api.TLSVolumePath,
+		ReadOnly:  true,
+	})
+	environment := getTLSEnvironment(ensemble)
+	delete(environment, "ENSEMBLE_TLS_SERVER_NAME")
+	environment["ENSEMBLE_TLS_CLIENT_AUTH"] = "require"
+	for _, key := range sortedKeys(environment) {
+		container.Env = append(container.Env, corev1.EnvVar{Name: key, Value: environment[key]})
+	}
+}
+
+// addServerCertHash adds the hash of the certificate of the ensemble service
+// to its pod template. A certificate that isn't issued yet (by cert-manager)
+// is added when it is.
+func (r *EnsembleReconciler) addServerCertHash(
+	ctx context.Context,
+	ensemble *api.Ensemble,
+	template *corev1.PodTemplateSpec,
+) error {
+	if !ensemble.TLSEnabled() {
+		return nil
+	}
+	secret := &corev1.Secret{}
+	err := r.Get(ctx, client.ObjectKey{Name: getServerTLSName(ensemble), Namespace: ensemble.Namespace}, secret)
+	if err != nil {
+		return client.IgnoreNotFound(err)
+	}
+	if template.Annotations == nil {
+		template.Annotations = map[string]string{}
+	}
+	template.Annotations[serverCertAnnotation] = getConfigHash(string(secret.Data[corev1.TLSCertKey]))
+	return nil
+}
+
+// getClientOptions returns the options for the operator to connect to the
+// ensemble service, with its certificate if TLS is enabled
+func (r *EnsembleReconciler) getClientOptions(
+	ctx context.Context,
+	ensemble *api.Ensemble,
+) ([]ensembleClient.Option, error) {
+	if !ensemble.TLSEnabled() {
+		return nil, nil
+	}
+	secret := &corev1.Secret{}
+	err := r.Get(ctx, client.ObjectKey{Name: getOperatorTLSName(ensemble), Namespace: ensemble.Namespace}, secret)
+	if err != nil {
+		return nil, err
+	}
+	return []ensembleClient.Option{
+		ensembleClient.WithMTLS(
+			secret.Data[corev1.TLSCertKey],
+			secret.Data[corev1.TLSPrivateKeyKey],
+			secret.Data[caCertKey],
+			ensemble.ServiceHost(),
+		),
+	}, nil
+}
@@ -0,0 +1,387 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"net"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	api "github.com/converged-computing/ensemble-operator/api/v1alpha1"
+	minicluster "github.com/flux-framework/flux-operator/api/v1alpha2"
+)
+
+// newTLSEnsemble returns an ensemble with TLS enabled, and an issuer if set
+func newTLSEnsemble(issuer *api.IssuerReference) *api.Ensemble {
+	return &api.Ensemble{
+		ObjectMeta: metav1.ObjectMeta{Name: "ens", Namespace: "default", UID: "ens-uid"},
+		Spec: api.EnsembleSpec{
+			Sidecar: api.Sidecar{TLS: &api.SidecarTLS{Enabled: true, IssuerRef: issuer}},
+		},
+	}
+}
+
+// newTLSReconciler returns a reconciler with a fake client. If certManager
+// is true, the cert-manager Certificate kind is known to the client.
+func newTLSReconciler(t *testing.T, certManager bool) *EnsembleReconciler {
+	t.Helper()
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	if err := api.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	mapper := meta.NewDefaultRESTMapper(nil)
+	if certManager {
+		mapper.Add(certificateGVK, meta.RESTScopeNamespace)
+	}
+	c := fake.NewClientBuilder().WithScheme(scheme).WithRESTMapper(mapper).Build()
+	return &EnsembleReconciler{Client: c, Scheme: scheme}
+}
+
+// getTLSSecret gets a secret the reconciler created
+func getTLSSecret(t *testing.T, r *EnsembleReconciler, name string) *corev1.Secret {
+	t.Helper()
+	secret := &corev1.Secret{}
+	err := r.Get(context.Background(), client.ObjectKey{Name: name, Namespace: "default"}, secret)
+	if err != nil {
+		t.Fatalf("secret %s: %s", name, err)
+	}
+	return secret
+}
+
+// parseCertificate parses a certificate (PEM)
+func parseCertificate(t *testing.T, certPEM []byte) *x509.Certificate {
+	t.Helper()
+	block, _ := pem.Decode(certPEM)
+	if block == nil {
+		t.Fatal("certificate is not PEM")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func TestIssueCertificates(t *testing.T) {
+	ctx := context.Background()
+	r := newTLSReconciler(t, false)
+	ensemble := newTLSEnsemble(nil)
+	member := &api.Member{MiniCluster: &minicluster.MiniCluster{}}
+
+	err := r.ensureServiceTLS(ctx, ensemble)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = r.ensureMemberTLS(ctx, "ens-sim", ensemble, member)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	caSecret := getTLSSecret(t, r, "ens-tls-ca")
+	ca := parseCertificate(t, caSecret.Data[corev1.TLSCertKey])
+	if !ca.IsCA {
+		t.Fatal("expected the ensemble CA to be a CA")
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+
+	tests := []struct {
+		secret  string
+		usage   x509.ExtKeyUsage
+		dnsName string
+	}{
+		{secret: "ens-tls-server", usage: x509.ExtKeyUsageServerAuth, dnsName: "ens-grpc.default.svc"},
+		{secret: "ens-tls-operator", usage: x509.ExtKeyUsageClientAuth},
+		{secret: "ens-sim-tls", usage: x509.ExtKeyUsageClientAuth},
+	}
+	for _, test := range tests {
+		t.Run(test.secret, func(t *testing.T) {
+			secret := getTLSSecret(t, r, test.secret)
+			if secret.Type != corev1.SecretTypeTLS {
+				t.Fatalf("expected a TLS secret, got %s", secret.Type)
+			}
+			if !metav1.IsControlledBy(secret, ensemble) {
+				t.Fatal("expected the secret to be owned by the ensemble")
+			}
+			if !bytes.Equal(secret.Data[caCertKey], caSecret.Data[corev1.TLSCertKey]) {
+				t.Fatal("expected the secret to have the ensemble CA")
+			}
+			_, err := tls.X509KeyPair(secret.Data[corev1.TLSCertKey], secret.Data[corev1.TLSPrivateKeyKey])
+			if err != nil {
+				t.Fatalf("certificate and key do not match: %s", err)
+			}
+			cert := parseCertificate(t, secret.Data[corev1.TLSCertKey])
+			_, err = cert.Verify(x509.VerifyOptions{
+				Roots:     roots,
+				DNSName:   test.dnsName,
+				KeyUsages: []x509.ExtKeyUsage{test.usage},
+			})
+			if err != nil {
+				t.Fatalf("certificate does not verify with the ensemble CA: %s", err)
+			}
+		})
+	}
+
+	// Member certificates are labeled, so orphaned ones can be deleted
+	secret := getTLSSecret(t, r, getMemberTLSName("ens-sim"))
+	if secret.Labels[tlsMemberLabel] != "ens-sim" || secret.Labels[api.EnsembleLabel] != "ens" {
+		t.Fatalf("member certificate labels are %v", secret.Labels)
+	}
+
+	// The operator and the service agree on mutual TLS
+	server := getTLSSecret(t, r, getServerTLSName(ensemble))
+	operator := getTLSSecret(t, r, getOperatorTLSName(ensemble))
+	testHandshake(t, server, operator, ensemble.ServiceHost())
+}
+
+// testHandshake checks a client with one certificate secret can connect to a
+// server with another, and the server requires the client certificate
+func testHandshake(t *testing.T, server, client *corev1.Secret, serverName string) {
+	t.Helper()
+	serverCert, err := tls.X509KeyPair(server.Data[corev1.TLSCertKey], server.Data[corev1.TLSPrivateKeyKey])
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientCert, err := tls.X509KeyPair(client.Data[corev1.TLSCertKey], client.Data[corev1.TLSPrivateKeyKey])
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(server.Data[caCertKey])
+
+	serverConn, clientConn := net.Pipe()
+	defer serverConn.Close()
+	defer clientConn.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	serverConn.SetDeadline(deadline)
+	clientConn.SetDeadline(deadline)
+
+	errs := make(chan error, 1)
+	go func() {
+		conn := tls.Server(serverConn, &tls.Config{
+			Certificates: []tls.Certificate{serverCert},
+			ClientCAs:    pool,
+			ClientAuth:   tls.RequireAndVerifyClientCert,
+		})
+		errs <- conn.Handshake()
+	}()
+	conn := tls.Client(clientConn, &tls.Config{
+		Certificates: []tls.Certificate{clientCert},
+		RootCAs:      pool,
+		ServerName:   serverName,
+	})
+	err = conn.Handshake()
+	if err != nil {
+		t.Fatalf("client handshake failed: %s", err)
+	}
+	err = <-errs
+	if err != nil {
+		t.Fatalf("server handshake failed: %s", err)
+	}
+}
+
+func TestCertificateRenewal(t *testing.T) {
+	ctx := context.Background()
+	day := 24 * time.Hour
+
+	tests := []struct {
+		name string
+
+		// How long the existing certificate is valid for, or it is replaced
+		duration time.Duration
+		replace  func(secret *corev1.Secret)
+		renewed  bool
+	}{
+		{name: "valid for a year", duration: certDuration},
+		{name: "outside the renewal window", duration: certRenewBefore + 2*day},
+		{name: "inside the renewal window", duration: certRenewBefore - 2*day, renewed: true},
+		{
+			name:     "not valid PEM",
+			duration: certDuration,
+			replace:  func(secret *corev1.Secret) { secret.Data[corev1.TLSCertKey] = []byte("not a certificate") },
+			renewed:  true,
+		},
+		{
+			name:     "from another CA",
+			duration: certDuration,
+			replace:  func(secret *corev1.Secret) { secret.Data[caCertKey] = []byte("another CA") },
+			renewed:  true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := newTLSReconciler(t, false)
+			ensemble := newTLSEnsemble(nil)
+			member := &api.Member{MiniCluster: &minicluster.MiniCluster{}}
+			name := getMemberTLSName("ens-sim")
+
+			// Issue the existing certificate with the duration of the test
+			original := certDuration
+			certDuration = test.duration
+			err := r.ensureMemberTLS(ctx, "ens-sim", ensemble, member)
+			certDuration = original
+			if err != nil {
+				t.Fatal(err)
+			}
+			existing := getTLSSecret(t, r, name)
+			if test.replace != nil {
+				test.replace(existing)
+				if err := r.Update(ctx, existing); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			err = r.ensureMemberTLS(ctx, "ens-sim", ensemble, member)
+			if err != nil {
+				t.Fatal(err)
+			}
+			secret := getTLSSecret(t, r, name)
+			renewed := !bytes.Equal(existing.Data[corev1.TLSCertKey], secret.Data[corev1.TLSCertKey])
+			if renewed != test.renewed {
+				t.Fatalf("expected renewed to be %t, got %t", test.renewed, renewed)
+			}
+			if renewed && needsRenewal(secret.Data[corev1.TLSCertKey]) {
+				t.Fatal("expected the renewed certificate to be valid outside the renewal window")
+			}
+		})
+	}
+}
+
+func TestUseCertManager(t *testing.T) {
+	issuer := &api.IssuerReference{Name: "issuer", Kind: "ClusterIssuer"}
+	tests := []struct {
+		name        string
+		issuer      *api.IssuerReference
+		certManager bool
+		expected    bool
+	}{
+		{name: "no issuer", certManager: true},
+		{name: "issuer without cert-manager", issuer: issuer},
+		{name: "issuer with cert-manager", issuer: issuer, certManager: true, expected: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := newTLSReconciler(t, test.certManager)
+			ensemble := newTLSEnsemble(test.issuer)
+			if r.useCertManager(ensemble) != test.expected {
+				t.Fatalf("expected useCertManager to be %t", test.expected)
+			}
+
+			// Without cert-manager, the operator issues the certificate itself
+			if test.expected {
+				return
+			}
+			err := r.ensureServiceTLS(context.Background(), ensemble)
+			if err != nil {
+				t.Fatal(err)
+			}
+			getTLSSecret(t, r, getCASecretName(ensemble))
+			getTLSSecret(t, r, getServerTLSName(ensemble))
+		})
+	}
+}
+
+// TestExternalMemberTLS checks an external member gets a certificate in its
+// credentials, and the service has the addresses the member connects with
+func TestExternalMemberTLS(t *testing.T) {
+	ctx := context.Background()
+	r := newTLSReconciler(t, false)
+	ensemble := newTLSEnsemble(nil)
+	member := api.Member{
+		Name:     "external",
+		External: &api.ExternalMember{ServiceType: corev1.ServiceTypeLoadBalancer, Hosts: []string{"node.example.com"}},
+	}
+	ensemble.Spec.Members = []api.Member{member}
+	name := "ens-external"
+
+	// The service of the member has an address from the load balancer
+	svc := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+		Spec:       corev1.ServiceSpec{Type: corev1.ServiceTypeLoadBalancer},
+	}
+	setMemberLabels(svc, ensemble, name)
+	if err := r.Create(ctx, svc); err != nil {
+		t.Fatal(err)
+	}
+	svc.Status.LoadBalancer.Ingress = []corev1.LoadBalancerIngress{{IP: "203.0.113.10"}}
+	if err := r.Status().Update(ctx, svc); err != nil {
+		t.Fatal(err)
+	}
+
+	err := r.ensureServiceTLS(ctx, ensemble)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = r.ensureMemberTLS(ctx, name, ensemble, &member)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// New credentials don't have data until they are read from the server
+	b := &ExternalBackend{r: r}
+	_, err = b.ensureCredentials(ctx, name, ensemble)
+	if err != nil {
+		t.Fatal(err)
+	}
+	credentials := getTLSSecret(t, r, getCredentialsName(name))
+	credentials.Data = map[string][]byte{"token": []byte("token")}
+	if err := r.Update(ctx, credentials); err != nil {
+		t.Fatal(err)
+	}
+	err = b.ensureCredentialsTLS(ctx, name, ensemble, credentials)
+	if err != nil {
+		t.Fatal(err)
+	}
+	credentials = getTLSSecret(t, r, getCredentialsName(name))
+	if string(credentials.Data["token"]) != "token" || string(credentials.Data["serverName"]) != ensemble.ServiceHost() {
+		t.Fatalf("expected the token and server name in the credentials, got keys %v", credentials.Data)
+	}
+
+	// The member connects with each of its addresses, or the service name
+	server := getTLSSecret(t, r, getServerTLSName(ensemble))
+	for _, serverName := range []string{"203.0.113.10", "node.example.com", ensemble.ServiceHost()} {
+		testHandshake(t, server, credentials, serverName)
+	}
+
+	// Another address issues the certificate of the service again
+	ensemble.Spec.Members[0].External.Hosts = []string{"node.example.com", "198.51.100.7"}
+	err = r.ensureServiceTLS(ctx, ensemble)
+	if err != nil {
+		t.Fatal(err)
+	}
+	renewed := getTLSSecret(t, r, getServerTLSName(ensemble))
+	if bytes.Equal(server.Data[corev1.TLSCertKey], renewed.Data[corev1.TLSCertKey]) {
+		t.Fatal("expected the certificate of the service to be issued again")
+	}
+	testHandshake(t, renewed, credentials, "198.51.100.7")
+}
@@ -2,21 +2,32 @@ package client
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
 	"time"
 
 	pb "github.com/converged-computing/ensemble-operator/protos"
 	"github.com/pkg/errors"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/credentials/insecure"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
 )
 
+// Time to wait for a request (including connecting, which happens on the
+// first request) before giving up
+var requestTimeout = 2 * time.Second
+
 // EnsembleClient interacts with client endpoints
 type EnsembleClient struct {
 	host       string
 	connection *grpc.ClientConn
 	service    pb.EnsembleOperatorClient
+	health     healthpb.HealthClient
 }
 
 var _ Client = (*EnsembleClient)(nil)
@@ -28,26 +39,86 @@ type Client interface {
 	RequestUpdate(ctx context.Context, in *pb.UpdateRequest, opts ...grpc.CallOption) (*pb.Response, error)
 	RequestStatus(ctx context.Context, in *pb.StatusRequest, opts ...grpc.CallOption) (*pb.Response, error)
 	RequestAction(ctx context.Context, in *pb.ActionRequest, opts ...grpc.CallOption) (*pb.Response, error)
+
+	// Check the health of the service
+	HealthCheck(ctx context.Context) error
+
+	// Close the connection
+	Close() error
+}
+
+// Option configures how the client connects
+type Option func(*options) error
+
+type options struct {
+	tlsConfig *tls.Config
+}
+
+// WithTLS verifies the server certificate with a CA (PEM), for the server
+// name (e.g., the service DNS name, if the host is an IP address)
+func WithTLS(caPEM []byte, serverName string) Option {
+	return func(o *options) error {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caPEM) {
+			return errors.New("CA certificate is not valid PEM")
+		}
+		if o.tlsConfig == nil {
+			o.tlsConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+		}
+		o.tlsConfig.RootCAs = pool
+		o.tlsConfig.ServerName = serverName
+		return nil
+	}
+}
+
+// WithMTLS is WithTLS, and also presents a client certificate (PEM) so a
+// server that requires one (mutual TLS) accepts the connection
+func WithMTLS(certPEM, keyPEM, caPEM []byte, serverName string) Option {
+	return func(o *options) error {
+		err := WithTLS(caPEM, serverName)(o)
+		if err != nil {
+			return err
+		}
+		cert, err := tls.X509KeyPair(certPEM, keyPEM)
+		if err != nil {
+			return errors.Wrap(err, "client certificate is not valid")
+		}
+		o.tlsConfig.Certificates = []tls.Certificate{cert}
+		return nil
+	}
 }
 
-// NewClient creates a new EnsembleClient
-func NewClient(host string) (Client, error) {
+// NewClient creates a new EnsembleClient. Without options, the connection
+// is insecure (no TLS).
+func NewClient(host string, opts ...Option) (Client, error) {
 	if host == "" {
 		return nil, errors.New("host is required")
 	}
+	o := &options{}
+	for _, opt := range opts {
+		err := opt(o)
+		if err != nil {
+			return nil, err
+		}
+	}
 
 	fmt.Printf("🥞️ starting client (%s)...", host)
 	c := &EnsembleClient{host: host}
 
-	// Set up a connection to the server.
+	// Set up a connection to the server. We don't block to connect, the
+	// first request does, so a server that isn't there costs one timeout.
 	creds := grpc.WithTransportCredentials(insecure.NewCredentials())
-	conn, err := grpc.Dial(c.GetHost(), creds, grpc.WithBlock())
+	if o.tlsConfig != nil {
+		creds = grpc.WithTransportCredentials(credentials.NewTLS(o.tlsConfig))
+	}
+	conn, err := grpc.Dial(c.GetHost(), creds)
 	if err != nil {
 		return nil, errors.Wrapf(err, "unable to connect to %s", host)
 	}
 
 	c.connection = conn
 	c.service = pb.NewEnsembleOperatorClient(conn)
+	c.health = healthpb.NewHealthClient(conn)
 
 	return c, nil
 }
@@ -79,10 +150,10 @@ func (c *EnsembleClient) RequestStatus(
 ) (*pb.Response, error) {
 
 	response := &pb.Response{}
-	if !c.Connected() {
+	if c.service == nil {
 		return response, errors.New("client is not connected")
 	}
-	ctx, cancel := context.WithTimeout(ctx, time.Second)
+	ctx, cancel := context.WithTimeout(ctx, requestTimeout)
 	defer cancel()
 
 	response, err := c.service.RequestStatus(ctx, in)
@@ -97,10 +168,10 @@ func (c *EnsembleClient) RequestUpdate(
 ) (*pb.Response, error) {
 
 	response := &pb.Response{}
-	if !c.Connected() {
+	if c.service == nil {
 		return response, errors.New("client is not connected")
 	}
-	ctx, cancel := context.WithTimeout(ctx, time.Second)
+	ctx, cancel := context.WithTimeout(ctx, requestTimeout)
 	defer cancel()
 
 	response, err := c.service.RequestUpdate(ctx, in)
@@ -114,12 +185,34 @@ func (c *EnsembleClient) RequestAction(
 ) (*pb.Response, error) {
 
 	response := &pb.Response{}
-	if !c.Connected() {
+	if c.service == nil {
 		return response, errors.New("client is not connected")
 	}
-	ctx, cancel := context.WithTimeout(ctx, time.Second)
+	ctx, cancel := context.WithTimeout(ctx, requestTimeout)
 	defer cancel()
 
 	response, err := c.service.RequestAction(ctx, in)
 	return response, err
 }
+
+// HealthCheck uses the standard gRPC health service to check that the server
+// is serving. A server without the health service is serving if connected.
+func (c *EnsembleClient) HealthCheck(ctx context.Context) error {
+	if c.health == nil {
+		return errors.New("client is not connected")
+	}
+	ctx, cancel := context.WithTimeout(ctx, requestTimeout)
+	defer cancel()
+
+	response, err := c.health.Check(ctx, &healthpb.HealthCheckRequest{})
+	if status.Code(err) == codes.Unimplemented {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if response.Status != healthpb.HealthCheckResponse_SERVING {
+		return fmt.Errorf("service is %s", response.Status)
+	}
+	return nil
+}
@@ -0,0 +1,185 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package client
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// startServer serves gRPC on a local port, optionally with the health service
+func startServer(t *testing.T, healthServer *health.Server) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := grpc.NewServer()
+	if healthServer != nil {
+		healthpb.RegisterHealthServer(server, healthServer)
+	}
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+	return listener.Addr().String()
+}
+
+func TestHealthCheck(t *testing.T) {
+	serving := health.NewServer()
+	notServing := health.NewServer()
+	notServing.SetServingStatus("", healthpb.HealthCheckResponse_NOT_SERVING)
+
+	tests := []struct {
+		name    string
+		health  *health.Server
+		healthy bool
+	}{
+		// A server without the health service is healthy when we can connect
+		{name: "unimplemented", healthy: true},
+		{name: "serving", health: serving, healthy: true},
+		{name: "not serving", health: notServing, healthy: false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c, err := NewClient(startServer(t, test.health))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+			err = c.HealthCheck(context.Background())
+			if test.healthy && err != nil {
+				t.Fatalf("expected healthy, got %s", err)
+			}
+			if !test.healthy && err == nil {
+				t.Fatal("expected an error for a service that is not serving")
+			}
+		})
+	}
+}
+
+// TestHealthCheckUnreachable checks a server that isn't there fails within the timeout
+func TestHealthCheckUnreachable(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	host := listener.Addr().String()
+	listener.Close()
+
+	start := time.Now()
+	c, err := NewClient(host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	err = c.HealthCheck(context.Background())
+	if err == nil {
+		t.Fatal("expected an error for a server that is not there")
+	}
+	if elapsed := time.Since(start); elapsed > requestTimeout+time.Second {
+		t.Fatalf("health check took %s, longer than the request timeout", elapsed)
+	}
+}
+
+func TestWithMTLS(t *testing.T) {
+	caPEM, certPEM, keyPEM := newTestCertificates(t)
+	tests := []struct {
+		name  string
+		ca    []byte
+		cert  []byte
+		key   []byte
+		error string
+	}{
+		{name: "valid", ca: caPEM, cert: certPEM, key: keyPEM},
+		{name: "CA is not PEM", ca: []byte("not a certificate"), cert: certPEM, key: keyPEM, error: "CA certificate is not valid PEM"},
+		{name: "CA is empty", cert: certPEM, key: keyPEM, error: "CA certificate is not valid PEM"},
+		{name: "key does not match", ca: caPEM, cert: certPEM, key: []byte("not a key"), error: "client certificate is not valid"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c, err := NewClient("127.0.0.1:50051", WithMTLS(test.cert, test.key, test.ca, "ensemble-grpc.default.svc"))
+			if test.error == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				c.Close()
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), test.error) {
+				t.Fatalf("expected error %q, got %v", test.error, err)
+			}
+		})
+	}
+}
+
+// newTestCertificates returns a self-signed CA, and a client certificate and
+// key signed by it (PEM)
+func newTestCertificates(t *testing.T) ([]byte, []byte, []byte) {
+	t.Helper()
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, ca, ca, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "member"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, cert, ca, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER}),
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
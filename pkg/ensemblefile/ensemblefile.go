@@ -0,0 +1,150 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ensemblefile
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"sigs.k8s.io/yaml"
+)
+
+// Types model the ensemble.yaml that ensemble-python runs, e.g.,
+//
+//	logging:
+//	  debug: false
+//	  heartbeat: 3
+//	jobs:
+//	  - name: sleep
+//	    command: sleep 10
+//	    count: 1
+//	    nodes: 1
+//	rules:
+//	  - trigger: metric
+//	    name: count.sleep.success
+//	    when: 1
+//	    action:
+//	      name: submit
+//	      label: echo
+
+// EnsembleFile is the ensemble.yaml for a member
+type EnsembleFile struct {
+	Logging Logging `json:"logging,omitempty"`
+	Jobs    []Job   `json:"jobs,omitempty"`
+	Rules   []Rule  `json:"rules,omitempty"`
+
+	// Custom is Python with functions for custom actions
+	Custom string `json:"custom,omitempty"`
+}
+
+// Logging for the ensemble, and the heartbeat (seconds) to check metrics
+type Logging struct {
+	Debug     bool  `json:"debug,omitempty"`
+	Heartbeat int32 `json:"heartbeat,omitempty"`
+}
+
+// Job is a group of jobs the ensemble can submit, by name (the label)
+type Job struct {
+	Name     string `json:"name"`
+	Command  string `json:"command"`
+	Count    int32  `json:"count,omitempty"`
+	Nodes    int32  `json:"nodes,omitempty"`
+	Tasks    int32  `json:"tasks,omitempty"`
+	Duration int32  `json:"duration,omitempty"`
+}
+
+// Rule is an action to take when a trigger happens
+type Rule struct {
+	Trigger string `json:"trigger"`
+
+	// Name is the job for a job trigger, or the metric for a metric trigger
+	Name string `json:"name,omitempty"`
+
+	// When is a value or comparison (e.g., "> 5") for a metric
+	When   When   `json:"when,omitempty"`
+	Action Action `json:"action"`
+}
+
+// Action is what the ensemble does when a rule is triggered
+type Action struct {
+	Name string `json:"name"`
+
+	// Label is the job for a submit action
+	Label string `json:"label,omitempty"`
+
+	// Value to grow or shrink by
+	Value int32 `json:"value,omitempty"`
+
+	// Repetitions is the number of times the action can run (default 1),
+	// and backoff the number of checks to wait in between
+	Repetitions int32 `json:"repetitions,omitempty"`
+	Backoff     int32 `json:"backoff,omitempty"`
+}
+
+// When can be a number (when: 1) or a string (when: "> 5")
+type When string
+
+// UnmarshalJSON keeps a number as its string
+func (w *When) UnmarshalJSON(data []byte) error {
+	if len(data) > 0 && data[0] == '"' {
+		var value string
+		err := json.Unmarshal(data, &value)
+		if err != nil {
+			return err
+		}
+		*w = When(value)
+		return nil
+	}
+	var number json.Number
+	err := json.Unmarshal(data, &number)
+	if err != nil {
+		return fmt.Errorf("when must be a number or a string: %s", err)
+	}
+	*w = When(number.String())
+	return nil
+}
+
+// Parse reads an ensemble.yaml. Fields that are not known (e.g., a misspelled
+// key) are an error, since ensemble-python would ignore them.
+func Parse(content string) (*EnsembleFile, error) {
+	file := &EnsembleFile{}
+	err := yaml.UnmarshalStrict([]byte(content), file)
+	if err != nil {
+		return nil, fmt.Errorf("ensemble yaml is not valid: %s", err)
+	}
+	return file, nil
+}
+
+// GetJob returns a job by name, or nil
+func (f *EnsembleFile) GetJob(name string) *Job {
+	for i := range f.Jobs {
+		if f.Jobs[i].Name == name {
+			return &f.Jobs[i]
+		}
+	}
+	return nil
+}
+
+// JobNames returns the names of the jobs, for messages
+func (f *EnsembleFile) JobNames() string {
+	names := []string{}
+	for _, job := range f.Jobs {
+		names = append(names, job.Name)
+	}
+	return strings.Join(names, ", ")
+}
@@ -0,0 +1,167 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ensemblefile
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+var (
+	// Triggers that ensemble-python knows about
+	triggers = []string{
+		"start", "metric", "heartbeat",
+		"job-submit", "job-start", "job-finish", "job-cancel", "job-depend",
+	}
+
+	// Actions that ensemble-python knows about
+	actions = []string{"submit", "terminate", "grow", "shrink", "custom"}
+
+	// Metrics are counts of job events, e.g., count.sleep.success, or
+	// a summary statistic of a job model, e.g., mean.sleep-pending
+	countMetricRegex = regexp.MustCompile(`^count\.(.+)\.(success|failed|cancelled)$`)
+	modelMetricRegex = regexp.MustCompile(`^(mean|variance|iqr|min|max)\.(.+)-(duration|pending)$`)
+
+	// A metric is compared to a value, e.g., 1 or "> 5"
+	whenRegex = regexp.MustCompile(`^\s*(>=|<=|==|!=|>|<)?\s*-?[0-9]+(\.[0-9]+)?\s*$`)
+)
+
+// Validate checks the ensemble file for jobs and rules that ensemble-python
+// would fail on at runtime. Errors are relative to the path of the file.
+func (f *EnsembleFile) Validate(path *field.Path) field.ErrorList {
+	allErrs := field.ErrorList{}
+
+	if f.Logging.Heartbeat < 0 {
+		allErrs = append(allErrs, field.Invalid(path.Child("logging", "heartbeat"), f.Logging.Heartbeat, "must be 0 or more"))
+	}
+
+	// Jobs are referenced by name, so they need one (and only one)
+	seen := map[string]bool{}
+	for i, job := range f.Jobs {
+		jobPath := path.Child("jobs").Index(i)
+		if job.Name == "" {
+			allErrs = append(allErrs, field.Required(jobPath.Child("name"), "a job needs a name"))
+		} else if seen[job.Name] {
+			allErrs = append(allErrs, field.Duplicate(jobPath.Child("name"), job.Name))
+		}
+		seen[job.Name] = true
+		if job.Command == "" {
+			allErrs = append(allErrs, field.Required(jobPath.Child("command"), "a job needs a command"))
+		}
+		if job.Count < 0 {
+			allErrs = append(allErrs, field.Invalid(jobPath.Child("count"), job.Count, "must be 0 or more"))
+		}
+		if job.Nodes < 0 {
+			allErrs = append(allErrs, field.Invalid(jobPath.Child("nodes"), job.Nodes, "must be 0 or more"))
+		}
+	}
+
+	for i := range f.Rules {
+		allErrs = append(allErrs, f.validateRule(&f.Rules[i], path.Child("rules").Index(i))...)
+	}
+	return allErrs
+}
+
+// validateRule checks the trigger and action of a rule
+func (f *EnsembleFile) validateRule(rule *Rule, path *field.Path) field.ErrorList {
+	allErrs := field.ErrorList{}
+
+	switch {
+	case !contains(triggers, rule.Trigger):
+		allErrs = append(allErrs, field.NotSupported(path.Child("trigger"), rule.Trigger, triggers))
+
+	// Metrics are named for a job, and compared to a value
+	case rule.Trigger == "metric":
+		allErrs = append(allErrs, f.validateMetric(rule.Name, path.Child("name"))...)
+		if rule.When == "" {
+			allErrs = append(allErrs, field.Required(path.Child("when"), "a metric rule needs a value to compare to"))
+		} else if !whenRegex.MatchString(string(rule.When)) {
+			allErrs = append(allErrs, field.Invalid(path.Child("when"), rule.When, "must be a number, or a comparison like \"> 5\""))
+		}
+
+	// Job triggers are for a job by name
+	case strings.HasPrefix(rule.Trigger, "job-"):
+		if rule.Name == "" {
+			allErrs = append(allErrs, field.Required(path.Child("name"), "a job trigger needs the name of a job"))
+		} else if f.GetJob(rule.Name) == nil {
+			allErrs = append(allErrs, f.jobNotFound(path.Child("name"), rule.Name))
+		}
+	}
+
+	action := rule.Action
+	actionPath := path.Child("action")
+	switch {
+	case action.Name == "":
+		allErrs = append(allErrs, field.Required(actionPath.Child("name"), "a rule needs an action"))
+	case !contains(actions, action.Name):
+		allErrs = append(allErrs, field.NotSupported(actionPath.Child("name"), action.Name, actions))
+	case action.Name == "submit":
+		if action.Label == "" {
+			allErrs = append(allErrs, field.Required(actionPath.Child("label"), "a submit action needs the name of a job"))
+		} else if f.GetJob(action.Label) == nil {
+			allErrs = append(allErrs, f.jobNotFound(actionPath.Child("label"), action.Label))
+		}
+	}
+	if action.Value < 0 {
+		allErrs = append(allErrs, field.Invalid(actionPath.Child("value"), action.Value, "must be 0 or more"))
+	}
+	if action.Repetitions < 0 {
+		allErrs = append(allErrs, field.Invalid(actionPath.Child("repetitions"), action.Repetitions, "must be 0 or more"))
+	}
+	if action.Backoff < 0 {
+		allErrs = append(allErrs, field.Invalid(actionPath.Child("backoff"), action.Backoff, "must be 0 or more"))
+	}
+	return allErrs
+}
+
+// validateMetric checks a metric name is well formed, and for a job that exists
+func (f *EnsembleFile) validateMetric(name string, path *field.Path) field.ErrorList {
+	if name == "" {
+		return field.ErrorList{field.Required(path, "a metric rule needs the name of a metric")}
+	}
+	job := ""
+	if match := countMetricRegex.FindStringSubmatch(name); match != nil {
+		job = match[1]
+	} else if match := modelMetricRegex.FindStringSubmatch(name); match != nil {
+		job = match[2]
+	} else {
+		return field.ErrorList{field.Invalid(path, name,
+			"metric must be count.<job>.<success|failed|cancelled> or <mean|variance|iqr|min|max>.<job>-<duration|pending>")}
+	}
+	if f.GetJob(job) == nil {
+		return field.ErrorList{f.jobNotFound(path, job)}
+	}
+	return nil
+}
+
+// jobNotFound is an error for a reference to a job that does not exist
+func (f *EnsembleFile) jobNotFound(path *field.Path, name string) *field.Error {
+	return field.NotFound(path, fmt.Sprintf("%s (jobs are: %s)", name, f.JobNames()))
+}
+
+// contains determines if a list has a value
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,250 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ensemblefile
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"sigs.k8s.io/yaml"
+)
+
+const validEnsemble = `
+logging:
+  debug: false
+  heartbeat: 3
+jobs:
+  - name: sleep
+    command: sleep 10
+    count: 1
+    nodes: 1
+rules:
+  - trigger: start
+    action:
+      name: submit
+      label: sleep
+  - trigger: metric
+    name: count.sleep.success
+    when: 1
+    action:
+      name: terminate
+  - trigger: metric
+    name: mean.sleep-pending
+    when: "> 5"
+    action:
+      name: grow
+      repetitions: 2
+      backoff: 1
+`
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+
+		// An error from parsing, or the fields with validation errors
+		parseError string
+		fields     []string
+	}{
+		{
+			name:    "valid",
+			content: validEnsemble,
+		},
+		{
+			name: "unknown key",
+			content: `
+jobs:
+  - name: sleep
+    command: sleep 10
+rules:
+  - trigger: job-finish
+    name: sleep
+    action:
+      name: submit
+      label: sleep
+      repetitons: 5
+`,
+			parseError: `unknown field "repetitons"`,
+		},
+		{
+			name:       "unknown top level key",
+			content:    "job:\n  - name: sleep\n    command: sleep 10\n",
+			parseError: `unknown field "job"`,
+		},
+		{
+			name: "bad rule action",
+			content: `
+jobs:
+  - name: sleep
+    command: sleep 10
+rules:
+  - trigger: start
+    action:
+      name: explode
+`,
+			fields: []string{"ensemble.rules[0].action.name"},
+		},
+		{
+			name: "bad trigger",
+			content: `
+rules:
+  - trigger: job-finsh
+    action:
+      name: terminate
+`,
+			fields: []string{"ensemble.rules[0].trigger"},
+		},
+		{
+			name: "bad metric name",
+			content: `
+jobs:
+  - name: sleep
+    command: sleep 10
+rules:
+  - trigger: metric
+    name: count.sleep.done
+    when: 1
+    action:
+      name: terminate
+`,
+			fields: []string{"ensemble.rules[0].name"},
+		},
+		{
+			name: "metric for a job that does not exist",
+			content: `
+jobs:
+  - name: sleep
+    command: sleep 10
+rules:
+  - trigger: metric
+    name: mean.echo-duration
+    when: "> 5"
+    action:
+      name: terminate
+`,
+			fields: []string{"ensemble.rules[0].name"},
+		},
+		{
+			name: "bad when",
+			content: `
+jobs:
+  - name: sleep
+    command: sleep 10
+rules:
+  - trigger: metric
+    name: count.sleep.success
+    when: "more than 5"
+    action:
+      name: terminate
+`,
+			fields: []string{"ensemble.rules[0].when"},
+		},
+		{
+			name: "submit a job that does not exist",
+			content: `
+jobs:
+  - name: sleep
+    command: sleep 10
+rules:
+  - trigger: start
+    action:
+      name: submit
+      label: echo
+`,
+			fields: []string{"ensemble.rules[0].action.label"},
+		},
+		{
+			name: "duplicate and incomplete jobs",
+			content: `
+jobs:
+  - name: sleep
+    command: sleep 10
+  - name: sleep
+  - command: echo hello
+`,
+			fields: []string{"ensemble.jobs[1].name", "ensemble.jobs[1].command", "ensemble.jobs[2].name"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			file, err := Parse(test.content)
+			if test.parseError != "" {
+				if err == nil || !strings.Contains(err.Error(), test.parseError) {
+					t.Fatalf("expected parse error %q, got %v", test.parseError, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected parse error: %s", err)
+			}
+			assertFields(t, file.Validate(field.NewPath("ensemble")), test.fields)
+		})
+	}
+}
+
+// TestValidateExamples checks the ensembles of the examples are valid
+func TestValidateExamples(t *testing.T) {
+	paths, err := filepath.Glob(filepath.Join("..", "..", "examples", "*", "ensemble.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) == 0 {
+		t.Fatal("did not find any examples")
+	}
+	for _, path := range paths {
+		t.Run(path, func(t *testing.T) {
+			content, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			example := struct {
+				Spec struct {
+					Members []struct {
+						Ensemble string `json:"ensemble"`
+					} `json:"members"`
+				} `json:"spec"`
+			}{}
+			err = yaml.Unmarshal(content, &example)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, member := range example.Spec.Members {
+				file, err := Parse(member.Ensemble)
+				if err != nil {
+					t.Fatalf("unexpected parse error: %s", err)
+				}
+				assertFields(t, file.Validate(field.NewPath("ensemble")), nil)
+			}
+		})
+	}
+}
+
+// assertFields checks the errors are for the expected fields, in order
+func assertFields(t *testing.T, errs field.ErrorList, expected []string) {
+	t.Helper()
+	fields := []string{}
+	for _, err := range errs {
+		fields = append(fields, err.Field)
+	}
+	if strings.Join(fields, ",") != strings.Join(expected, ",") {
+		t.Fatalf("expected errors for %v, got %v", expected, errs)
+	}
+}
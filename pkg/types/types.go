@@ -80,3 +80,23 @@ func (m *MiniClusterStatus) GetRandomWaitingSize() int32 {
 	}
 	return selection[rand.Intn(len(selection))]
 }
+
+// ExternalMemberStatus is returned by the gRPC sidecar for a member
+// that runs outside of the cluster, and looks like:
+//
+//	{
+//	   "heartbeat": 1718836462,
+//	   "size": 4,
+//	   "phase": "running"
+//	}
+type ExternalMemberStatus struct {
+
+	// Unix timestamp (seconds) of the last heartbeat from the member
+	Heartbeat int64 `json:"heartbeat"`
+
+	// Size reported by the member
+	Size int32 `json:"size"`
+
+	// Phase reported by the member (running, completed, failed)
+	Phase string `json:"phase"`
+}